@@ -0,0 +1,315 @@
+package accountDeletion
+
+import (
+	"chatapp-backend/internal/globals"
+	"chatapp-backend/internal/hub"
+	"chatapp-backend/internal/models"
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// accounts are deleted a grace period after the user asked for it, logging in before that cancels it.
+// messages either go with the account or stay under a placeholder user,
+// owned servers are handed to their longest standing member or deleted along with the account
+
+const GracePeriod = 14 * 24 * time.Hour
+
+// variables so tests can make them shorter
+var (
+	pollInterval = time.Minute
+	batchSize    = 20
+)
+
+var sugar *zap.SugaredLogger
+var db *sql.DB
+
+var ctx, cancel = context.WithCancel(context.Background())
+var waitGroup sync.WaitGroup
+
+// deletion is what clients have to be told about once the account is gone
+type deletion struct {
+	userID             int64
+	deletedServers     []int64
+	transferredServers []models.Server
+	leftServers        []int64
+	relatedUsers       []int64
+	bots               []int64
+}
+
+func Setup(_sugar *zap.SugaredLogger, _db *sql.DB) {
+	sugar = _sugar
+	db = _db
+
+	waitGroup.Add(1)
+	go runDeletions()
+}
+
+// Shutdown waits for the deletion in progress, the rest are picked up by the next node to start
+func Shutdown(ctx context.Context) error {
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		waitGroup.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func runDeletions() {
+	defer waitGroup.Done()
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, err := deleteDue()
+			if err != nil {
+				sugar.Error(err)
+			}
+		}
+	}
+}
+
+// deleteDue deletes the accounts whose grace period is over, returns how many were deleted
+func deleteDue() (int, error) {
+	rows, err := db.Query("SELECT user_id FROM account_deletions WHERE delete_at <= $1 LIMIT $2", time.Now().UTC(), batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			sugar.Error(err)
+		}
+	}()
+
+	var userIDs []int64
+	for rows.Next() {
+		var userID int64
+		err := rows.Scan(&userID)
+		if err != nil {
+			return 0, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, userID := range userIDs {
+		d, ok, err := deleteAccount(userID)
+		if err != nil {
+			sugar.Error(err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		deleted++
+
+		err = emitDeletion(d)
+		if err != nil {
+			sugar.Error(err)
+		}
+	}
+
+	return deleted, nil
+}
+
+func queryIDs(tx *sql.Tx, query string, args ...any) ([]int64, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			sugar.Error(err)
+		}
+	}()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// deleteAccount does nothing and returns false if the deletion was cancelled in the meantime,
+// or another node already took care of it
+func deleteAccount(userID int64) (deletion, bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return deletion{}, false, err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			sugar.Error(err)
+		}
+	}()
+
+	var removeMessages bool
+	var transferServers bool
+	err = tx.QueryRow("DELETE FROM account_deletions WHERE user_id = $1 AND delete_at <= $2 RETURNING remove_messages, transfer_servers", userID, time.Now().UTC()).
+		Scan(&removeMessages, &transferServers)
+	if errors.Is(err, sql.ErrNoRows) {
+		return deletion{}, false, nil
+	}
+	if err != nil {
+		return deletion{}, false, err
+	}
+
+	d := deletion{userID: userID}
+
+	ownedServers, err := queryIDs(tx, "SELECT id FROM servers WHERE owner_id = $1", userID)
+	if err != nil {
+		return deletion{}, false, err
+	}
+
+	for _, serverID := range ownedServers {
+		var newOwnerID int64
+		if transferServers {
+			err = tx.QueryRow(`
+				SELECT
+					user_id
+				FROM
+					server_members
+				WHERE
+					server_id = $1 AND user_id != $2 AND
+					NOT EXISTS(SELECT 1 FROM bots WHERE bots.id = server_members.user_id)
+				ORDER BY
+					since
+				LIMIT 1
+			`, serverID, userID).Scan(&newOwnerID)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return deletion{}, false, err
+			}
+		}
+
+		// nobody to hand it to
+		if newOwnerID == 0 {
+			_, err = tx.Exec("DELETE FROM servers WHERE id = $1", serverID)
+			if err != nil {
+				return deletion{}, false, err
+			}
+			d.deletedServers = append(d.deletedServers, serverID)
+			continue
+		}
+
+		var server models.Server
+		err = tx.QueryRow("UPDATE servers SET owner_id = $1 WHERE id = $2 RETURNING id, owner_id, name, COALESCE(picture, ''), COALESCE(banner, '')", newOwnerID, serverID).
+			Scan(&server.ID, &server.OwnerID, &server.Name, &server.Picture, &server.Banner)
+		if err != nil {
+			return deletion{}, false, err
+		}
+		d.transferredServers = append(d.transferredServers, server)
+	}
+
+	d.leftServers, err = queryIDs(tx, "SELECT server_id FROM server_members WHERE user_id = $1", userID)
+	if err != nil {
+		return deletion{}, false, err
+	}
+
+	d.relatedUsers, err = queryIDs(tx, "SELECT other_user_id FROM relationships WHERE user_id = $1 UNION SELECT user_id FROM relationships WHERE other_user_id = $1", userID)
+	if err != nil {
+		return deletion{}, false, err
+	}
+
+	d.bots, err = queryIDs(tx, "SELECT id FROM bots WHERE owner_id = $1", userID)
+	if err != nil {
+		return deletion{}, false, err
+	}
+
+	// messages of the bots go the same way, deleting the bots would cascade them otherwise
+	if removeMessages {
+		_, err = tx.Exec("DELETE FROM messages WHERE user_id = $1 OR user_id IN (SELECT id FROM bots WHERE owner_id = $1)", userID)
+	} else {
+		_, err = tx.Exec("UPDATE messages SET user_id = $1 WHERE user_id = $2 OR user_id IN (SELECT id FROM bots WHERE owner_id = $2)", globals.DeletedUserID, userID)
+	}
+	if err != nil {
+		return deletion{}, false, err
+	}
+
+	// only the bots rows would cascade, the users rows of the bots have to be deleted too
+	_, err = tx.Exec("DELETE FROM users WHERE id IN (SELECT id FROM bots WHERE owner_id = $1)", userID)
+	if err != nil {
+		return deletion{}, false, err
+	}
+
+	// everything else of the user cascades
+	_, err = tx.Exec("DELETE FROM users WHERE id = $1", userID)
+	if err != nil {
+		return deletion{}, false, err
+	}
+
+	return d, true, tx.Commit()
+}
+
+func emitDeletion(d deletion) error {
+	for _, serverID := range d.deletedServers {
+		err := hub.Emit(hub.ServerDeleted, globals.ChannelTypeServerList, serverID, serverID)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, server := range d.transferredServers {
+		err := hub.Emit(hub.ServerModified, globals.ChannelTypeServerList, server, server.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, serverID := range d.leftServers {
+		member := models.ServerMember{
+			ServerID: serverID,
+			User:     models.User{ID: d.userID},
+		}
+
+		err := hub.Emit(hub.MemberLeft, globals.ChannelTypeServer, member, serverID)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, otherUserID := range d.relatedUsers {
+		err := hub.EmitToUser(hub.RelationshipRemoved, d.userID, otherUserID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// sessions were closed when the deletion was asked for, bots are still connected
+	for _, userID := range append(d.bots, d.userID) {
+		err := hub.DisconnectUser(userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,198 @@
+package accountDeletion
+
+import (
+	"chatapp-backend/internal/database"
+	"chatapp-backend/internal/database/databaseTest"
+	"chatapp-backend/internal/globals"
+	"slices"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	deletedUser = 10
+	memberUser  = 11
+	botUser     = 12
+
+	sharedServer = 20
+	lonelyServer = 21
+	otherServer  = 22
+
+	channel = 30
+)
+
+func setupTest(t *testing.T) {
+	t.Helper()
+
+	db = databaseTest.Open(t)
+
+	// the deletion relies on cascades
+	_, err := db.Exec("PRAGMA foreign_keys = ON")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sugar = zap.NewNop().Sugar()
+
+	exec(t, "INSERT INTO users (id, email, username, display_name, picture, password) VALUES($1, $2, $3, $4, '', '')", deletedUser, "deleted@gmail.com", "deleted", "deleted")
+	exec(t, "INSERT INTO users (id, email, username, display_name, picture, password) VALUES($1, $2, $3, $4, '', '')", memberUser, "member@gmail.com", "member", "member")
+	exec(t, "INSERT INTO users (id, email, username, display_name, picture, password) VALUES($1, $2, $3, $4, '', '')", botUser, "12@bots.invalid", "12", "bot")
+	exec(t, "INSERT INTO bots (id, owner_id, token_hash, token_id) VALUES($1, $2, '', 0)", botUser, deletedUser)
+
+	exec(t, "INSERT INTO servers (id, owner_id, name) VALUES($1, $2, 'shared')", sharedServer, deletedUser)
+	exec(t, "INSERT INTO servers (id, owner_id, name) VALUES($1, $2, 'lonely')", lonelyServer, deletedUser)
+	exec(t, "INSERT INTO servers (id, owner_id, name) VALUES($1, $2, 'other')", otherServer, memberUser)
+
+	// the bot joined before the member, but can't be handed a server
+	exec(t, "INSERT INTO server_members (server_id, user_id, since) VALUES($1, $2, $3)", sharedServer, deletedUser, time.Now().Add(-3*time.Hour))
+	exec(t, "INSERT INTO server_members (server_id, user_id, since) VALUES($1, $2, $3)", sharedServer, botUser, time.Now().Add(-2*time.Hour))
+	exec(t, "INSERT INTO server_members (server_id, user_id, since) VALUES($1, $2, $3)", sharedServer, memberUser, time.Now().Add(-time.Hour))
+	exec(t, "INSERT INTO server_members (server_id, user_id, since) VALUES($1, $2, $3)", lonelyServer, deletedUser, time.Now())
+	exec(t, "INSERT INTO server_members (server_id, user_id, since) VALUES($1, $2, $3)", otherServer, memberUser, time.Now())
+	exec(t, "INSERT INTO server_members (server_id, user_id, since) VALUES($1, $2, $3)", otherServer, deletedUser, time.Now())
+
+	exec(t, "INSERT INTO channels (id, server_id, name) VALUES($1, $2, 'general')", channel, otherServer)
+	exec(t, "INSERT INTO messages (id, channel_id, user_id, message, edited) VALUES(40, $1, $2, 'hello', FALSE)", channel, deletedUser)
+	exec(t, "INSERT INTO messages (id, channel_id, user_id, message, edited) VALUES(41, $1, $2, 'hi', FALSE)", channel, memberUser)
+	exec(t, "INSERT INTO messages (id, channel_id, user_id, message, edited) VALUES(42, $1, $2, 'beep', FALSE)", channel, botUser)
+
+	exec(t, "INSERT INTO relationships (user_id, other_user_id, type, since) VALUES($1, $2, 'friend', $3)", deletedUser, memberUser, time.Now())
+	exec(t, "INSERT INTO relationships (user_id, other_user_id, type, since) VALUES($1, $2, 'friend', $3)", memberUser, deletedUser, time.Now())
+}
+
+func exec(t *testing.T, query string, args ...any) {
+	t.Helper()
+
+	_, err := db.Exec(query, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func count(t *testing.T, query string, args ...any) int {
+	t.Helper()
+
+	var n int
+	err := db.QueryRow(query, args...).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func schedule(t *testing.T, deleteAt time.Time, removeMessages bool, transferServers bool) {
+	t.Helper()
+
+	exec(t, "INSERT INTO account_deletions (user_id, requested_at, delete_at, remove_messages, transfer_servers) VALUES($1, $2, $3, $4, $5)",
+		deletedUser, time.Now().UTC(), deleteAt.UTC(), removeMessages, transferServers)
+}
+
+func TestTransferServersAndKeepMessages(t *testing.T) {
+	setupTest(t)
+	schedule(t, time.Now().Add(-time.Minute), false, true)
+
+	d, ok, err := deleteAccount(deletedUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("due deletion wasn't done")
+	}
+
+	if count(t, "SELECT COUNT(*) FROM users WHERE id IN ($1, $2)", deletedUser, botUser) != 0 {
+		t.Error("user and their bot should be deleted")
+	}
+
+	if len(d.transferredServers) != 1 || d.transferredServers[0].ID != sharedServer || d.transferredServers[0].OwnerID != memberUser {
+		t.Errorf("shared server should be handed to the member, got %+v", d.transferredServers)
+	}
+	if !slices.Equal(d.deletedServers, []int64{lonelyServer}) {
+		t.Errorf("server without other members should be deleted, got %v", d.deletedServers)
+	}
+	if count(t, "SELECT COUNT(*) FROM servers WHERE id = $1", lonelyServer) != 0 {
+		t.Error("lonely server is still there")
+	}
+
+	slices.Sort(d.leftServers)
+	if !slices.Equal(d.leftServers, []int64{sharedServer, otherServer}) {
+		t.Errorf("expected to leave the remaining servers, got %v", d.leftServers)
+	}
+	if !slices.Equal(d.relatedUsers, []int64{memberUser}) {
+		t.Errorf("expected the friend to be told, got %v", d.relatedUsers)
+	}
+	if !slices.Equal(d.bots, []int64{botUser}) {
+		t.Errorf("expected the bot to be disconnected, got %v", d.bots)
+	}
+
+	if count(t, "SELECT COUNT(*) FROM messages WHERE id IN (40, 42) AND user_id = $1", globals.DeletedUserID) != 2 {
+		t.Error("messages of the user and their bot should be kept under the placeholder user")
+	}
+	if count(t, "SELECT COUNT(*) FROM relationships") != 0 {
+		t.Error("relationships should be gone")
+	}
+}
+
+func TestDeleteServersAndMessages(t *testing.T) {
+	setupTest(t)
+	schedule(t, time.Now().Add(-time.Minute), true, false)
+
+	d, ok, err := deleteAccount(deletedUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("due deletion wasn't done")
+	}
+
+	slices.Sort(d.deletedServers)
+	if !slices.Equal(d.deletedServers, []int64{sharedServer, lonelyServer}) || len(d.transferredServers) != 0 {
+		t.Errorf("every owned server should be deleted, got %v and %+v", d.deletedServers, d.transferredServers)
+	}
+
+	if count(t, "SELECT COUNT(*) FROM messages") != 1 {
+		t.Error("only the message of the other user should be left, the bot's goes too")
+	}
+}
+
+func TestNotDueOrCancelled(t *testing.T) {
+	setupTest(t)
+	schedule(t, time.Now().Add(time.Hour), false, false)
+
+	_, ok, err := deleteAccount(deletedUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("deletion isn't due yet")
+	}
+
+	exec(t, "DELETE FROM account_deletions WHERE user_id = $1", deletedUser)
+
+	_, ok, err = deleteAccount(deletedUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("cancelled deletion was done")
+	}
+
+	if count(t, "SELECT COUNT(*) FROM users WHERE id = $1", deletedUser) != 1 {
+		t.Error("user should still exist")
+	}
+}
+
+func TestDeletedUserPlaceholder(t *testing.T) {
+	setupTest(t)
+
+	// running the setup again must not fail on the existing placeholder
+	err := database.SetupTables(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count(t, "SELECT COUNT(*) FROM users WHERE id = $1 AND password = ''", globals.DeletedUserID) != 1 {
+		t.Error("placeholder user should exist without a password")
+	}
+}
@@ -0,0 +1,192 @@
+package commands
+
+import (
+	"chatapp-backend/internal/models"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// slash commands are registered by bots per server, a message like `/roll 2 "big dice"` runs the command roll
+// with its options given in order, the message isn't stored but sent to the bot as an interaction
+
+const (
+	OptionString  = "string"
+	OptionInteger = "integer"
+	OptionNumber  = "number"
+	OptionBoolean = "boolean"
+	OptionUser    = "user"
+	OptionChannel = "channel"
+)
+
+const maxOptions = 25
+const maxDescriptionLength = 100
+const maxStringLength = 1000
+
+var nameRegex = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// Validate checks the command a bot wants to register
+func Validate(name string, description string, options []models.CommandOption) error {
+	if !nameRegex.MatchString(name) {
+		return fmt.Errorf("command name [%s] must be 1-32 lowercase letters, numbers, - or _", name)
+	}
+	if len(description) > maxDescriptionLength {
+		return fmt.Errorf("description can't be longer than %d characters", maxDescriptionLength)
+	}
+	if len(options) > maxOptions {
+		return fmt.Errorf("a command can't have more than %d options", maxOptions)
+	}
+
+	names := make(map[string]bool, len(options))
+	optional := false
+	for _, option := range options {
+		if !nameRegex.MatchString(option.Name) {
+			return fmt.Errorf("option name [%s] must be 1-32 lowercase letters, numbers, - or _", option.Name)
+		}
+		if names[option.Name] {
+			return fmt.Errorf("option name [%s] is used more than once", option.Name)
+		}
+		names[option.Name] = true
+
+		if len(option.Description) > maxDescriptionLength {
+			return fmt.Errorf("description of option [%s] can't be longer than %d characters", option.Name, maxDescriptionLength)
+		}
+
+		switch option.Type {
+		case OptionString, OptionInteger, OptionNumber, OptionBoolean, OptionUser, OptionChannel:
+		default:
+			return fmt.Errorf("option [%s] has unknown type [%s]", option.Name, option.Type)
+		}
+
+		// options are given in order, so a required one can't come after one that can be left out
+		if option.Required && optional {
+			return fmt.Errorf("required option [%s] can't come after optional ones", option.Name)
+		}
+		optional = !option.Required
+	}
+
+	return nil
+}
+
+// Split returns the name of the command and its arguments, ok is false if the message isn't a command
+func Split(message string) (string, string, bool) {
+	message = strings.TrimSpace(message)
+	if !strings.HasPrefix(message, "/") {
+		return "", "", false
+	}
+
+	name, args, _ := strings.Cut(message[1:], " ")
+	if !nameRegex.MatchString(name) {
+		return "", "", false
+	}
+
+	return name, strings.TrimSpace(args), true
+}
+
+// nextArgument returns the first argument and the rest, an argument is either a word or a "quoted text"
+func nextArgument(args string) (string, string, error) {
+	args = strings.TrimLeft(args, " ")
+
+	if quoted, found := strings.CutPrefix(args, `"`); found {
+		argument, rest, closed := strings.Cut(quoted, `"`)
+		if !closed {
+			return "", "", errors.New("quote isn't closed")
+		}
+		return argument, rest, nil
+	}
+
+	argument, rest, _ := strings.Cut(args, " ")
+	return argument, rest, nil
+}
+
+// ParseOptions fills the options of a command from its arguments, which are given in the order of the options,
+// the last option takes the rest of the message if it's a string, so it doesn't need quotes.
+// user and channel options are returned as ID strings, checking them is up to the caller
+func ParseOptions(options []models.CommandOption, args string) (map[string]any, error) {
+	values := make(map[string]any, len(options))
+
+	for i, option := range options {
+		var argument string
+		var err error
+
+		if i == len(options)-1 && option.Type == OptionString && !strings.HasPrefix(strings.TrimSpace(args), `"`) {
+			argument, args = strings.TrimSpace(args), ""
+		} else {
+			argument, args, err = nextArgument(args)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if argument == "" {
+			if option.Required {
+				return nil, fmt.Errorf("option [%s] is missing", option.Name)
+			}
+			continue
+		}
+
+		value, err := parseValue(option.Type, argument)
+		if err != nil {
+			return nil, fmt.Errorf("option [%s] %w", option.Name, err)
+		}
+		values[option.Name] = value
+	}
+
+	if strings.TrimSpace(args) != "" {
+		return nil, errors.New("too many arguments")
+	}
+
+	return values, nil
+}
+
+func parseValue(optionType string, argument string) (any, error) {
+	switch optionType {
+	case OptionString:
+		if len(argument) > maxStringLength {
+			return nil, fmt.Errorf("can't be longer than %d characters", maxStringLength)
+		}
+		return argument, nil
+	case OptionInteger:
+		value, err := strconv.ParseInt(argument, 10, 64)
+		if err != nil {
+			return nil, errors.New("must be a whole number")
+		}
+		return value, nil
+	case OptionNumber:
+		value, err := strconv.ParseFloat(argument, 64)
+		if err != nil {
+			return nil, errors.New("must be a number")
+		}
+		return value, nil
+	case OptionBoolean:
+		switch strings.ToLower(argument) {
+		case "true", "yes":
+			return true, nil
+		case "false", "no":
+			return false, nil
+		}
+		return nil, errors.New("must be true or false")
+	case OptionUser:
+		return parseMention(argument, "<@")
+	case OptionChannel:
+		return parseMention(argument, "<#")
+	}
+
+	return nil, fmt.Errorf("has unknown type [%s]", optionType)
+}
+
+// parseMention accepts either a mention like <@123> or the ID itself,
+// the ID is returned as a string like every other ID sent to clients
+func parseMention(argument string, prefix string) (string, error) {
+	if mention, found := strings.CutPrefix(argument, prefix); found {
+		argument = strings.TrimSuffix(mention, ">")
+	}
+
+	id, err := strconv.ParseInt(argument, 10, 64)
+	if err != nil || id <= 0 {
+		return "", errors.New("must be a mention or an ID")
+	}
+	return strconv.FormatInt(id, 10), nil
+}
@@ -0,0 +1,115 @@
+package commands_test
+
+import (
+	"chatapp-backend/internal/commands"
+	"chatapp-backend/internal/models"
+	"reflect"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		message string
+		name    string
+		args    string
+		ok      bool
+	}{
+		{message: "/roll 2 dice", name: "roll", args: "2 dice", ok: true},
+		{message: "  /ping  ", name: "ping", args: "", ok: true},
+		{message: "hello /roll", ok: false},
+		{message: "/", ok: false},
+		{message: "/Roll", ok: false},
+		{message: "// comment", ok: false},
+	}
+
+	for _, test := range tests {
+		name, args, ok := commands.Split(test.message)
+		if name != test.name || args != test.args || ok != test.ok {
+			t.Errorf("Split(%q) = %q, %q, %v, expected %q, %q, %v", test.message, name, args, ok, test.name, test.args, test.ok)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := []models.CommandOption{
+		{Name: "count", Type: commands.OptionInteger, Required: true},
+		{Name: "reason", Type: commands.OptionString},
+	}
+	if err := commands.Validate("roll", "Rolls dice", valid); err != nil {
+		t.Errorf("expected valid command, got %v", err)
+	}
+
+	invalid := map[string][]models.CommandOption{
+		"unknown type":          {{Name: "count", Type: "dice"}},
+		"duplicate name":        {{Name: "a", Type: commands.OptionString}, {Name: "a", Type: commands.OptionString}},
+		"required after option": {{Name: "a", Type: commands.OptionString}, {Name: "b", Type: commands.OptionString, Required: true}},
+		"bad option name":       {{Name: "Bad Name", Type: commands.OptionString}},
+	}
+	for name, options := range invalid {
+		if err := commands.Validate("roll", "", options); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	if err := commands.Validate("has space", "", nil); err == nil {
+		t.Error("expected an error for a bad command name")
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	options := []models.CommandOption{
+		{Name: "user", Type: commands.OptionUser, Required: true},
+		{Name: "days", Type: commands.OptionInteger, Required: true},
+		{Name: "silent", Type: commands.OptionBoolean},
+		{Name: "reason", Type: commands.OptionString},
+	}
+
+	tests := []struct {
+		args     string
+		expected map[string]any
+		fails    bool
+	}{
+		{
+			args:     "<@123> 7 yes being rude to others",
+			expected: map[string]any{"user": "123", "days": int64(7), "silent": true, "reason": "being rude to others"},
+		},
+		{
+			args:     `123 7 false "quoted reason"`,
+			expected: map[string]any{"user": "123", "days": int64(7), "silent": false, "reason": "quoted reason"},
+		},
+		{
+			args:     "123 7",
+			expected: map[string]any{"user": "123", "days": int64(7)},
+		},
+		{args: "123", fails: true},
+		{args: "123 seven", fails: true},
+		{args: "<@abc> 7", fails: true},
+		{args: `123 7 maybe`, fails: true},
+		{args: `123 7 true "unclosed`, fails: true},
+		{args: `123 7 true "quoted" extra`, fails: true},
+	}
+
+	for _, test := range tests {
+		values, err := commands.ParseOptions(options, test.args)
+		if test.fails {
+			if err == nil {
+				t.Errorf("ParseOptions(%q) expected an error, got %v", test.args, values)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("ParseOptions(%q) failed: %v", test.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(values, test.expected) {
+			t.Errorf("ParseOptions(%q) = %v, expected %v", test.args, values, test.expected)
+		}
+	}
+
+	number := []models.CommandOption{{Name: "amount", Type: commands.OptionNumber, Required: true}}
+	values, err := commands.ParseOptions(number, "2.5")
+	if err != nil || values["amount"] != 2.5 {
+		t.Errorf("expected 2.5, got %v, %v", values, err)
+	}
+}
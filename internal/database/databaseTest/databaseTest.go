@@ -0,0 +1,29 @@
+package databaseTest
+
+import (
+	"chatapp-backend/internal/database"
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// Open creates an sqlite database with every table in the temporary directory of the test,
+// it's closed once the test is over. foreign keys are off, so tests only need to insert the rows they use
+func Open(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "database.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// there can be sqlite busy errors otherwise, like in the app
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	err = database.SetupTables(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
@@ -1,6 +1,7 @@
 package database
 
 import (
+	"chatapp-backend/internal/globals"
 	"chatapp-backend/internal/models"
 	"database/sql"
 	"fmt"
@@ -90,7 +91,12 @@ func Setup(cfg *models.ConfigFile) (*sql.DB, error) {
 		db.SetMaxOpenConns(10)
 	}
 
-	err = setupTables(db)
+	err = SetupTables(db)
+	if err != nil {
+		return db, err
+	}
+
+	err = migrate(db, cfg.UsePostgres)
 	if err != nil {
 		return db, err
 	}
@@ -98,7 +104,17 @@ func Setup(cfg *models.ConfigFile) (*sql.DB, error) {
 	return db, nil
 }
 
-func setupTables(db *sql.DB) error {
+// server_id is NULL for direct message channels
+const channelsColumns = `(
+	id BIGINT PRIMARY KEY,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	server_id BIGINT,
+	name VARCHAR(32) NOT NULL,
+	FOREIGN KEY (server_id) REFERENCES servers(id) ON DELETE CASCADE
+)`
+
+// SetupTables creates the missing tables, tests use it to prepare their own database
+func SetupTables(db *sql.DB) error {
 	queries := [...]string{`
 			CREATE TABLE IF NOT EXISTS users (
 				id BIGINT PRIMARY KEY,
@@ -107,9 +123,18 @@ func setupTables(db *sql.DB) error {
 				username VARCHAR(32) NOT NULL UNIQUE,
 				display_name VARCHAR(64) NOT NULL,
 				picture TEXT,
-				password CHAR(60) NOT NULL
+				password CHAR(60) NOT NULL,
+				username_changed_at TIMESTAMP
 			);
+
+			CREATE UNIQUE INDEX IF NOT EXISTS users_username_lower ON users (LOWER(username));
 		`,
+		// nobody can log in as the placeholder, as it has no password
+		fmt.Sprintf(`
+			INSERT INTO users (id, email, username, display_name, picture, password)
+			VALUES(%d, 'deleted@users.invalid', 'deleted_user', 'Deleted User', '', '')
+			ON CONFLICT DO NOTHING;
+		`, globals.DeletedUserID),
 		`
 			CREATE TABLE IF NOT EXISTS servers (
 				id BIGINT PRIMARY KEY,
@@ -131,27 +156,220 @@ func setupTables(db *sql.DB) error {
 				FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
 			);
 		`,
+		"CREATE TABLE IF NOT EXISTS channels " + channelsColumns,
+		`
+			CREATE TABLE IF NOT EXISTS messages (
+				id BIGINT PRIMARY KEY,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				channel_id BIGINT NOT NULL,
+				user_id BIGINT NOT NULL,
+				message TEXT NOT NULL,
+				attachments TEXT,
+				edited BOOLEAN NOT NULL,
+				FOREIGN KEY (channel_id) REFERENCES channels(id) ON DELETE CASCADE,
+				FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+			);
+		`,
+		`
+			CREATE TABLE IF NOT EXISTS refresh_tokens (
+				token_hash CHAR(64) PRIMARY KEY,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				family_id BIGINT NOT NULL,
+				user_id BIGINT NOT NULL,
+				remember BOOLEAN NOT NULL,
+				used_at TIMESTAMP,
+				expires_at TIMESTAMP NOT NULL,
+				FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+			);
+		`,
+		`
+			CREATE INDEX IF NOT EXISTS refresh_tokens_family_id ON refresh_tokens (family_id);
+		`,
+		`
+			CREATE TABLE IF NOT EXISTS login_sessions (
+				id BIGINT PRIMARY KEY,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				user_id BIGINT NOT NULL,
+				device VARCHAR(64) NOT NULL,
+				user_agent TEXT NOT NULL,
+				ip VARCHAR(45) NOT NULL,
+				last_used_at TIMESTAMP NOT NULL,
+				FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+			);
+		`,
 		`
-			CREATE TABLE IF NOT EXISTS channels (
+			CREATE TABLE IF NOT EXISTS api_keys (
+				id BIGINT PRIMARY KEY,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				user_id BIGINT NOT NULL,
+				name VARCHAR(64) NOT NULL,
+				secret_hash CHAR(64) NOT NULL,
+				scopes TEXT NOT NULL,
+				last_used_at TIMESTAMP,
+				FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+			);
+		`,
+		`
+			CREATE TABLE IF NOT EXISTS bots (
+				id BIGINT PRIMARY KEY,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				owner_id BIGINT NOT NULL,
+				token_hash CHAR(64) NOT NULL,
+				token_id BIGINT NOT NULL,
+				public BOOLEAN NOT NULL DEFAULT FALSE,
+				FOREIGN KEY (id) REFERENCES users(id) ON DELETE CASCADE,
+				FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE
+			);
+		`,
+		`
+			CREATE TABLE IF NOT EXISTS webhooks (
+				id BIGINT PRIMARY KEY,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				channel_id BIGINT NOT NULL,
+				creator_id BIGINT NOT NULL,
+				name VARCHAR(64) NOT NULL,
+				avatar TEXT NOT NULL,
+				token_hash CHAR(64) NOT NULL,
+				FOREIGN KEY (channel_id) REFERENCES channels(id) ON DELETE CASCADE,
+				FOREIGN KEY (creator_id) REFERENCES users(id) ON DELETE CASCADE
+			);
+		`,
+		`
+			CREATE TABLE IF NOT EXISTS message_webhooks (
+				message_id BIGINT PRIMARY KEY,
+				webhook_id BIGINT NOT NULL,
+				name VARCHAR(64) NOT NULL,
+				avatar TEXT NOT NULL,
+				FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
+			);
+		`,
+		`
+			CREATE TABLE IF NOT EXISTS outgoing_webhooks (
 				id BIGINT PRIMARY KEY,
 				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 				server_id BIGINT NOT NULL,
+				creator_id BIGINT NOT NULL,
+				url TEXT NOT NULL,
+				secret CHAR(64) NOT NULL,
+				events TEXT NOT NULL,
+				enabled BOOLEAN NOT NULL DEFAULT TRUE,
+				consecutive_failures INTEGER NOT NULL DEFAULT 0,
+				FOREIGN KEY (server_id) REFERENCES servers(id) ON DELETE CASCADE,
+				FOREIGN KEY (creator_id) REFERENCES users(id) ON DELETE CASCADE
+			);
+		`,
+		`
+			CREATE TABLE IF NOT EXISTS outgoing_webhook_deliveries (
+				id BIGINT PRIMARY KEY,
+				created_at TIMESTAMP NOT NULL,
+				webhook_id BIGINT NOT NULL,
+				event VARCHAR(32) NOT NULL,
+				payload TEXT NOT NULL,
+				status VARCHAR(16) NOT NULL,
+				attempts INTEGER NOT NULL DEFAULT 0,
+				next_attempt_at TIMESTAMP NOT NULL,
+				response_status INTEGER NOT NULL DEFAULT 0,
+				error TEXT NOT NULL DEFAULT '',
+				FOREIGN KEY (webhook_id) REFERENCES outgoing_webhooks(id) ON DELETE CASCADE
+			);
+		`,
+		`
+			CREATE INDEX IF NOT EXISTS outgoing_webhook_deliveries_due ON outgoing_webhook_deliveries (status, next_attempt_at);
+		`,
+		`
+			CREATE INDEX IF NOT EXISTS outgoing_webhook_deliveries_webhook_id ON outgoing_webhook_deliveries (webhook_id, created_at);
+		`,
+		`
+			CREATE TABLE IF NOT EXISTS bot_commands (
+				id BIGINT PRIMARY KEY,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				bot_id BIGINT NOT NULL,
+				server_id BIGINT NOT NULL,
 				name VARCHAR(32) NOT NULL,
+				description VARCHAR(100) NOT NULL,
+				options TEXT NOT NULL,
+				UNIQUE (server_id, name),
+				FOREIGN KEY (bot_id) REFERENCES users(id) ON DELETE CASCADE,
 				FOREIGN KEY (server_id) REFERENCES servers(id) ON DELETE CASCADE
 			);
 		`,
 		`
-			CREATE TABLE IF NOT EXISTS messages (
+			CREATE TABLE IF NOT EXISTS dm_channels (
 				id BIGINT PRIMARY KEY,
 				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				is_group BOOLEAN NOT NULL,
+				pair_key VARCHAR(41) UNIQUE,
+				last_activity_at TIMESTAMP NOT NULL,
+				FOREIGN KEY (id) REFERENCES channels(id) ON DELETE CASCADE
+			);
+		`,
+		`
+			CREATE TABLE IF NOT EXISTS dm_members (
 				channel_id BIGINT NOT NULL,
 				user_id BIGINT NOT NULL,
-				message TEXT NOT NULL,
-				attachments TEXT,
-				edited BOOLEAN NOT NULL,
+				since TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (channel_id, user_id),
 				FOREIGN KEY (channel_id) REFERENCES channels(id) ON DELETE CASCADE,
 				FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
 			);
+		`,
+		`
+			CREATE INDEX IF NOT EXISTS dm_members_user_id ON dm_members (user_id);
+		`,
+		`
+			CREATE TABLE IF NOT EXISTS relationships (
+				user_id BIGINT NOT NULL,
+				other_user_id BIGINT NOT NULL,
+				type VARCHAR(16) NOT NULL,
+				since TIMESTAMP NOT NULL,
+				PRIMARY KEY (user_id, other_user_id),
+				FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+				FOREIGN KEY (other_user_id) REFERENCES users(id) ON DELETE CASCADE
+			);
+		`,
+		`
+			CREATE TABLE IF NOT EXISTS account_deletions (
+				user_id BIGINT PRIMARY KEY,
+				requested_at TIMESTAMP NOT NULL,
+				delete_at TIMESTAMP NOT NULL,
+				remove_messages BOOLEAN NOT NULL,
+				transfer_servers BOOLEAN NOT NULL,
+				FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+			);
+
+			CREATE INDEX IF NOT EXISTS account_deletions_delete_at ON account_deletions (delete_at);
+		`,
+		`
+			CREATE TABLE IF NOT EXISTS two_factor (
+				user_id BIGINT PRIMARY KEY,
+				secret TEXT NOT NULL,
+				enabled BOOLEAN NOT NULL DEFAULT FALSE,
+				last_used_step BIGINT NOT NULL DEFAULT 0,
+				created_at TIMESTAMP NOT NULL,
+				FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+			);
+		`,
+		`
+			CREATE TABLE IF NOT EXISTS recovery_codes (
+				user_id BIGINT NOT NULL,
+				code_hash CHAR(64) NOT NULL,
+				PRIMARY KEY (user_id, code_hash),
+				FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+			);
+		`,
+		`
+			CREATE TABLE IF NOT EXISTS passkeys (
+				id BIGINT PRIMARY KEY,
+				user_id BIGINT NOT NULL,
+				credential_id TEXT NOT NULL UNIQUE,
+				credential TEXT NOT NULL,
+				name VARCHAR(64) NOT NULL,
+				created_at TIMESTAMP NOT NULL,
+				last_used_at TIMESTAMP,
+				FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+			);
+
+			CREATE INDEX IF NOT EXISTS passkeys_user_id ON passkeys (user_id);
 		`}
 
 	for _, query := range queries {
@@ -163,3 +381,87 @@ func setupTables(db *sql.DB) error {
 
 	return nil
 }
+
+// migrate updates tables made by older versions, as CREATE TABLE IF NOT EXISTS leaves them as they are
+func migrate(db *sql.DB, usePostgres bool) error {
+	err := allowChannelsWithoutServer(db, usePostgres)
+	if err != nil {
+		return err
+	}
+
+	return addUsernameChangedAt(db, usePostgres)
+}
+
+// addUsernameChangedAt adds the column the username change cooldown needs
+func addUsernameChangedAt(db *sql.DB, usePostgres bool) error {
+	if usePostgres {
+		_, err := db.Exec("ALTER TABLE users ADD COLUMN IF NOT EXISTS username_changed_at TIMESTAMP")
+		return err
+	}
+
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM pragma_table_info('users') WHERE name = 'username_changed_at')").Scan(&exists)
+	if err != nil || exists {
+		return err
+	}
+
+	fmt.Println("Migrating users table to add username_changed_at...")
+
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN username_changed_at TIMESTAMP")
+	return err
+}
+
+// allowChannelsWithoutServer drops NOT NULL from channels.server_id, which direct message channels need
+func allowChannelsWithoutServer(db *sql.DB, usePostgres bool) error {
+	if usePostgres {
+		_, err := db.Exec("ALTER TABLE channels ALTER COLUMN server_id DROP NOT NULL")
+		return err
+	}
+
+	var notNull bool
+	err := db.QueryRow(`SELECT "notnull" FROM pragma_table_info('channels') WHERE name = 'server_id'`).Scan(&notNull)
+	if err != nil {
+		return err
+	}
+	if !notNull {
+		return nil
+	}
+
+	fmt.Println("Migrating channels table to allow channels without a server...")
+
+	// sqlite can't change a column, so the table is copied to a new one,
+	// foreign keys have to be off, otherwise dropping the old table would delete every message
+	_, err = db.Exec("PRAGMA foreign_keys = OFF")
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	queries := [...]string{
+		"CREATE TABLE channels_new " + channelsColumns,
+		"INSERT INTO channels_new (id, created_at, server_id, name) SELECT id, created_at, server_id, name FROM channels",
+		"DROP TABLE channels",
+		"ALTER TABLE channels_new RENAME TO channels",
+	}
+	for _, query := range queries {
+		_, err = tx.Exec(query)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("PRAGMA foreign_keys = ON")
+	return err
+}
@@ -3,6 +3,7 @@ package email
 import (
 	"chatapp-backend/internal/models"
 	"fmt"
+	"html"
 	"net/smtp"
 	"net/url"
 )
@@ -58,10 +59,95 @@ func SendEmailConfirmation(email string, username string, token string) error {
 		return sendEmail([]string{email}, subject, message)
 	}
 
-	err := storeManual(email, link)
+	err := storeManual(email, link, "confirm email")
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// SendPasswordReset sends the link to the page where the user picks a new password
+func SendPasswordReset(email string, username string, token string) error {
+	link := fmt.Sprintf("%s/reset-password?token=%s", fullServerAddress, url.QueryEscape(token))
+
+	if useSmtp {
+		subject := "Password reset"
+		message := fmt.Sprintf(`
+		<html>
+			<body>
+				<h2>Hallo %s!</h2>
+				<a href="%s">Reset your password by clicking here</a>
+				<p>If you didn't ask for this, you can ignore this email.</p>
+			</body>
+		</html>`,
+			username, link)
+
+		return sendEmail([]string{email}, subject, message)
+	}
+
+	return storeManual(email, link, "reset password")
+}
+
+// SendMagicLink sends the link to the page that signs the user in, in place of the password
+func SendMagicLink(email string, username string, token string) error {
+	link := fmt.Sprintf("%s/magic-login?token=%s", fullServerAddress, url.QueryEscape(token))
+
+	if useSmtp {
+		subject := "Sign in link"
+		message := fmt.Sprintf(`
+		<html>
+			<body>
+				<h2>Hallo %s!</h2>
+				<a href="%s">Sign in by clicking here</a>
+				<p>The link works once. If you didn't ask for this, you can ignore this email.</p>
+			</body>
+		</html>`,
+			username, link)
+
+		return sendEmail([]string{email}, subject, message)
+	}
+
+	return storeManual(email, link, "sign in")
+}
+
+// SendEmailChangeConfirmation goes to the new address, the email only changes once it's confirmed
+func SendEmailChangeConfirmation(email string, username string, token string) error {
+	link := fmt.Sprintf("%s/api/email/confirmChange?token=%s", fullServerAddress, url.QueryEscape(token))
+
+	if useSmtp {
+		subject := "Confirm your new email"
+		message := fmt.Sprintf(`
+		<html>
+			<body>
+				<h2>Hallo %s!</h2>
+				<a href="%s">Confirm this as your new email by clicking here</a>
+			</body>
+		</html>`,
+			username, link)
+
+		return sendEmail([]string{email}, subject, message)
+	}
+
+	return storeManual(email, link, "confirm email change")
+}
+
+// SendEmailChangeNotice tells the old address that someone asked to move the account to another email
+func SendEmailChangeNotice(email string, username string, newEmail string) error {
+	if useSmtp {
+		subject := "Your email is being changed"
+		message := fmt.Sprintf(`
+		<html>
+			<body>
+				<h2>Hallo %s!</h2>
+				<p>A change of your email to %s was requested, it takes effect once the new address is confirmed.</p>
+				<p>If you didn't ask for this, change your password right away.</p>
+			</body>
+		</html>`,
+			username, html.EscapeString(newEmail))
+
+		return sendEmail([]string{email}, subject, message)
+	}
+
+	return storeManual(email, "", fmt.Sprintf("notice: email is being changed to %s", newEmail))
+}
@@ -4,6 +4,7 @@ import (
 	"chatapp-backend/internal/keyValue"
 	"encoding/json"
 	"fmt"
+	"html"
 	"net/http"
 	"time"
 
@@ -11,8 +12,9 @@ import (
 )
 
 type ConfirmLink struct {
-	Email string
-	Link  string
+	Email   string
+	Link    string
+	Purpose string
 }
 
 const emailConfirmations string = "email_confirmations"
@@ -36,12 +38,17 @@ func localhostListener() {
 			if err != nil {
 				return
 			}
-			htmlString = fmt.Append(htmlString, "<h1>Emails waiting to be confirmed:</h1>")
+			htmlString = fmt.Append(htmlString, "<h1>Links waiting to be opened:</h1>")
 			for _, link := range confirmLinks {
-				htmlString = fmt.Appendf(htmlString, `<a href="%s">%s</a></br></p>`, link.Link, link.Email)
+				// notices have nothing to open
+				if link.Link == "" {
+					htmlString = fmt.Appendf(htmlString, `%s (%s)</br></p>`, link.Email, html.EscapeString(link.Purpose))
+					continue
+				}
+				htmlString = fmt.Appendf(htmlString, `<a href="%s">%s</a> (%s)</br></p>`, link.Link, link.Email, link.Purpose)
 			}
 		} else {
-			htmlString = fmt.Appendf(htmlString, "<h1>No emails to confirm</h1>\n")
+			htmlString = fmt.Appendf(htmlString, "<h1>No links to open</h1>\n")
 		}
 
 		_, err = w.Write(htmlString)
@@ -60,7 +67,7 @@ func localhostListener() {
 	}
 }
 
-func storeManual(email string, link string) error {
+func storeManual(email string, link string, purpose string) error {
 	result, err := keyValue.Get(emailConfirmations)
 	if err != nil {
 		return err
@@ -74,7 +81,7 @@ func storeManual(email string, link string) error {
 		}
 	}
 
-	confirmLinks = append(confirmLinks, ConfirmLink{email, link})
+	confirmLinks = append(confirmLinks, ConfirmLink{email, link, purpose})
 
 	jsonBytes, err := json.Marshal(confirmLinks)
 	if err != nil {
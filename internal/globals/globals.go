@@ -1,7 +1,9 @@
 package globals
 
 const (
-	ChannelTypeChannel    = "channel"
-	ChannelTypeServer     = "server"
-	ChannelTypeServerList = "server_list"
+	ChannelTypeChannel         = "channel"
+	ChannelTypeChannelActivity = "channel_activity"
+	ChannelTypeServer          = "server"
+	ChannelTypeServerList      = "server_list"
+	ChannelTypeUser            = "user"
 )
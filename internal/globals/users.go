@@ -0,0 +1,4 @@
+package globals
+
+// DeletedUserID is the placeholder author of the messages users kept when they deleted their account
+const DeletedUserID int64 = 1
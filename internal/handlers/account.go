@@ -0,0 +1,359 @@
+package handlers
+
+import (
+	"chatapp-backend/internal/accountDeletion"
+	"chatapp-backend/internal/email"
+	"chatapp-backend/internal/keyValue"
+	"chatapp-backend/internal/validator"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const emailChangeLifetime = time.Hour
+
+func emailChangeKey(token string) string {
+	return fmt.Sprintf("email_change:%s", token)
+}
+
+type emailChange struct {
+	UserID int64  `json:"userID"`
+	Email  string `json:"email"`
+}
+
+// isCurrentPassword is for actions that need the user to prove it's them, even though they're logged in
+func isCurrentPassword(userID int64, password string) (bool, error) {
+	var hash []byte
+	err := db.QueryRow("SELECT password FROM users WHERE id = $1", userID).Scan(&hash)
+	if err != nil {
+		return false, err
+	}
+
+	err = bcrypt.CompareHashAndPassword(hash, []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func isEmailTaken(emailAddress string) (bool, error) {
+	var taken bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE email = $1)", emailAddress).Scan(&taken)
+	return taken, err
+}
+
+// ChangePassword keeps the current login, every other one is logged out, API keys are revoked and passkeys are deleted
+func ChangePassword(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+	familyID := ctx.Value(FamilyIDKeyType{}).(int64)
+
+	type PasswordChange struct {
+		CurrentPassword string `json:"currentPassword"`
+		Password        string `json:"password"`
+		ConfirmPassword string `json:"confirmPassword"`
+	}
+
+	var passwordChange PasswordChange
+	err := json.NewDecoder(r.Body).Decode(&passwordChange)
+	if err != nil {
+		sugar.Debug(err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	correct, err := isCurrentPassword(userID, passwordChange.CurrentPassword)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if !correct {
+		http.Error(w, "wrong_password", http.StatusUnauthorized)
+		return
+	}
+
+	if passwordChange.Password != passwordChange.ConfirmPassword {
+		http.Error(w, "passwords_dont_match", http.StatusBadRequest)
+		return
+	}
+
+	err = validator.Password(passwordChange.Password)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	passwordBytes, err := bcrypt.GenerateFromPassword([]byte(passwordChange.Password), 12)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = db.Exec("UPDATE users SET password = $1 WHERE id = $2", passwordBytes, userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = revokeOtherLoginSessions(userID, familyID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = revokeApiKeys(userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = deletePasskeys(userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+// ChangeEmail sends a confirmation to the new address and a notice to the old one,
+// nothing changes until the new address is confirmed
+func ChangeEmail(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	type EmailChange struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+
+	var change EmailChange
+	err := json.NewDecoder(r.Body).Decode(&change)
+	if err != nil {
+		sugar.Debug(err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	correct, err := isCurrentPassword(userID, change.Password)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if !correct {
+		http.Error(w, "wrong_password", http.StatusUnauthorized)
+		return
+	}
+
+	err = validator.Email(change.Email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var currentEmail string
+	var username string
+	err = db.QueryRow("SELECT email, username FROM users WHERE id = $1", userID).Scan(&currentEmail, &username)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if change.Email == currentEmail {
+		http.Error(w, "same_email", http.StatusBadRequest)
+		return
+	}
+
+	taken, err := isEmailTaken(change.Email)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		http.Error(w, "email_taken", http.StatusConflict)
+		return
+	}
+
+	token, err := uuid.NewRandom()
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	bytes, err := json.Marshal(emailChange{UserID: userID, Email: change.Email})
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = keyValue.Set(emailChangeKey(token.String()), string(bytes), emailChangeLifetime)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = email.SendEmailChangeConfirmation(change.Email, username, token.String())
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = email.SendEmailChangeNotice(currentEmail, username, change.Email)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = fmt.Fprintf(w, "confirm_email")
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+func ConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	urlToken := r.URL.Query().Get("token")
+	if urlToken == "" {
+		http.Error(w, "Missing token", http.StatusBadRequest)
+		return
+	}
+
+	token, err := url.QueryUnescape(urlToken)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "Error", http.StatusInternalServerError)
+		return
+	}
+
+	value, err := keyValue.GetDel(emailChangeKey(token))
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "Error", http.StatusInternalServerError)
+		return
+	}
+	if value == "" {
+		http.Error(w, "Token isn't valid", http.StatusUnauthorized)
+		return
+	}
+
+	var change emailChange
+	err = json.Unmarshal([]byte(value), &change)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "Error", http.StatusInternalServerError)
+		return
+	}
+
+	// someone could have registered with it in the meantime
+	taken, err := isEmailTaken(change.Email)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "Error", http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		http.Error(w, "Email is already used by another account", http.StatusConflict)
+		return
+	}
+
+	_, err = db.Exec("UPDATE users SET email = $1 WHERE id = $2", change.Email, change.UserID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "Error", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/login", http.StatusMovedPermanently)
+}
+
+// DeleteAccount schedules the deletion, logs the user out everywhere and revokes their API keys,
+// logging in again before the grace period is over cancels it
+func DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	type Deletion struct {
+		Password string `json:"password"`
+		// otherwise they're kept under a placeholder user
+		RemoveMessages bool `json:"removeMessages"`
+		// otherwise owned servers are deleted, they're also deleted if there is nobody to hand them to
+		TransferServers bool `json:"transferServers"`
+	}
+
+	var deletion Deletion
+	err := json.NewDecoder(r.Body).Decode(&deletion)
+	if err != nil {
+		sugar.Debug(err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	correct, err := isCurrentPassword(userID, deletion.Password)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if !correct {
+		http.Error(w, "wrong_password", http.StatusUnauthorized)
+		return
+	}
+
+	now := time.Now().UTC()
+	deleteAt := now.Add(accountDeletion.GracePeriod)
+
+	_, err = db.Exec(`
+		INSERT INTO account_deletions (user_id, requested_at, delete_at, remove_messages, transfer_servers) VALUES($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id) DO UPDATE SET requested_at = excluded.requested_at, delete_at = excluded.delete_at,
+			remove_messages = excluded.remove_messages, transfer_servers = excluded.transfer_servers
+	`, userID, now, deleteAt, deletion.RemoveMessages, deletion.TransferServers)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = revokeAllTokens(userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	// API keys would keep the account in use during the grace period, logging in is the only way to cancel
+	err = revokeApiKeys(userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	deleteCookie(w, "session", "/")
+	deleteCookie(w, "JWT", "/")
+	deleteCookie(w, "refresh", "/api/auth")
+
+	err = json.NewEncoder(w).Encode(map[string]time.Time{"deleteAt": deleteAt})
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,315 @@
+package handlers
+
+import (
+	"chatapp-backend/internal/hub"
+	"chatapp-backend/internal/models"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// API keys look like "apikey.<ID>.<secret>", the prefix tells them apart from access tokens
+const apiKeyPrefix = "apikey."
+
+const maxApiKeysPerUser = 25
+
+const (
+	ScopeUserRead     = "user:read"
+	ScopeUserWrite    = "user:write"
+	ScopeServerRead   = "server:read"
+	ScopeServerWrite  = "server:write"
+	ScopeChannelRead  = "channel:read"
+	ScopeChannelWrite = "channel:write"
+	ScopeMessageRead  = "message:read"
+	ScopeMessageWrite = "message:write"
+	ScopeMembersRead  = "members:read"
+	// connecting to websocket, SSE or long polling, and creating the session needed for it
+	ScopeRealtime = "realtime"
+)
+
+var apiKeyScopes = []string{
+	ScopeUserRead,
+	ScopeUserWrite,
+	ScopeServerRead,
+	ScopeServerWrite,
+	ScopeChannelRead,
+	ScopeChannelWrite,
+	ScopeMessageRead,
+	ScopeMessageWrite,
+	ScopeMembersRead,
+	ScopeRealtime,
+}
+
+// hasScope reports if the request is allowed to use the scope, requests not using an API key can do everything
+func hasScope(ctx context.Context, scope string) bool {
+	info := ctx.Value(AuthInfoKeyType{}).(authInfo)
+	if info.apiKeyID == 0 {
+		return true
+	}
+	return slices.Contains(info.scopes, scope)
+}
+
+// verifyApiKey checks the part of the key after the prefix
+func verifyApiKey(apiKey string) (authInfo, error) {
+	keyID, secret, err := parseSecretToken(apiKey)
+	if err != nil {
+		sugar.Debug(err)
+		return authInfo{}, &authError{status: http.StatusBadRequest, message: "API key is in improper format"}
+	}
+
+	var userID int64
+	var secretHash, scopes string
+	var lastUsedAt sql.NullTime
+	err = db.QueryRow("SELECT user_id, secret_hash, scopes, last_used_at FROM api_keys WHERE id = $1", keyID).Scan(&userID, &secretHash, &scopes, &lastUsedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			sugar.Debugf("API key ID [%d] doesn't exist", keyID)
+			return authInfo{}, &authError{status: http.StatusUnauthorized, message: "API key isn't valid"}
+		}
+		return authInfo{}, err
+	}
+
+	hash := sha256.Sum256(secret)
+	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(hash[:])), []byte(secretHash)) != 1 {
+		sugar.Debugf("API key ID [%d] was used with a wrong secret", keyID)
+		return authInfo{}, &authError{status: http.StatusUnauthorized, message: "API key isn't valid"}
+	}
+
+	// only updated once a minute so every request doesn't need a write
+	now := time.Now().UTC()
+	if !lastUsedAt.Valid || now.Sub(lastUsedAt.Time) > time.Minute {
+		_, err = db.Exec("UPDATE api_keys SET last_used_at = $1 WHERE id = $2", now, keyID)
+		if err != nil {
+			return authInfo{}, err
+		}
+	}
+
+	return authInfo{userID: userID, apiKeyID: keyID, scopes: strings.Fields(scopes)}, nil
+}
+
+func CreateApiKey(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	type ApiKeyRequest struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}
+
+	var apiKeyRequest ApiKeyRequest
+	err := json.NewDecoder(r.Body).Decode(&apiKeyRequest)
+	if err != nil {
+		sugar.Debug(err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	apiKeyRequest.Name = strings.TrimSpace(apiKeyRequest.Name)
+	if apiKeyRequest.Name == "" || len(apiKeyRequest.Name) > 64 {
+		http.Error(w, "Name must be between 1 and 64 characters", http.StatusBadRequest)
+		return
+	}
+
+	if len(apiKeyRequest.Scopes) == 0 {
+		http.Error(w, "At least one scope is required", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range apiKeyRequest.Scopes {
+		if !slices.Contains(apiKeyScopes, scope) {
+			http.Error(w, fmt.Sprintf("Unknown scope [%s]", scope), http.StatusBadRequest)
+			return
+		}
+	}
+	slices.Sort(apiKeyRequest.Scopes)
+	apiKeyRequest.Scopes = slices.Compact(apiKeyRequest.Scopes)
+
+	var keyCount int
+	err = db.QueryRow("SELECT COUNT(*) FROM api_keys WHERE user_id = $1", userID).Scan(&keyCount)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if keyCount >= maxApiKeysPerUser {
+		http.Error(w, fmt.Sprintf("You can't have more than %d API keys", maxApiKeysPerUser), http.StatusBadRequest)
+		return
+	}
+
+	secret := make([]byte, 32)
+	_, err = rand.Read(secret)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	hash := sha256.Sum256(secret)
+
+	apiKey := models.ApiKey{
+		ID:        snowflakeNode.Generate().Int64(),
+		Name:      apiKeyRequest.Name,
+		Scopes:    apiKeyRequest.Scopes,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	_, err = db.Exec("INSERT INTO api_keys (id, created_at, user_id, name, secret_hash, scopes) VALUES($1, $2, $3, $4, $5, $6)",
+		apiKey.ID, apiKey.CreatedAt, userID, apiKey.Name, hex.EncodeToString(hash[:]), strings.Join(apiKey.Scopes, " "))
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	// only the hash is stored, so this is the only time the key can be seen
+	apiKey.Key = fmt.Sprintf("%s%d.%s", apiKeyPrefix, apiKey.ID, base64.RawURLEncoding.EncodeToString(secret))
+
+	err = json.NewEncoder(w).Encode(apiKey)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+func GetApiKeys(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	rows, err := db.Query("SELECT id, name, scopes, created_at, last_used_at FROM api_keys WHERE user_id = $1 ORDER BY created_at", userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			sugar.Error(err)
+		}
+	}()
+
+	apiKeys := []models.ApiKey{}
+	for rows.Next() {
+		var apiKey models.ApiKey
+		var scopes string
+		var lastUsedAt sql.NullTime
+
+		err := rows.Scan(&apiKey.ID, &apiKey.Name, &scopes, &apiKey.CreatedAt, &lastUsedAt)
+		if err != nil {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		apiKey.Scopes = strings.Fields(scopes)
+		if lastUsedAt.Valid {
+			apiKey.LastUsedAt = &lastUsedAt.Time
+		}
+		apiKeys = append(apiKeys, apiKey)
+	}
+
+	if err := rows.Err(); err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(apiKeys)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+// revokeApiKeys deletes every API key of the user and closes the connections opened with them,
+// for when the user might not be the only one who knows the password anymore
+func revokeApiKeys(userID int64) error {
+	rows, err := db.Query("SELECT id FROM api_keys WHERE user_id = $1", userID)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			sugar.Error(err)
+		}
+	}()
+
+	var keyIDs []int64
+	for rows.Next() {
+		var keyID int64
+		err := rows.Scan(&keyID)
+		if err != nil {
+			return err
+		}
+
+		keyIDs = append(keyIDs, keyID)
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = db.Exec("DELETE FROM api_keys WHERE user_id = $1", userID)
+	if err != nil {
+		return err
+	}
+
+	for _, keyID := range keyIDs {
+		err = hub.DisconnectLoginSession(userID, keyID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func RevokeApiKey(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	keyID, err := strconv.ParseInt(r.URL.Query().Get("keyID"), 10, 64)
+	if err != nil || keyID == 0 {
+		http.Error(w, "Invalid API key ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM api_keys WHERE id = $1 AND user_id = $2", keyID, userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if affected == 0 {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+
+	// connections opened with the key are grouped under its ID
+	err = hub.DisconnectLoginSession(userID, keyID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
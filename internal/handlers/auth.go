@@ -2,7 +2,6 @@ package handlers
 
 import (
 	"chatapp-backend/internal/email"
-	"chatapp-backend/internal/jwt"
 	"chatapp-backend/internal/keyValue"
 	"chatapp-backend/internal/models"
 	"chatapp-backend/internal/validator"
@@ -11,6 +10,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -18,6 +18,7 @@ import (
 )
 
 func Login(w http.ResponseWriter, r *http.Request) {
+	// email can also be the username, usernames can't contain @
 	type Login struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
@@ -37,7 +38,11 @@ func Login(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var result Result
-	err = db.QueryRow("SELECT id, password FROM users WHERE email = $1", login.Email).Scan(&result.userID, &result.password)
+	if strings.Contains(login.Email, "@") {
+		err = db.QueryRow("SELECT id, password FROM users WHERE email = $1", login.Email).Scan(&result.userID, &result.password)
+	} else {
+		err = db.QueryRow("SELECT id, password FROM users WHERE LOWER(username) = LOWER($1)", login.Email).Scan(&result.userID, &result.password)
+	}
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			sugar.Debug(err)
@@ -56,19 +61,36 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cookie, err := jwt.CreateToken(r.URL.Query().Get("rememberMe") == "true", result.userID)
+	rememberMe := r.URL.Query().Get("rememberMe") == "true"
+
+	// the login is only finished once the second factor is checked too
+	twoFactorEnabled, err := hasTwoFactor(result.userID)
 	if err != nil {
-		sugar.Debug(err)
+		sugar.Error(err)
 		http.Error(w, "", http.StatusInternalServerError)
 		return
 	}
+	if twoFactorEnabled {
+		err = startLoginChallenge(w, result.userID, rememberMe)
+		if err != nil {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+		}
+		return
+	}
 
-	http.SetCookie(w, &cookie)
+	err = startLogin(w, r, result.userID, rememberMe)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
 }
 
 func Register(w http.ResponseWriter, r *http.Request) {
 	type Registration struct {
 		Email           string `json:"email"`
+		Username        string `json:"username"`
 		Password        string `json:"password"`
 		ConfirmPassword string `json:"confirmPassword"`
 	}
@@ -96,13 +118,32 @@ func Register(w http.ResponseWriter, r *http.Request) {
 		err = validator.Password(registration.Password)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = validator.Username(registration.Username)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 	}
 
+	// checked again once the email is confirmed, someone else could take it in the meantime
+	taken, err := isUsernameTaken(registration.Username, 0)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		http.Error(w, "username_taken", http.StatusConflict)
+		return
+	}
+
 	userID := snowflakeNode.Generate().Int64()
 
-	username := fmt.Sprintf("%d", userID)    // temporary
-	displayName := fmt.Sprintf("%d", userID) // temporary
+	username := registration.Username
+	displayName := registration.Username
 
 	passwordBytes, err := bcrypt.GenerateFromPassword([]byte(registration.Password), 12)
 	if err != nil {
@@ -155,18 +196,87 @@ func Register(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func NewSession(w http.ResponseWriter, _ *http.Request) {
-	sessionID := snowflakeNode.Generate().Int64()
+func NewSession(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
 
-	// TODO possibly encrypt session id with user id together
+	_, token, err := createSession(userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
 
 	sessionCookie := http.Cookie{
 		Name:     "session",
-		Value:    fmt.Sprint(sessionID),
+		Value:    token,
 		Path:     "/",
 		HttpOnly: true,
 		Secure:   isHttps,
 		SameSite: http.SameSiteLaxMode,
 	}
 	http.SetCookie(w, &sessionCookie)
+
+	// clients without cookies send it back in the X-Session-Token header
+	err = json.NewEncoder(w).Encode(map[string]string{"token": token})
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+func Logout(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+	familyID := ctx.Value(FamilyIDKeyType{}).(int64)
+
+	err := revokeFamily(userID, familyID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	sessionCookie, err := r.Cookie("session")
+	if err == nil {
+		sessionID, secret, err := parseSecretToken(sessionCookie.Value)
+		if err == nil {
+			owner, err := getSessionOwner(sessionID, secret)
+			if err != nil {
+				sugar.Error(err)
+				http.Error(w, "", http.StatusInternalServerError)
+				return
+			}
+
+			if owner == userID {
+				err = endSession(sessionID)
+				if err != nil {
+					sugar.Error(err)
+					http.Error(w, "", http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+	}
+
+	deleteCookie(w, "session", "/")
+	deleteCookie(w, "JWT", "/")
+	deleteCookie(w, "refresh", "/api/auth")
+}
+
+func LogoutEverywhere(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	err := revokeAllTokens(userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	deleteCookie(w, "session", "/")
+	deleteCookie(w, "JWT", "/")
+	deleteCookie(w, "refresh", "/api/auth")
 }
@@ -0,0 +1,498 @@
+package handlers
+
+import (
+	"chatapp-backend/internal/hub"
+	"chatapp-backend/internal/models"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bot tokens look like "bot.<bot ID>.<secret>"
+const botTokenPrefix = "bot."
+
+const maxBotsPerUser = 10
+
+// bots are users that can't log in, the email only exists to satisfy the users table
+func botEmail(botID int64) string {
+	return fmt.Sprintf("%d@bots.invalid", botID)
+}
+
+// newBotToken makes a token for the bot and returns it along with the hash and ID to store
+func newBotToken(botID int64) (string, string, int64, error) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", "", 0, err
+	}
+	hash := sha256.Sum256(secret)
+
+	token := fmt.Sprintf("%s%d.%s", botTokenPrefix, botID, base64.RawURLEncoding.EncodeToString(secret))
+	return token, hex.EncodeToString(hash[:]), snowflakeNode.Generate().Int64(), nil
+}
+
+// verifyBotToken checks the part of the token after the prefix
+func verifyBotToken(botToken string) (authInfo, error) {
+	botID, secret, err := parseSecretToken(botToken)
+	if err != nil {
+		sugar.Debug(err)
+		return authInfo{}, &authError{status: http.StatusBadRequest, message: "Bot token is in improper format"}
+	}
+
+	var tokenHash string
+	var tokenID int64
+	err = db.QueryRow("SELECT token_hash, token_id FROM bots WHERE id = $1", botID).Scan(&tokenHash, &tokenID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			sugar.Debugf("Bot ID [%d] doesn't exist", botID)
+			return authInfo{}, &authError{status: http.StatusUnauthorized, message: "Bot token isn't valid"}
+		}
+		return authInfo{}, err
+	}
+
+	hash := sha256.Sum256(secret)
+	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(hash[:])), []byte(tokenHash)) != 1 {
+		sugar.Debugf("Bot ID [%d] was used with a wrong token", botID)
+		return authInfo{}, &authError{status: http.StatusUnauthorized, message: "Bot token isn't valid"}
+	}
+
+	return authInfo{userID: botID, botTokenID: tokenID}, nil
+}
+
+// getOwnedBot returns the bot if the user owns it, writes the error response itself if not
+func getOwnedBot(w http.ResponseWriter, r *http.Request, userID int64) (models.Bot, bool) {
+	botID, err := strconv.ParseInt(r.URL.Query().Get("botID"), 10, 64)
+	if err != nil || botID == 0 {
+		http.Error(w, "Invalid bot ID", http.StatusBadRequest)
+		return models.Bot{}, false
+	}
+
+	bot, err := getBot(botID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Bot not found", http.StatusNotFound)
+		} else {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+		}
+		return models.Bot{}, false
+	}
+
+	if bot.OwnerID != userID {
+		sugar.Warnf("User ID [%d] tried to manage bot ID [%d] of user ID [%d]", userID, bot.ID, bot.OwnerID)
+		http.Error(w, "Bot not found", http.StatusNotFound)
+		return models.Bot{}, false
+	}
+
+	return bot, true
+}
+
+func getBot(botID int64) (models.Bot, error) {
+	var bot models.Bot
+	err := db.QueryRow(`
+		SELECT
+			bots.id,
+			bots.owner_id,
+			users.display_name,
+			users.picture,
+			bots.public,
+			bots.created_at
+		FROM
+			bots
+		JOIN
+			users ON users.id = bots.id
+		WHERE
+			bots.id = $1
+		`, botID).Scan(&bot.ID, &bot.OwnerID, &bot.Name, &bot.Picture, &bot.Public, &bot.CreatedAt)
+	return bot, err
+}
+
+func CreateBot(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	name := strings.TrimSpace(r.URL.Query().Get("name"))
+	if name == "" || len(name) > 64 {
+		http.Error(w, "Name must be between 1 and 64 characters", http.StatusBadRequest)
+		return
+	}
+
+	var botCount int
+	err := db.QueryRow("SELECT COUNT(*) FROM bots WHERE owner_id = $1", userID).Scan(&botCount)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if botCount >= maxBotsPerUser {
+		http.Error(w, fmt.Sprintf("You can't have more than %d bots", maxBotsPerUser), http.StatusBadRequest)
+		return
+	}
+
+	bot := models.Bot{
+		ID:        snowflakeNode.Generate().Int64(),
+		OwnerID:   userID,
+		Name:      name,
+		Public:    r.URL.Query().Get("public") == "true",
+		CreatedAt: time.Now().UTC(),
+	}
+
+	token, tokenHash, tokenID, err := newBotToken(bot.ID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			sugar.Error(err)
+		}
+	}()
+
+	// bots have no password, so logging in as them always fails
+	_, err = tx.Exec("INSERT INTO users (id, email, username, display_name, picture, password) VALUES($1, $2, $3, $4, $5, $6)",
+		bot.ID, botEmail(bot.ID), strconv.FormatInt(bot.ID, 10), bot.Name, "", "")
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec("INSERT INTO bots (id, created_at, owner_id, token_hash, token_id, public) VALUES($1, $2, $3, $4, $5, $6)",
+		bot.ID, bot.CreatedAt, bot.OwnerID, tokenHash, tokenID, bot.Public)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	bot.Token = token
+
+	err = json.NewEncoder(w).Encode(bot)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+func GetBots(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	rows, err := db.Query(`
+		SELECT
+			bots.id,
+			users.display_name,
+			users.picture,
+			bots.public,
+			bots.created_at
+		FROM
+			bots
+		JOIN
+			users ON users.id = bots.id
+		WHERE
+			bots.owner_id = $1
+		ORDER BY
+			bots.created_at
+		`, userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			sugar.Error(err)
+		}
+	}()
+
+	bots := []models.Bot{}
+	for rows.Next() {
+		bot := models.Bot{OwnerID: userID}
+
+		err := rows.Scan(&bot.ID, &bot.Name, &bot.Picture, &bot.Public, &bot.CreatedAt)
+		if err != nil {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		bots = append(bots, bot)
+	}
+
+	if err := rows.Err(); err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(bots)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+// RegenerateBotToken replaces the token of the bot, disconnecting everything using the old one
+func RegenerateBotToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	bot, ok := getOwnedBot(w, r, userID)
+	if !ok {
+		return
+	}
+
+	var oldTokenID int64
+	err := db.QueryRow("SELECT token_id FROM bots WHERE id = $1", bot.ID).Scan(&oldTokenID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	token, tokenHash, tokenID, err := newBotToken(bot.ID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = db.Exec("UPDATE bots SET token_hash = $1, token_id = $2 WHERE id = $3", tokenHash, tokenID, bot.ID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = hub.DisconnectLoginSession(bot.ID, oldTokenID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	bot.Token = token
+
+	err = json.NewEncoder(w).Encode(bot)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+// DeleteBot deletes the bot user, which removes it from every server
+func DeleteBot(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	bot, ok := getOwnedBot(w, r, userID)
+	if !ok {
+		return
+	}
+
+	_, err := db.Exec("DELETE FROM users WHERE id = $1", bot.ID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = hub.DisconnectUser(bot.ID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+// getAuthorizableBot returns the bot if the user is allowed to add it to servers,
+// which is anyone for public bots and only the owner for private ones
+func getAuthorizableBot(w http.ResponseWriter, r *http.Request, userID int64) (models.Bot, bool) {
+	botID, err := strconv.ParseInt(r.URL.Query().Get("botID"), 10, 64)
+	if err != nil || botID == 0 {
+		http.Error(w, "Invalid bot ID", http.StatusBadRequest)
+		return models.Bot{}, false
+	}
+
+	bot, err := getBot(botID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Bot not found", http.StatusNotFound)
+		} else {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+		}
+		return models.Bot{}, false
+	}
+
+	// private bots look the same as ones that don't exist
+	if !bot.Public && bot.OwnerID != userID {
+		http.Error(w, "Bot not found", http.StatusNotFound)
+		return models.Bot{}, false
+	}
+
+	return bot, true
+}
+
+// GetBotAuthorization returns what the user needs to decide about adding the bot,
+// which is the bot itself and the servers it can be added to
+func GetBotAuthorization(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	bot, ok := getAuthorizableBot(w, r, userID)
+	if !ok {
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT
+			id,
+			name,
+			picture
+		FROM
+			servers
+		WHERE
+			owner_id = $1
+		AND NOT EXISTS (SELECT 1 FROM server_members WHERE server_members.server_id = servers.id AND server_members.user_id = $2)
+		`, userID, bot.ID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			sugar.Error(err)
+		}
+	}()
+
+	type Authorization struct {
+		Bot     models.Bot      `json:"bot"`
+		Servers []models.Server `json:"servers"`
+	}
+
+	authorization := Authorization{Bot: bot, Servers: []models.Server{}}
+	for rows.Next() {
+		server := models.Server{OwnerID: userID}
+
+		err := rows.Scan(&server.ID, &server.Name, &server.Picture)
+		if err != nil {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		authorization.Servers = append(authorization.Servers, server)
+	}
+
+	if err := rows.Err(); err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(authorization)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+// AuthorizeBot adds the bot to a server the user owns
+func AuthorizeBot(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	bot, ok := getAuthorizableBot(w, r, userID)
+	if !ok {
+		return
+	}
+
+	serverID, err := strconv.ParseInt(r.URL.Query().Get("serverID"), 10, 64)
+	if err != nil || serverID == 0 {
+		http.Error(w, "Invalid server ID", http.StatusBadRequest)
+		return
+	}
+
+	var server models.Server
+	err = db.QueryRow("SELECT id, owner_id, name, picture, banner FROM servers WHERE id = $1", serverID).
+		Scan(&server.ID, &server.OwnerID, &server.Name, &server.Picture, &server.Banner)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Server not found", http.StatusNotFound)
+		} else {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+		}
+		return
+	}
+	if server.OwnerID != userID {
+		sugar.Warnf("User ID [%d] tried to add bot ID [%d] to server ID [%d] they don't own", userID, bot.ID, serverID)
+		http.Error(w, "You don't own this server", http.StatusForbidden)
+		return
+	}
+
+	isMember, err := isServerMember(serverID, bot.ID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if isMember {
+		http.Error(w, "Bot is already in this server", http.StatusConflict)
+		return
+	}
+
+	err = addServerMember(serverID, bot.ID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = hub.EmitToUser(hub.ServerJoined, server, bot.ID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = emitMemberEvent(hub.MemberJoined, serverID, bot.ID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
@@ -135,3 +135,54 @@ func GetChannelList(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// SubscribeChannel keeps the channel in the session's subscriptions without focusing it,
+// so the client only gets notified about new activity in it
+func SubscribeChannel(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+	sessionID := ctx.Value(SessionIDKeyType{}).(int64)
+
+	channelID, err := strconv.ParseInt(r.URL.Query().Get("channelID"), 10, 64)
+	if err != nil || channelID == 0 {
+		http.Error(w, "Invalid channel ID", http.StatusBadRequest)
+		return
+	}
+
+	isMember, err := isChannelMember(channelID, userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	if !isMember {
+		http.Error(w, "You are not member of given channel", http.StatusUnauthorized)
+		return
+	}
+
+	err = hub.Subscribe(channelID, globals.ChannelTypeChannelActivity, sessionID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+func UnsubscribeChannel(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	sessionID := ctx.Value(SessionIDKeyType{}).(int64)
+
+	channelID, err := strconv.ParseInt(r.URL.Query().Get("channelID"), 10, 64)
+	if err != nil || channelID == 0 {
+		http.Error(w, "Invalid channel ID", http.StatusBadRequest)
+		return
+	}
+
+	err = hub.Unsubscribe(channelID, globals.ChannelTypeChannel, sessionID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,565 @@
+package handlers
+
+import (
+	"chatapp-backend/internal/commands"
+	"chatapp-backend/internal/hub"
+	"chatapp-backend/internal/keyValue"
+	"chatapp-backend/internal/models"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxCommandsPerBot = 50
+
+// how long a bot has to respond to an interaction
+const interactionDeadline = 15 * time.Second
+
+// the key includes the bot, so a bot can't use up the interactions of others
+func interactionKey(botID int64, interactionID int64) string {
+	return fmt.Sprintf("interaction:%d:%d", botID, interactionID)
+}
+
+func scanCommand(scan func(dest ...any) error, extra ...any) (models.Command, error) {
+	var command models.Command
+	var options string
+	err := scan(append([]any{&command.ID, &command.BotID, &command.ServerID, &command.Name, &command.Description, &options, &command.CreatedAt}, extra...)...)
+	if err != nil {
+		return models.Command{}, err
+	}
+
+	err = json.Unmarshal([]byte(options), &command.Options)
+	return command, err
+}
+
+// RegisterCommand adds a command to a server the bot is in, or updates it if the bot already has one with the same name
+func RegisterCommand(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	botID := ctx.Value(UserIDKeyType{}).(int64)
+
+	serverID, err := strconv.ParseInt(r.URL.Query().Get("serverID"), 10, 64)
+	if err != nil || serverID == 0 {
+		http.Error(w, "Invalid server ID", http.StatusBadRequest)
+		return
+	}
+
+	isMember, err := isServerMember(serverID, botID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if !isMember {
+		http.Error(w, "Bot is not in this server", http.StatusForbidden)
+		return
+	}
+
+	type CommandRequest struct {
+		Name        string                 `json:"name"`
+		Description string                 `json:"description"`
+		Options     []models.CommandOption `json:"options"`
+	}
+
+	var commandRequest CommandRequest
+	err = json.NewDecoder(r.Body).Decode(&commandRequest)
+	if err != nil {
+		sugar.Debug(err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	if commandRequest.Options == nil {
+		commandRequest.Options = []models.CommandOption{}
+	}
+
+	err = commands.Validate(commandRequest.Name, commandRequest.Description, commandRequest.Options)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	options, err := json.Marshal(commandRequest.Options)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	command := models.Command{
+		BotID:       botID,
+		ServerID:    serverID,
+		Name:        commandRequest.Name,
+		Description: commandRequest.Description,
+		Options:     commandRequest.Options,
+	}
+
+	err = db.QueryRow("SELECT id, bot_id, created_at FROM bot_commands WHERE server_id = $1 AND name = $2", serverID, command.Name).
+		Scan(&command.ID, &command.BotID, &command.CreatedAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	if err == nil {
+		if command.BotID != botID {
+			http.Error(w, fmt.Sprintf("Another bot already has the command [%s] in this server", command.Name), http.StatusConflict)
+			return
+		}
+
+		_, err = db.Exec("UPDATE bot_commands SET description = $1, options = $2 WHERE id = $3", command.Description, string(options), command.ID)
+		if err != nil {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		var commandCount int
+		err = db.QueryRow("SELECT COUNT(*) FROM bot_commands WHERE bot_id = $1 AND server_id = $2", botID, serverID).Scan(&commandCount)
+		if err != nil {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		if commandCount >= maxCommandsPerBot {
+			http.Error(w, fmt.Sprintf("A bot can't have more than %d commands in a server", maxCommandsPerBot), http.StatusBadRequest)
+			return
+		}
+
+		command.ID = snowflakeNode.Generate().Int64()
+		command.CreatedAt = time.Now().UTC()
+
+		_, err = db.Exec("INSERT INTO bot_commands (id, created_at, bot_id, server_id, name, description, options) VALUES($1, $2, $3, $4, $5, $6, $7)",
+			command.ID, command.CreatedAt, botID, serverID, command.Name, command.Description, string(options))
+		if err != nil {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = json.NewEncoder(w).Encode(command)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+// GetOwnCommands returns the commands the bot registered in a server
+func GetOwnCommands(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	botID := ctx.Value(UserIDKeyType{}).(int64)
+
+	serverID, err := strconv.ParseInt(r.URL.Query().Get("serverID"), 10, 64)
+	if err != nil || serverID == 0 {
+		http.Error(w, "Invalid server ID", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.Query("SELECT id, bot_id, server_id, name, description, options, created_at FROM bot_commands WHERE bot_id = $1 AND server_id = $2 ORDER BY name", botID, serverID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			sugar.Error(err)
+		}
+	}()
+
+	commandList := []models.Command{}
+	for rows.Next() {
+		command, err := scanCommand(rows.Scan)
+		if err != nil {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		commandList = append(commandList, command)
+	}
+
+	if err := rows.Err(); err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(commandList)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+func DeleteCommand(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	botID := ctx.Value(UserIDKeyType{}).(int64)
+
+	commandID, err := strconv.ParseInt(r.URL.Query().Get("commandID"), 10, 64)
+	if err != nil || commandID == 0 {
+		http.Error(w, "Invalid command ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM bot_commands WHERE id = $1 AND bot_id = $2", commandID, botID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if affected == 0 {
+		http.Error(w, "Command not found", http.StatusNotFound)
+		return
+	}
+}
+
+// GetChannelCommands returns the commands that can be used in a channel, for autocompletion,
+// commands of bots no longer in the server are left out
+func GetChannelCommands(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	channelID, err := strconv.ParseInt(r.URL.Query().Get("channelID"), 10, 64)
+	if err != nil || channelID == 0 {
+		http.Error(w, "Invalid channel ID", http.StatusBadRequest)
+		return
+	}
+
+	isMember, err := isChannelMember(channelID, userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if !isMember {
+		http.Error(w, "You are not member of this channel", http.StatusForbidden)
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT
+			bot_commands.id,
+			bot_commands.bot_id,
+			bot_commands.server_id,
+			bot_commands.name,
+			bot_commands.description,
+			bot_commands.options,
+			bot_commands.created_at,
+			users.display_name,
+			users.picture
+		FROM
+			channels
+		JOIN
+			bot_commands ON bot_commands.server_id = channels.server_id
+		JOIN
+			server_members ON server_members.server_id = bot_commands.server_id AND server_members.user_id = bot_commands.bot_id
+		JOIN
+			users ON users.id = bot_commands.bot_id
+		WHERE
+			channels.id = $1
+		ORDER BY
+			bot_commands.name
+	`, channelID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			sugar.Error(err)
+		}
+	}()
+
+	commandList := []models.Command{}
+	for rows.Next() {
+		bot := models.User{Bot: true}
+		command, err := scanCommand(rows.Scan, &bot.DisplayName, &bot.Picture)
+		if err != nil {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		bot.ID = command.BotID
+		command.Bot = &bot
+
+		commandList = append(commandList, command)
+	}
+
+	if err := rows.Err(); err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(commandList)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+// checkMentionedOptions makes sure user and channel options point to members and channels of the server
+func checkMentionedOptions(options []models.CommandOption, values map[string]any, serverID int64) (string, error) {
+	for _, option := range options {
+		value, exists := values[option.Name].(string)
+		if !exists || (option.Type != commands.OptionUser && option.Type != commands.OptionChannel) {
+			continue
+		}
+
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Sprintf("Option [%s] must be a mention or an ID", option.Name), nil
+		}
+
+		var found bool
+		if option.Type == commands.OptionUser {
+			found, err = isServerMember(serverID, id)
+		} else {
+			err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM channels WHERE id = $1 AND server_id = $2)", id, serverID).Scan(&found)
+		}
+		if err != nil {
+			return "", err
+		}
+		if !found {
+			return fmt.Sprintf("Option [%s] isn't a %s of this server", option.Name, option.Type), nil
+		}
+	}
+
+	return "", nil
+}
+
+// runCommand sends the message to the bot as an interaction if it's one of the commands of the channel,
+// returns false if it isn't, so the message can be posted like any other
+func runCommand(w http.ResponseWriter, userID int64, channelID int64, message string) bool {
+	name, args, ok := commands.Split(message)
+	if !ok {
+		return false
+	}
+
+	command, err := scanCommand(db.QueryRow(`
+		SELECT
+			bot_commands.id,
+			bot_commands.bot_id,
+			bot_commands.server_id,
+			bot_commands.name,
+			bot_commands.description,
+			bot_commands.options,
+			bot_commands.created_at
+		FROM
+			channels
+		JOIN
+			bot_commands ON bot_commands.server_id = channels.server_id
+		JOIN
+			server_members ON server_members.server_id = bot_commands.server_id AND server_members.user_id = bot_commands.bot_id
+		WHERE
+			channels.id = $1 AND bot_commands.name = $2
+	`, channelID, name).Scan)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false
+	}
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return true
+	}
+
+	isMember, err := isServerMember(command.ServerID, userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return true
+	}
+	if !isMember {
+		http.Error(w, "You are not member of this server", http.StatusForbidden)
+		return true
+	}
+
+	values, err := commands.ParseOptions(command.Options, args)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return true
+	}
+
+	problem, err := checkMentionedOptions(command.Options, values, command.ServerID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return true
+	}
+	if problem != "" {
+		http.Error(w, problem, http.StatusBadRequest)
+		return true
+	}
+
+	interaction := models.Interaction{
+		ID:          snowflakeNode.Generate().Int64(),
+		CommandID:   command.ID,
+		CommandName: command.Name,
+		BotID:       command.BotID,
+		ServerID:    command.ServerID,
+		ChannelID:   channelID,
+		User:        models.User{ID: userID},
+		Options:     values,
+		ExpiresAt:   time.Now().UTC().Add(interactionDeadline),
+	}
+
+	err = db.QueryRow("SELECT display_name, picture FROM users WHERE id = $1", userID).Scan(&interaction.User.DisplayName, &interaction.User.Picture)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return true
+	}
+
+	value, err := json.Marshal(interaction)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return true
+	}
+
+	err = keyValue.Set(interactionKey(interaction.BotID, interaction.ID), string(value), interactionDeadline)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return true
+	}
+
+	err = hub.EmitToUser(hub.InteractionCreated, interaction, interaction.BotID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return true
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	err = json.NewEncoder(w).Encode(interaction)
+	if err != nil {
+		sugar.Error(err)
+	}
+	return true
+}
+
+// RespondToInteraction posts the reply of the bot, either to the channel or only to the user who ran the command,
+// an interaction can be responded to once, before its deadline
+func RespondToInteraction(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	botID := ctx.Value(UserIDKeyType{}).(int64)
+
+	interactionID, err := strconv.ParseInt(r.URL.Query().Get("interactionID"), 10, 64)
+	if err != nil || interactionID == 0 {
+		http.Error(w, "Invalid interaction ID", http.StatusBadRequest)
+		return
+	}
+
+	type ResponseRequest struct {
+		Message   string `json:"message"`
+		Ephemeral bool   `json:"ephemeral"`
+	}
+
+	var responseRequest ResponseRequest
+	err = json.NewDecoder(r.Body).Decode(&responseRequest)
+	if err != nil {
+		sugar.Debug(err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	responseRequest.Message = strings.TrimSpace(responseRequest.Message)
+	if responseRequest.Message == "" {
+		http.Error(w, "Message can't be empty", http.StatusBadRequest)
+		return
+	}
+	if len(responseRequest.Message) > maxMessageLength {
+		http.Error(w, fmt.Sprintf("Message can't be longer than %d characters", maxMessageLength), http.StatusBadRequest)
+		return
+	}
+
+	value, err := keyValue.GetDel(interactionKey(botID, interactionID))
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	if value == "" {
+		http.Error(w, "Interaction doesn't exist, was already responded to or has expired", http.StatusNotFound)
+		return
+	}
+
+	var interaction models.Interaction
+	err = json.Unmarshal([]byte(value), &interaction)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	// the bot could have been removed from the server since the command was used
+	isMember, err := isServerMember(interaction.ServerID, botID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if !isMember {
+		http.Error(w, "Bot is not in this server", http.StatusForbidden)
+		return
+	}
+
+	msg := models.Message{
+		ID:        snowflakeNode.Generate().Int64(),
+		ChannelID: interaction.ChannelID,
+		UserID:    botID,
+		Message:   responseRequest.Message,
+		User:      models.User{ID: botID, Bot: true},
+		Ephemeral: responseRequest.Ephemeral,
+	}
+
+	err = db.QueryRow("SELECT display_name, picture FROM users WHERE id = $1", botID).Scan(&msg.User.DisplayName, &msg.User.Picture)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	if msg.Ephemeral {
+		err = hub.EmitToUser(hub.MessageCreated, msg, interaction.User.ID)
+	} else {
+		_, err = db.Exec("INSERT INTO messages (id, channel_id, user_id, message, attachments, edited) VALUES($1, $2, $3, $4, $5, $6)",
+			msg.ID, msg.ChannelID, msg.UserID, msg.Message, msg.Attachments, msg.Edited)
+		if err == nil {
+			err = emitMessageCreated(msg)
+		}
+	}
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(msg)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
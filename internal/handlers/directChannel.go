@@ -0,0 +1,592 @@
+package handlers
+
+import (
+	"chatapp-backend/internal/database"
+	"chatapp-backend/internal/globals"
+	"chatapp-backend/internal/hub"
+	"chatapp-backend/internal/models"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// direct channels are rows in channels without a server, so messages and the channel: hub key work the same as in servers,
+// dm_channels holds what's specific to them and dm_members decides who can see them
+
+const maxGroupMembers = 10
+
+// pairKey makes sure there is only one direct channel between two users
+func pairKey(userID int64, otherUserID int64) string {
+	return fmt.Sprintf("%d:%d", min(userID, otherUserID), max(userID, otherUserID))
+}
+
+// canBeMessaged reports if the user exists and is a real account, webhooks can't read messages
+func canBeMessaged(userID int64) (bool, error) {
+	if userID == globals.DeletedUserID {
+		return false, nil
+	}
+
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = $1) AND NOT EXISTS(SELECT 1 FROM webhooks WHERE id = $1)", userID).Scan(&exists)
+	return exists, err
+}
+
+func getDirectChannelMembers(channelID int64) ([]models.User, error) {
+	rows, err := db.Query(`
+		SELECT
+			users.id,
+			users.display_name,
+			users.picture,
+			EXISTS(SELECT 1 FROM bots WHERE bots.id = users.id)
+		FROM
+			dm_members
+		JOIN
+			users ON dm_members.user_id = users.id
+		WHERE
+			dm_members.channel_id = $1
+		ORDER BY
+			dm_members.since
+	`, channelID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			sugar.Error(err)
+		}
+	}()
+
+	members := []models.User{}
+	for rows.Next() {
+		var member models.User
+		err := rows.Scan(&member.ID, &member.DisplayName, &member.Picture, &member.Bot)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+
+	return members, rows.Err()
+}
+
+func getDirectChannel(channelID int64) (models.DirectChannel, error) {
+	var channel models.DirectChannel
+	err := db.QueryRow(`
+		SELECT
+			channels.id, channels.name, dm_channels.is_group, dm_channels.last_activity_at, dm_channels.created_at
+		FROM
+			dm_channels
+		JOIN
+			channels ON channels.id = dm_channels.id
+		WHERE
+			dm_channels.id = $1
+	`, channelID).Scan(&channel.ID, &channel.Name, &channel.Group, &channel.LastActivityAt, &channel.CreatedAt)
+	if err != nil {
+		return models.DirectChannel{}, err
+	}
+
+	channel.Members, err = getDirectChannelMembers(channelID)
+	return channel, err
+}
+
+// getJoinedDirectChannel returns the direct channel if the user is in it,
+// writes the error response itself if not
+func getJoinedDirectChannel(w http.ResponseWriter, r *http.Request, userID int64) (models.DirectChannel, bool) {
+	channelID, err := strconv.ParseInt(r.URL.Query().Get("channelID"), 10, 64)
+	if err != nil || channelID == 0 {
+		http.Error(w, "Invalid channel ID", http.StatusBadRequest)
+		return models.DirectChannel{}, false
+	}
+
+	channel, err := getDirectChannel(channelID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Channel not found", http.StatusNotFound)
+		} else {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+		}
+		return models.DirectChannel{}, false
+	}
+
+	if !slices.ContainsFunc(channel.Members, func(member models.User) bool { return member.ID == userID }) {
+		http.Error(w, "You are not member of given channel", http.StatusUnauthorized)
+		return models.DirectChannel{}, false
+	}
+
+	return channel, true
+}
+
+// emitToMembers sends the event to every member of the direct channel, except the given user
+func emitToMembers(messageType string, message any, members []models.User, exceptUserID int64) error {
+	for _, member := range members {
+		if member.ID == exceptUserID {
+			continue
+		}
+
+		err := hub.EmitToUser(messageType, message, member.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// insertDirectChannel creates the channel with its members, pairKey is empty for groups
+func insertDirectChannel(name string, group bool, pairKey string, memberIDs []int64) (int64, error) {
+	channelID := snowflakeNode.Generate().Int64()
+	now := time.Now().UTC()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			sugar.Error(err)
+		}
+	}()
+
+	_, err = tx.Exec("INSERT INTO channels (id, created_at, server_id, name) VALUES($1, $2, NULL, $3)", channelID, now, name)
+	if err != nil {
+		return 0, err
+	}
+
+	var nullablePairKey sql.NullString
+	if pairKey != "" {
+		nullablePairKey = sql.NullString{String: pairKey, Valid: true}
+	}
+
+	_, err = tx.Exec("INSERT INTO dm_channels (id, created_at, is_group, pair_key, last_activity_at) VALUES($1, $2, $3, $4, $5)",
+		channelID, now, group, nullablePairKey, now)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, memberID := range memberIDs {
+		_, err = tx.Exec("INSERT INTO dm_members (channel_id, user_id, since) VALUES($1, $2, $3)", channelID, memberID, now)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return channelID, tx.Commit()
+}
+
+// touchDirectChannel moves the direct channel of the message to the top of its members' lists,
+// members get notified even if they aren't following the channel
+func touchDirectChannel(msg models.Message) error {
+	result, err := db.Exec("UPDATE dm_channels SET last_activity_at = $1 WHERE id = $2", time.Now().UTC(), msg.ChannelID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil || affected == 0 {
+		return err
+	}
+
+	members, err := getDirectChannelMembers(msg.ChannelID)
+	if err != nil {
+		return err
+	}
+
+	activity := models.ChannelActivity{
+		ChannelID: msg.ChannelID,
+		MessageID: msg.ID,
+	}
+
+	return emitToMembers(hub.ChannelActivity, activity, members, 0)
+}
+
+// CreateDirectChannel returns the direct channel with the other user, creating it if there isn't one yet
+func CreateDirectChannel(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	otherUserID, err := strconv.ParseInt(r.URL.Query().Get("userID"), 10, 64)
+	if err != nil || otherUserID == 0 {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	if otherUserID == userID {
+		http.Error(w, "You can't message yourself", http.StatusBadRequest)
+		return
+	}
+
+	exists, err := canBeMessaged(otherUserID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	blocked, err := isBlocked(userID, otherUserID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if blocked {
+		http.Error(w, "You can't message this user", http.StatusForbidden)
+		return
+	}
+
+	key := pairKey(userID, otherUserID)
+
+	var channelID int64
+	err = db.QueryRow("SELECT id FROM dm_channels WHERE pair_key = $1", key).Scan(&channelID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	created := errors.Is(err, sql.ErrNoRows)
+	if created {
+		channelID, err = insertDirectChannel("", false, key, []int64{userID, otherUserID})
+		// a request from the other user created it in the meantime
+		if database.IsUniqueViolation(err) {
+			created = false
+			err = db.QueryRow("SELECT id FROM dm_channels WHERE pair_key = $1", key).Scan(&channelID)
+		}
+		if err != nil {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	channel, err := getDirectChannel(channelID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	if created {
+		err = emitToMembers(hub.DirectChannelCreated, channel, channel.Members, 0)
+		if err != nil {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = json.NewEncoder(w).Encode(channel)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+func CreateGroupDirectChannel(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	type GroupRequest struct {
+		Name    string   `json:"name"`
+		UserIDs []string `json:"userIDs"`
+	}
+
+	var groupRequest GroupRequest
+	err := json.NewDecoder(r.Body).Decode(&groupRequest)
+	if err != nil {
+		sugar.Debug(err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	groupRequest.Name = strings.TrimSpace(groupRequest.Name)
+	if len(groupRequest.Name) > 32 {
+		http.Error(w, "Name can't be longer than 32 characters", http.StatusBadRequest)
+		return
+	}
+
+	memberIDs := []int64{userID}
+	for _, rawID := range groupRequest.UserIDs {
+		memberID, err := strconv.ParseInt(rawID, 10, 64)
+		if err != nil || memberID == 0 {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+		if slices.Contains(memberIDs, memberID) {
+			continue
+		}
+
+		exists, err := canBeMessaged(memberID)
+		if err != nil {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, fmt.Sprintf("User ID [%d] not found", memberID), http.StatusNotFound)
+			return
+		}
+
+		blocked, err := isBlocked(userID, memberID)
+		if err != nil {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		if blocked {
+			http.Error(w, fmt.Sprintf("You can't add user ID [%d] to a group", memberID), http.StatusForbidden)
+			return
+		}
+
+		memberIDs = append(memberIDs, memberID)
+	}
+
+	if len(memberIDs) < 2 {
+		http.Error(w, "A group needs at least one other user", http.StatusBadRequest)
+		return
+	}
+	if len(memberIDs) > maxGroupMembers {
+		http.Error(w, fmt.Sprintf("A group can't have more than %d members", maxGroupMembers), http.StatusBadRequest)
+		return
+	}
+
+	channelID, err := insertDirectChannel(groupRequest.Name, true, "", memberIDs)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	channel, err := getDirectChannel(channelID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = emitToMembers(hub.DirectChannelCreated, channel, channel.Members, 0)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(channel)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+// AddGroupMember lets any member of a group add someone else to it
+func AddGroupMember(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	channel, ok := getJoinedDirectChannel(w, r, userID)
+	if !ok {
+		return
+	}
+	if !channel.Group {
+		http.Error(w, "Members can only be added to groups", http.StatusBadRequest)
+		return
+	}
+
+	newMemberID, err := strconv.ParseInt(r.URL.Query().Get("userID"), 10, 64)
+	if err != nil || newMemberID == 0 {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	if slices.ContainsFunc(channel.Members, func(member models.User) bool { return member.ID == newMemberID }) {
+		http.Error(w, "User is already in this group", http.StatusConflict)
+		return
+	}
+	if len(channel.Members) >= maxGroupMembers {
+		http.Error(w, fmt.Sprintf("A group can't have more than %d members", maxGroupMembers), http.StatusBadRequest)
+		return
+	}
+
+	exists, err := canBeMessaged(newMemberID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	blocked, err := isBlocked(userID, newMemberID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if blocked {
+		http.Error(w, "You can't add this user to a group", http.StatusForbidden)
+		return
+	}
+
+	_, err = db.Exec("INSERT INTO dm_members (channel_id, user_id, since) VALUES($1, $2, $3)", channel.ID, newMemberID, time.Now().UTC())
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	channel, err = getDirectChannel(channel.ID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = emitToMembers(hub.DirectChannelModified, channel, channel.Members, newMemberID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = hub.EmitToUser(hub.DirectChannelCreated, channel, newMemberID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+// LeaveGroup removes the user from the group, the group is deleted with its messages once everyone left
+func LeaveGroup(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	channel, ok := getJoinedDirectChannel(w, r, userID)
+	if !ok {
+		return
+	}
+	if !channel.Group {
+		http.Error(w, "Only groups can be left", http.StatusBadRequest)
+		return
+	}
+
+	_, err := db.Exec("DELETE FROM dm_members WHERE channel_id = $1 AND user_id = $2", channel.ID, userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	// the sessions of the user keep receiving the messages of the group otherwise
+	err = hub.UnsubscribeUser(channel.ID, globals.ChannelTypeChannel, userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	channel.Members = slices.DeleteFunc(channel.Members, func(member models.User) bool { return member.ID == userID })
+	if len(channel.Members) == 0 {
+		_, err = db.Exec("DELETE FROM channels WHERE id = $1", channel.ID)
+		if err != nil {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = emitToMembers(hub.DirectChannelModified, channel, channel.Members, 0)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = hub.EmitToUser(hub.DirectChannelRemoved, channel.ID, userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+// GetDirectChannels returns the direct channels of the user, most recently active first
+func GetDirectChannels(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	rows, err := db.Query(`
+		SELECT
+			channels.id, channels.name, dm_channels.is_group, dm_channels.last_activity_at, dm_channels.created_at
+		FROM
+			dm_members
+		JOIN
+			dm_channels ON dm_channels.id = dm_members.channel_id
+		JOIN
+			channels ON channels.id = dm_channels.id
+		WHERE
+			dm_members.user_id = $1
+		ORDER BY
+			dm_channels.last_activity_at DESC
+	`, userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			sugar.Error(err)
+		}
+	}()
+
+	channels := []models.DirectChannel{}
+	for rows.Next() {
+		var channel models.DirectChannel
+		err := rows.Scan(&channel.ID, &channel.Name, &channel.Group, &channel.LastActivityAt, &channel.CreatedAt)
+		if err != nil {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		channels = append(channels, channel)
+	}
+
+	if err := rows.Err(); err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	// members are looked up after the rows are closed, as sqlite only has one connection
+	for i := range channels {
+		channels[i].Members, err = getDirectChannelMembers(channels[i].ID)
+		if err != nil {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = json.NewEncoder(w).Encode(channels)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
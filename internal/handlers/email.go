@@ -42,6 +42,17 @@ func ConfirmEmail(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	taken, err := isUsernameTaken(u.UserName, 0)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "Error", http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		http.Error(w, "Username was taken in the meantime, register again with another one", http.StatusConflict)
+		return
+	}
+
 	_, err = db.Exec("INSERT INTO users (id, email, username, display_name, picture, password) VALUES($1, $2, $3, $4, $5, $6)",
 		u.ID, u.Email, u.UserName, u.DisplayName, u.Picture, u.Password)
 	if err != nil {
@@ -0,0 +1,467 @@
+package handlers
+
+import (
+	"chatapp-backend/internal/fileHandlers"
+	"chatapp-backend/internal/models"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/httprate"
+)
+
+const maxWebhooksPerChannel = 10
+
+// executions allowed per webhook within the window, as they are usually all called from the same CI servers
+// they don't share a bucket. attempts with a wrong token are counted per IP address instead
+const (
+	webhookRequestLimit = 30
+	webhookWindow       = time.Minute
+)
+
+var webhookLimiter = httprate.NewRateLimiter(webhookRequestLimit, webhookWindow)
+
+const maxMessageLength = 4000
+
+// webhooks post as a user that can't log in, so their messages work like any other,
+// the user stays after the webhook is deleted so its messages do too
+func webhookEmail(webhookID int64) string {
+	return fmt.Sprintf("%d@webhooks.invalid", webhookID)
+}
+
+func webhookURL(webhookID int64, token string) string {
+	return fmt.Sprintf("%s/api/webhook/execute/%d/%s", baseURL, webhookID, token)
+}
+
+// newWebhookToken returns the token given to the owner and the hash that is stored
+func newWebhookToken() (string, string, error) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", "", err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(secret)
+	return token, hashToken(token), nil
+}
+
+// verifyChannelOwner checks if the user owns the server of the channel,
+// writes the error response itself if not
+func verifyChannelOwner(w http.ResponseWriter, userID int64, channelID int64) bool {
+	var serverID sql.NullInt64
+	err := db.QueryRow("SELECT server_id FROM channels WHERE id = $1", channelID).Scan(&serverID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Channel not found", http.StatusNotFound)
+		} else {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+		}
+		return false
+	}
+	if !serverID.Valid {
+		http.Error(w, "Direct channels can't have webhooks", http.StatusBadRequest)
+		return false
+	}
+
+	return verifyServerOwner(w, userID, serverID.Int64)
+}
+
+// getOwnedWebhook returns the webhook if the user owns the server it posts to,
+// writes the error response itself if not
+func getOwnedWebhook(w http.ResponseWriter, r *http.Request, userID int64) (models.Webhook, bool) {
+	webhookID, err := strconv.ParseInt(r.URL.Query().Get("webhookID"), 10, 64)
+	if err != nil || webhookID == 0 {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return models.Webhook{}, false
+	}
+
+	var webhook models.Webhook
+	err = db.QueryRow("SELECT id, channel_id, name, avatar, created_at FROM webhooks WHERE id = $1", webhookID).
+		Scan(&webhook.ID, &webhook.ChannelID, &webhook.Name, &webhook.Avatar, &webhook.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Webhook not found", http.StatusNotFound)
+		} else {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+		}
+		return models.Webhook{}, false
+	}
+
+	if !verifyChannelOwner(w, userID, webhook.ChannelID) {
+		return models.Webhook{}, false
+	}
+
+	return webhook, true
+}
+
+func CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	channelID, err := strconv.ParseInt(r.URL.Query().Get("channelID"), 10, 64)
+	if err != nil || channelID == 0 {
+		http.Error(w, "Invalid channel ID", http.StatusBadRequest)
+		return
+	}
+
+	if !verifyChannelOwner(w, userID, channelID) {
+		return
+	}
+
+	name := strings.TrimSpace(r.URL.Query().Get("name"))
+	if name == "" {
+		name = "Webhook"
+	}
+	if len(name) > 64 {
+		http.Error(w, "Name can't be longer than 64 characters", http.StatusBadRequest)
+		return
+	}
+
+	var webhookCount int
+	err = db.QueryRow("SELECT COUNT(*) FROM webhooks WHERE channel_id = $1", channelID).Scan(&webhookCount)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if webhookCount >= maxWebhooksPerChannel {
+		http.Error(w, fmt.Sprintf("A channel can't have more than %d webhooks", maxWebhooksPerChannel), http.StatusBadRequest)
+		return
+	}
+
+	// the avatar is optional, so the request doesn't need to be multipart
+	avatar, err := fileHandlers.HandleAvatarPicture(r)
+	if err != nil && !errors.Is(err, http.ErrMissingFile) && !errors.Is(err, http.ErrNotMultipart) {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	token, tokenHash, err := newWebhookToken()
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	webhook := models.Webhook{
+		ID:        snowflakeNode.Generate().Int64(),
+		ChannelID: channelID,
+		Name:      name,
+		Avatar:    avatar,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			sugar.Error(err)
+		}
+	}()
+
+	_, err = tx.Exec("INSERT INTO users (id, email, username, display_name, picture, password) VALUES($1, $2, $3, $4, $5, $6)",
+		webhook.ID, webhookEmail(webhook.ID), strconv.FormatInt(webhook.ID, 10), webhook.Name, webhook.Avatar, "")
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec("INSERT INTO webhooks (id, created_at, channel_id, creator_id, name, avatar, token_hash) VALUES($1, $2, $3, $4, $5, $6, $7)",
+		webhook.ID, webhook.CreatedAt, webhook.ChannelID, userID, webhook.Name, webhook.Avatar, tokenHash)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	// only the hash is stored, so this is the only time the URL can be seen
+	webhook.URL = webhookURL(webhook.ID, token)
+
+	err = json.NewEncoder(w).Encode(webhook)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+func GetWebhooks(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	channelID, err := strconv.ParseInt(r.URL.Query().Get("channelID"), 10, 64)
+	if err != nil || channelID == 0 {
+		http.Error(w, "Invalid channel ID", http.StatusBadRequest)
+		return
+	}
+
+	if !verifyChannelOwner(w, userID, channelID) {
+		return
+	}
+
+	rows, err := db.Query("SELECT id, channel_id, name, avatar, created_at FROM webhooks WHERE channel_id = $1 ORDER BY created_at", channelID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			sugar.Error(err)
+		}
+	}()
+
+	webhooks := []models.Webhook{}
+	for rows.Next() {
+		var webhook models.Webhook
+		err := rows.Scan(&webhook.ID, &webhook.ChannelID, &webhook.Name, &webhook.Avatar, &webhook.CreatedAt)
+		if err != nil {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		webhooks = append(webhooks, webhook)
+	}
+
+	if err := rows.Err(); err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(webhooks)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+// RegenerateWebhook replaces the token of the webhook, the old URL stops working
+func RegenerateWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	webhook, ok := getOwnedWebhook(w, r, userID)
+	if !ok {
+		return
+	}
+
+	token, tokenHash, err := newWebhookToken()
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = db.Exec("UPDATE webhooks SET token_hash = $1 WHERE id = $2", tokenHash, webhook.ID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	webhook.URL = webhookURL(webhook.ID, token)
+
+	err = json.NewEncoder(w).Encode(webhook)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+func DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	webhook, ok := getOwnedWebhook(w, r, userID)
+	if !ok {
+		return
+	}
+
+	_, err := db.Exec("DELETE FROM webhooks WHERE id = $1", webhook.ID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+// ExecuteWebhook posts a message to the channel of the webhook, the token in the URL is the only authentication
+func ExecuteWebhook(w http.ResponseWriter, r *http.Request) {
+	webhookID, err := strconv.ParseInt(chi.URLParam(r, "webhookID"), 10, 64)
+	if err != nil || webhookID == 0 {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+
+	ipKey, err := httprate.KeyByIP(r)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	// an IP address that used up its attempts isn't even looked up
+	_, rate, err := webhookLimiter.Status(ipKey)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if rate >= webhookRequestLimit {
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
+	var webhook models.Webhook
+	var tokenHash string
+	err = db.QueryRow("SELECT id, channel_id, name, avatar, token_hash FROM webhooks WHERE id = $1", webhookID).
+		Scan(&webhook.ID, &webhook.ChannelID, &webhook.Name, &webhook.Avatar, &tokenHash)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	if err != nil || subtle.ConstantTimeCompare([]byte(hashToken(chi.URLParam(r, "token"))), []byte(tokenHash)) != 1 {
+		sugar.Debugf("Webhook ID [%d] doesn't exist or was executed with a wrong token", webhookID)
+		webhookLimiter.OnLimit(w, r, ipKey)
+		http.Error(w, "Unknown webhook", http.StatusNotFound)
+		return
+	}
+
+	webhookKey := fmt.Sprintf("webhook:%d", webhook.ID)
+	if claimRateLimit(w, r, webhookKey) || webhookLimiter.RespondOnLimit(w, r, webhookKey) {
+		return
+	}
+
+	type ExecuteRequest struct {
+		Message string `json:"message"`
+		// override the name and avatar of the webhook for this message only
+		Name   string `json:"name"`
+		Avatar string `json:"avatar"`
+	}
+
+	var executeRequest ExecuteRequest
+	err = json.NewDecoder(r.Body).Decode(&executeRequest)
+	if err != nil {
+		sugar.Debug(err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	if strings.TrimSpace(executeRequest.Message) == "" || len(executeRequest.Message) > maxMessageLength {
+		http.Error(w, fmt.Sprintf("Message must be between 1 and %d characters", maxMessageLength), http.StatusBadRequest)
+		return
+	}
+
+	name := webhook.Name
+	if executeRequest.Name != "" {
+		name = strings.TrimSpace(executeRequest.Name)
+		if name == "" || len(name) > 64 {
+			http.Error(w, "Name must be between 1 and 64 characters", http.StatusBadRequest)
+			return
+		}
+	}
+
+	avatar := webhook.Avatar
+	if executeRequest.Avatar != "" {
+		avatarURL, err := url.Parse(executeRequest.Avatar)
+		if err != nil || (avatarURL.Scheme != "https" && avatarURL.Scheme != "http") || avatarURL.Host == "" {
+			http.Error(w, "Avatar must be an http or https URL", http.StatusBadRequest)
+			return
+		}
+		avatar = executeRequest.Avatar
+	}
+
+	msg := models.Message{
+		ID:          snowflakeNode.Generate().Int64(),
+		ChannelID:   webhook.ChannelID,
+		UserID:      webhook.ID,
+		Message:     executeRequest.Message,
+		Attachments: "",
+		Edited:      false,
+		WebhookID:   webhook.ID,
+		User: models.User{
+			DisplayName: name,
+			Picture:     avatar,
+		},
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			sugar.Error(err)
+		}
+	}()
+
+	_, err = tx.Exec("INSERT INTO messages (id, channel_id, user_id, message, attachments, edited) VALUES($1, $2, $3, $4, $5, $6)", msg.ID, msg.ChannelID, msg.UserID, msg.Message, msg.Attachments, msg.Edited)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	// the name and avatar are kept per message, so they stay the same when the webhook is changed
+	_, err = tx.Exec("INSERT INTO message_webhooks (message_id, webhook_id, name, avatar) VALUES($1, $2, $3, $4)", msg.ID, webhook.ID, name, avatar)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = emitMessageCreated(msg)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(msg)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"chatapp-backend/internal/models"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// deviceFromUserAgent makes a short readable name like "Firefox on Linux" from the user agent
+func deviceFromUserAgent(userAgent string) string {
+	browsers := [...][2]string{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"Dart/", "App"},
+		{"curl/", "curl"},
+	}
+	systems := [...][2]string{
+		{"Android", "Android"},
+		{"iPhone", "iOS"},
+		{"iPad", "iPadOS"},
+		{"Windows", "Windows"},
+		{"Mac OS", "macOS"},
+		{"Linux", "Linux"},
+	}
+
+	browser := "Unknown browser"
+	for _, b := range browsers {
+		if strings.Contains(userAgent, b[0]) {
+			browser = b[1]
+			break
+		}
+	}
+
+	for _, s := range systems {
+		if strings.Contains(userAgent, s[0]) {
+			return browser + " on " + s[1]
+		}
+	}
+
+	return browser
+}
+
+func GetLoginSessions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+	familyID := ctx.Value(FamilyIDKeyType{}).(int64)
+
+	rows, err := db.Query(`
+		SELECT
+			login_sessions.id,
+			login_sessions.device,
+			login_sessions.user_agent,
+			login_sessions.ip,
+			login_sessions.created_at,
+			login_sessions.last_used_at,
+			refresh_tokens.expires_at
+		FROM
+			login_sessions
+		JOIN
+			refresh_tokens ON refresh_tokens.family_id = login_sessions.id AND refresh_tokens.used_at IS NULL
+		WHERE
+			login_sessions.user_id = $1
+		ORDER BY
+			login_sessions.last_used_at DESC
+		`, userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			sugar.Error(err)
+		}
+	}()
+
+	loginSessions := []models.LoginSession{}
+	for rows.Next() {
+		var loginSession models.LoginSession
+		var expiresAt time.Time
+
+		err := rows.Scan(&loginSession.ID, &loginSession.Device, &loginSession.UserAgent, &loginSession.IP, &loginSession.CreatedAt, &loginSession.LastUsedAt, &expiresAt)
+		if err != nil {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		// logins that weren't refreshed in time are effectively logged out
+		if time.Now().UTC().After(expiresAt.UTC()) {
+			continue
+		}
+
+		loginSession.Current = loginSession.ID == familyID
+		loginSessions = append(loginSessions, loginSession)
+	}
+
+	if err := rows.Err(); err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(loginSessions)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+func RevokeLoginSession(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	loginSessionID, err := strconv.ParseInt(r.URL.Query().Get("sessionID"), 10, 64)
+	if err != nil || loginSessionID == 0 {
+		http.Error(w, "Invalid session ID", http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM login_sessions WHERE id = $1 AND user_id = $2)", loginSessionID, userID).Scan(&exists)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	if !exists {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	err = revokeFamily(userID, loginSessionID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+// revokeOtherLoginSessions logs out every login of the user except the given one
+func revokeOtherLoginSessions(userID int64, familyID int64) error {
+	rows, err := db.Query("SELECT id FROM login_sessions WHERE user_id = $1 AND id != $2", userID, familyID)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			sugar.Error(err)
+		}
+	}()
+
+	var loginSessionIDs []int64
+	for rows.Next() {
+		var loginSessionID int64
+		err := rows.Scan(&loginSessionID)
+		if err != nil {
+			return err
+		}
+
+		loginSessionIDs = append(loginSessionIDs, loginSessionID)
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, loginSessionID := range loginSessionIDs {
+		err = revokeFamily(userID, loginSessionID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RevokeOtherLoginSessions logs out every login of the user except the current one
+func RevokeOtherLoginSessions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+	familyID := ctx.Value(FamilyIDKeyType{}).(int64)
+
+	err := revokeOtherLoginSessions(userID, familyID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
@@ -1,5 +1,11 @@
 package handlers
 
+import (
+	"chatapp-backend/internal/globals"
+	"chatapp-backend/internal/hub"
+	"chatapp-backend/internal/models"
+)
+
 func isServerOwner(userID int64, serverID int64) (bool, error) {
 	var ownsServer bool
 	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM servers WHERE id = $1 AND owner_id = $2)", serverID, userID).Scan(&ownsServer)
@@ -21,8 +27,35 @@ func addServerMember(serverID int64, userID int64) error {
 	return nil
 }
 
+// emitMemberEvent tells those in the server that a member joined or left
+func emitMemberEvent(messageType string, serverID int64, userID int64) error {
+	member := models.ServerMember{
+		ServerID: serverID,
+		User:     models.User{ID: userID},
+	}
+
+	err := db.QueryRow("SELECT display_name, picture, EXISTS(SELECT 1 FROM bots WHERE bots.id = users.id) FROM users WHERE id = $1", userID).
+		Scan(&member.User.DisplayName, &member.User.Picture, &member.User.Bot)
+	if err != nil {
+		return err
+	}
+
+	return hub.Emit(messageType, globals.ChannelTypeServer, member, serverID)
+}
+
 func isServerMember(serverID int64, userID int64) (bool, error) {
 	var isMember bool = false
 	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM server_members WHERE server_id = $1 AND user_id = $2)", serverID, userID).Scan(&isMember)
 	return isMember, err
 }
+
+// isChannelMember checks if the user is in the server of the channel, or in the direct channel itself
+func isChannelMember(channelID int64, userID int64) (bool, error) {
+	var isMember bool = false
+	err := db.QueryRow(`
+		SELECT
+			EXISTS(SELECT 1 FROM channels c JOIN server_members m ON c.server_id = m.server_id WHERE c.id = $1 AND m.user_id = $2) OR
+			EXISTS(SELECT 1 FROM dm_members WHERE channel_id = $1 AND user_id = $2)
+	`, channelID, userID).Scan(&isMember)
+	return isMember, err
+}
@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"chatapp-backend/internal/email"
+	"chatapp-backend/internal/keyValue"
+	"chatapp-backend/internal/validator"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const magicLinkLifetime = 15 * time.Minute
+
+// links asked for the same email within the window, on top of the limit per IP
+const (
+	magicLinksPerEmail   = 3
+	magicLinkEmailWindow = 15 * time.Minute
+)
+
+func magicLinkKey(token string) string {
+	return fmt.Sprintf("magic_link:%s", token)
+}
+
+func magicLinkRequestsKey(emailAddress string) string {
+	return fmt.Sprintf("magic_link_requests:%s", strings.ToLower(emailAddress))
+}
+
+type magicLink struct {
+	UserID int64 `json:"userID"`
+}
+
+// allowMagicLink counts the request for the email, it's counted whether there is such an account or not.
+// the window starts with the first request, asking again doesn't extend it
+func allowMagicLink(emailAddress string) (bool, error) {
+	count, err := keyValue.Incr(magicLinkRequestsKey(emailAddress), magicLinkEmailWindow)
+	if err != nil {
+		return false, err
+	}
+	return count <= magicLinksPerEmail, nil
+}
+
+// sendMagicLink does nothing if there is no such account, bots and webhooks can't sign in this way
+func sendMagicLink(emailAddress string) error {
+	userID, username, found, err := getPasswordUserByEmail(emailAddress)
+	if err != nil || !found {
+		return err
+	}
+
+	token, err := uuid.NewRandom()
+	if err != nil {
+		return err
+	}
+
+	bytes, err := json.Marshal(magicLink{UserID: userID})
+	if err != nil {
+		return err
+	}
+
+	err = keyValue.Set(magicLinkKey(token.String()), string(bytes), magicLinkLifetime)
+	if err != nil {
+		return err
+	}
+
+	return email.SendMagicLink(emailAddress, username, token.String())
+}
+
+// RequestMagicLink emails a link to sign in with, at most magicLinksPerEmail times per window for an address
+// so its inbox can't be flooded from many IPs. the link only opens a page, signing in is the POST to MagicLinkLogin
+func RequestMagicLink(w http.ResponseWriter, r *http.Request) {
+	type LinkRequest struct {
+		Email string `json:"email"`
+	}
+
+	var linkRequest LinkRequest
+	err := json.NewDecoder(r.Body).Decode(&linkRequest)
+	if err != nil {
+		sugar.Debug(err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	err = validator.Email(linkRequest.Email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	allowed, err := allowMagicLink(linkRequest.Email)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, "too_many_requests", http.StatusTooManyRequests)
+		return
+	}
+
+	go func() {
+		err := sendMagicLink(linkRequest.Email)
+		if err != nil {
+			sugar.Error(err)
+		}
+	}()
+
+	_, err = fmt.Fprintf(w, "magic_link_sent")
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+// MagicLinkLogin is called by the page the link opens, a plain GET would let link scanners in emails use it up.
+// the link only stands in for the password, users with a second factor are answered with a challenge like Login does
+func MagicLinkLogin(w http.ResponseWriter, r *http.Request) {
+	type Login struct {
+		Token string `json:"token"`
+	}
+
+	var login Login
+	err := json.NewDecoder(r.Body).Decode(&login)
+	if err != nil {
+		sugar.Debug(err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	value, err := keyValue.GetDel(magicLinkKey(login.Token))
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if value == "" {
+		http.Error(w, "Token isn't valid", http.StatusUnauthorized)
+		return
+	}
+
+	var link magicLink
+	err = json.Unmarshal([]byte(value), &link)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	rememberMe := r.URL.Query().Get("rememberMe") == "true"
+
+	twoFactorEnabled, err := hasTwoFactor(link.UserID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if twoFactorEnabled {
+		err = startLoginChallenge(w, link.UserID, rememberMe)
+		if err != nil {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	err = startLogin(w, r, link.UserID, rememberMe)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
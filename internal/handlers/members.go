@@ -20,7 +20,8 @@ func GetMemberList(w http.ResponseWriter, r *http.Request) {
 		SELECT 
 			users.id,
 			users.display_name,
-			users.picture
+			users.picture,
+			EXISTS(SELECT 1 FROM bots WHERE bots.id = users.id)
 		FROM 
 			channels
 		JOIN 
@@ -29,6 +30,18 @@ func GetMemberList(w http.ResponseWriter, r *http.Request) {
 			users ON server_members.user_id = users.id
 		WHERE 
 			channels.id = $1
+		UNION
+		SELECT
+			users.id,
+			users.display_name,
+			users.picture,
+			EXISTS(SELECT 1 FROM bots WHERE bots.id = users.id)
+		FROM
+			dm_members
+		JOIN
+			users ON dm_members.user_id = users.id
+		WHERE
+			dm_members.channel_id = $1
 		`, channelID)
 	if err != nil {
 		sugar.Error(err)
@@ -45,7 +58,7 @@ func GetMemberList(w http.ResponseWriter, r *http.Request) {
 	var users []models.User
 	for rows.Next() {
 		var user models.User
-		err := rows.Scan(&user.ID, &user.DisplayName, &user.Picture)
+		err := rows.Scan(&user.ID, &user.DisplayName, &user.Picture, &user.Bot)
 		if err != nil {
 			sugar.Error(err)
 			http.Error(w, "", http.StatusInternalServerError)
@@ -27,7 +27,32 @@ func CreateMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// TODO check if user is member of channel
+	// commands of bots aren't posted, bots can't run commands so they can't trigger each other
+	if !ctx.Value(AuthInfoKeyType{}).(authInfo).isBot() && runCommand(w, userID, messageRequest.ChannelID, messageRequest.Message) {
+		return
+	}
+
+	isMember, err := isChannelMember(messageRequest.ChannelID, userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if !isMember {
+		http.Error(w, "You are not member of given channel", http.StatusUnauthorized)
+		return
+	}
+
+	blocked, err := isBlockedInDirectChannel(messageRequest.ChannelID, userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if blocked {
+		http.Error(w, "You can't message this user", http.StatusForbidden)
+		return
+	}
 
 	messageID := snowflakeNode.Generate().Int64()
 
@@ -54,7 +79,14 @@ func CreateMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = hub.Emit(hub.MessageCreated, globals.ChannelTypeChannel, msg, msg.ChannelID)
+	err = emitMessageCreated(msg)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = touchDirectChannel(msg)
 	if err != nil {
 		sugar.Error(err)
 		http.Error(w, "", http.StatusInternalServerError)
@@ -62,8 +94,34 @@ func CreateMessage(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// emitMessageCreated sends the message to those viewing the channel,
+// and notifies those only following it.
+// users who blocked the author get it marked as blocked, like in the message list
+func emitMessageCreated(msg models.Message) error {
+	blockedBy, err := usersBlocking(msg.UserID)
+	if err != nil {
+		return err
+	}
+
+	blockedMsg := msg
+	blockedMsg.Blocked = true
+
+	err = hub.EmitWithOverride(hub.MessageCreated, globals.ChannelTypeChannel, msg, msg.ChannelID, blockedMsg, blockedBy)
+	if err != nil {
+		return err
+	}
+
+	activity := models.ChannelActivity{
+		ChannelID: msg.ChannelID,
+		MessageID: msg.ID,
+	}
+
+	return hub.Emit(hub.ChannelActivity, globals.ChannelTypeChannelActivity, activity, msg.ChannelID)
+}
+
 func GetMessageList(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
 	sessionID := ctx.Value(SessionIDKeyType{}).(int64)
 
 	channelID, err := strconv.ParseInt(r.URL.Query().Get("channelID"), 10, 64)
@@ -84,7 +142,16 @@ func GetMessageList(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// TODO check if user is member of channel
+	isMember, err := isChannelMember(channelID, userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if !isMember {
+		http.Error(w, "You are not member of given channel", http.StatusUnauthorized)
+		return
+	}
 
 	query := `
 		SELECT
@@ -94,20 +161,24 @@ func GetMessageList(w http.ResponseWriter, r *http.Request) {
 			messages.message,
 			messages.attachments,
 			messages.edited,
-			users.display_name,
-			users.picture
+			COALESCE(message_webhooks.name, users.display_name),
+			COALESCE(message_webhooks.avatar, users.picture),
+			COALESCE(message_webhooks.webhook_id, 0),
+			EXISTS(SELECT 1 FROM relationships WHERE user_id = $1 AND other_user_id = messages.user_id AND type = $2)
 		FROM
 			messages
 		JOIN
 			users ON messages.user_id = users.id
+		LEFT JOIN
+			message_webhooks ON message_webhooks.message_id = messages.id
 		WHERE
-			messages.channel_ID = $1 AND (messages.id < $2 OR $2 = 0)
+			messages.channel_ID = $3 AND (messages.id < $4 OR $4 = 0)
 		ORDER BY
 			messages.created_at DESC
 		LIMIT 25;
 	`
 
-	rows, err := db.Query(query, channelID, messageID)
+	rows, err := db.Query(query, userID, relationshipBlocked, channelID, messageID)
 	if err != nil {
 		sugar.Error(err)
 		http.Error(w, "", http.StatusInternalServerError)
@@ -124,7 +195,7 @@ func GetMessageList(w http.ResponseWriter, r *http.Request) {
 	for rows.Next() {
 		var msg models.Message
 
-		err := rows.Scan(&msg.ID, &msg.ChannelID, &msg.UserID, &msg.Message, &msg.Attachments, &msg.Edited, &msg.User.DisplayName, &msg.User.Picture)
+		err := rows.Scan(&msg.ID, &msg.ChannelID, &msg.UserID, &msg.Message, &msg.Attachments, &msg.Edited, &msg.User.DisplayName, &msg.User.Picture, &msg.WebhookID, &msg.Blocked)
 		if err != nil {
 			sugar.Error(err)
 			http.Error(w, "", http.StatusInternalServerError)
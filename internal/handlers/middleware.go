@@ -8,18 +8,20 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
-	"strconv"
+	"strings"
 	"time"
 )
 
 type SessionIDKeyType struct{}
 type UserIDKeyType struct{}
+type FamilyIDKeyType struct{}
+type AuthInfoKeyType struct{}
 
 func AllowCors(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Session-Token")
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
 
 		if r.Method == "OPTIONS" {
@@ -31,134 +33,322 @@ func AllowCors(next http.Handler) http.Handler {
 	})
 }
 
+// authError is returned when credentials are rejected, the message can be shown to the client
+type authError struct {
+	status  int
+	message string
+	// the credential was an access token that will never be accepted again, so its cookie can be deleted
+	clearCookie bool
+}
+
+func (e *authError) Error() string {
+	return e.message
+}
+
+// writeAuthError responds with the rejection, or with an internal error if it wasn't a rejection
+func writeAuthError(w http.ResponseWriter, err error) {
+	var rejection *authError
+	if !errors.As(err, &rejection) {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	if rejection.clearCookie {
+		deleteCookie(w, "JWT", "/")
+	}
+	http.Error(w, rejection.message, rejection.status)
+}
+
+// sessionToken reads the session from the cookie, clients that can't keep cookies may send it in a header instead
+func sessionToken(r *http.Request) string {
+	sessionCookie, err := r.Cookie("session")
+	if err == nil {
+		return sessionCookie.Value
+	}
+
+	return r.Header.Get("X-Session-Token")
+}
+
+// checkSessionToken returns the ID of the session if it exists and belongs to the user
+func checkSessionToken(token string, userID int64) (int64, error) {
+	if token == "" {
+		return 0, &authError{status: http.StatusUnauthorized, message: "No session cookie was provided"}
+	}
+
+	sessionID, secret, err := parseSecretToken(token)
+	if err != nil {
+		sugar.Debug(err)
+		return 0, &authError{status: http.StatusBadRequest, message: "Session cookie is in improper format"}
+	}
+
+	sessionUserID, err := getSessionOwner(sessionID, secret)
+	if err != nil {
+		return 0, err
+	}
+
+	if sessionUserID != userID {
+		if sessionUserID != 0 {
+			sugar.Warnf("User ID [%d] tried to use session ID [%d] of user ID [%d]", userID, sessionID, sessionUserID)
+		}
+		return 0, &authError{status: http.StatusUnauthorized, message: "Session isn't valid"}
+	}
+
+	return sessionID, nil
+}
+
+// verifySessionCookie checks that the session exists and belongs to the user,
+// it writes the error response itself if it doesn't
+func verifySessionCookie(w http.ResponseWriter, r *http.Request, userID int64) (int64, bool) {
+	sessionID, err := checkSessionToken(sessionToken(r), userID)
+	if err != nil {
+		writeAuthError(w, err)
+		return 0, false
+	}
+
+	return sessionID, true
+}
+
 func SessionVerifier(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		sessionCookie, err := r.Cookie("session")
-		if err != nil {
-			sugar.Debug(err)
-			switch {
-			case errors.Is(err, http.ErrNoCookie):
-				http.Error(w, "No session cookie was provided", http.StatusUnauthorized)
-			default:
-				http.Error(w, "Couldn't read session cookie", http.StatusInternalServerError)
-			}
+		userID := r.Context().Value(UserIDKeyType{}).(int64)
+
+		sessionID, ok := verifySessionCookie(w, r, userID)
+		if !ok {
 			return
 		}
 
-		sessionID, err := strconv.ParseInt(sessionCookie.Value, 10, 64)
+		// the websocket of the session may be held by a different node
+		session, exists, err := hub.GetSession(sessionID)
 		if err != nil {
 			sugar.Error(err)
-			http.Error(w, "Session cookie is in improper format", http.StatusBadRequest)
+			http.Error(w, "", http.StatusInternalServerError)
 			return
 		}
 
-		_, exists := hub.GetClient(sessionID)
-		if exists {
+		if exists && session.UserID == userID {
 			ctx := context.WithValue(r.Context(), SessionIDKeyType{}, sessionID)
 			next.ServeHTTP(w, r.WithContext(ctx))
 		} else {
-			http.Error(w, "You are not connected to websocket", http.StatusUnauthorized)
+			http.Error(w, "You are not connected to websocket, SSE or long polling", http.StatusUnauthorized)
 			return
 		}
 	})
 }
 
+// authInfo describes who made the request and with what credentials
+type authInfo struct {
+	userID int64
+	// refresh token family of the access token, 0 for API keys and bots
+	familyID int64
+	// 0 for access tokens and bots
+	apiKeyID int64
+	// nil for access tokens and bots, which can do everything the user can
+	scopes []string
+	// changes every time the token of the bot is regenerated, 0 for humans
+	botTokenID int64
+}
+
+func (info authInfo) isBot() bool {
+	return info.botTokenID != 0
+}
+
+// accessToken reads the credential from the Authorization header,
+// or from the JWT cookie for browsers
+func accessToken(r *http.Request) (string, error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		token, found := strings.CutPrefix(header, "Bearer ")
+		if !found || token == "" {
+			return "", &authError{status: http.StatusBadRequest, message: "Authorization header must be a Bearer token"}
+		}
+		return token, nil
+	}
+
+	jwtCookie, err := r.Cookie("JWT")
+	if err != nil {
+		sugar.Debug(err)
+		if errors.Is(err, http.ErrNoCookie) {
+			return "", &authError{status: http.StatusUnauthorized, message: "No jwt cookie was provided"}
+		}
+		return "", err
+	}
+
+	return jwtCookie.Value, nil
+}
+
+// authenticate accepts either an access token or an API key
+func authenticate(token string) (authInfo, error) {
+	if apiKey, isApiKey := strings.CutPrefix(token, apiKeyPrefix); isApiKey {
+		return verifyApiKey(apiKey)
+	}
+	if botToken, isBotToken := strings.CutPrefix(token, botTokenPrefix); isBotToken {
+		return verifyBotToken(botToken)
+	}
+
+	userToken, err := jwt.VerifyToken(token)
+	if err != nil {
+		sugar.Debug(err)
+		return authInfo{}, &authError{status: http.StatusBadRequest, message: "Couldn't verify JWT"}
+	}
+
+	// check if token is expired
+	expired := time.Now().UTC().After(userToken.ExpiresAt.UTC())
+	if expired {
+		return authInfo{}, &authError{status: http.StatusUnauthorized, message: "Login expired"}
+	}
+
+	if userToken.FamilyID == 0 {
+		return authInfo{}, &authError{status: http.StatusUnauthorized, message: "Login expired"}
+	}
+
+	revoked, err := isTokenRevoked(userToken)
+	if err != nil {
+		return authInfo{}, err
+	}
+	if revoked {
+		return authInfo{}, &authError{status: http.StatusUnauthorized, message: "Login expired", clearCookie: true}
+	}
+
+	// check if user exists
+	key := fmt.Sprintf("user_exists:%d", userToken.UserID)
+
+	userFound := false
+
+	value, err := keyValue.Get(key)
+	if err != nil {
+		return authInfo{}, err
+	}
+
+	if value == "" { // user isn't cached
+		err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)", userToken.UserID).Scan(&userFound)
+		if err != nil {
+			return authInfo{}, err
+		}
+		if userFound {
+			err = keyValue.Set(key, "y", 15*time.Minute)
+			if err != nil {
+				return authInfo{}, err
+			}
+			sugar.Debugf("User ID %d was found in database and was cached\n", userToken.UserID)
+		} else {
+			sugar.Error("User ID %d was not found in database\n", userToken.UserID)
+		}
+	} else {
+		sugar.Debugf("User ID %d was found in cache\n", userToken.UserID)
+		userFound = true
+	}
+
+	// delete JWT token from client, this should run when a user deleted their account,
+	// but kept the JWT token for any reason
+	if !userFound {
+		return authInfo{}, &authError{status: http.StatusUnauthorized, clearCookie: true}
+	}
+
+	return authInfo{userID: userToken.UserID, familyID: userToken.FamilyID}, nil
+}
+
+func withAuthInfo(ctx context.Context, info authInfo) context.Context {
+	// this passes the authenticated user's ID to next handler
+	ctx = context.WithValue(ctx, UserIDKeyType{}, info.userID)
+	ctx = context.WithValue(ctx, FamilyIDKeyType{}, info.familyID)
+	ctx = context.WithValue(ctx, AuthInfoKeyType{}, info)
+	return ctx
+}
+
+// loginSessionID is what the hub groups connections by, so revoking the login, API key or bot token closes them
+func (info authInfo) loginSessionID() int64 {
+	switch {
+	case info.apiKeyID != 0:
+		return info.apiKeyID
+	case info.isBot():
+		return info.botTokenID
+	default:
+		return info.familyID
+	}
+}
+
+func loginSessionID(ctx context.Context) int64 {
+	return ctx.Value(AuthInfoKeyType{}).(authInfo).loginSessionID()
+}
+
 func UserVerifier(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		jwtCookie, err := r.Cookie("JWT")
+		token, err := accessToken(r)
 		if err != nil {
-			sugar.Debug(err)
-			switch {
-			case errors.Is(err, http.ErrNoCookie):
-				http.Error(w, "No jwt cookie was provided", http.StatusUnauthorized)
-			default:
-				http.Error(w, "Couldn't read jwt cookie", http.StatusInternalServerError)
-			}
+			writeAuthError(w, err)
 			return
 		}
 
-		userToken, err := jwt.VerifyToken(jwtCookie.Value)
+		info, err := authenticate(token)
 		if err != nil {
-			sugar.Debug(err)
-			http.Error(w, "Couldn't verify JWT", http.StatusBadRequest)
+			writeAuthError(w, err)
 			return
 		}
 
-		// check if token is expired
-		expired := time.Now().UTC().After(userToken.ExpiresAt.UTC())
-		if expired {
-			sugar.Debug(err)
-			http.Error(w, "Login expired", http.StatusUnauthorized)
+		if info.isBot() && claimRateLimit(w, r, fmt.Sprintf("bot:%d", info.userID)) {
 			return
 		}
 
-		// check if user exists
-		key := fmt.Sprintf("user_exists:%d", userToken.UserID)
-
-		userFound := false
+		next.ServeHTTP(w, r.WithContext(withAuthInfo(r.Context(), info)))
+	})
+}
 
-		value, err := keyValue.Get(key)
-		if err != nil {
-			sugar.Error(err)
-			http.Error(w, "", http.StatusInternalServerError)
-			return
-		}
+// ScopeVerifier limits API keys to the resource they have scopes for,
+// GET requests need the read scope, everything else the write scope
+func ScopeVerifier(resource string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			scope := resource + ":write"
+			if r.Method == http.MethodGet {
+				scope = resource + ":read"
+			}
 
-		if value == "" { // user isn't cached
-			dbErr := db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)", userToken.UserID).Scan(&userFound)
-			if dbErr != nil {
-				sugar.Error(dbErr)
-				http.Error(w, "", http.StatusInternalServerError)
+			if !hasScope(r.Context(), scope) {
+				http.Error(w, fmt.Sprintf("API key is missing the %s scope", scope), http.StatusForbidden)
 				return
 			}
-			if userFound {
-				err = keyValue.Set(key, "y", 15*time.Minute)
-				if err != nil {
-					sugar.Error(err)
-					http.Error(w, "", http.StatusInternalServerError)
-					return
-				}
-				sugar.Debugf("User ID %d was found in database and was cached\n", userToken.UserID)
-			} else {
-				sugar.Error("User ID %d was not found in database\n", userToken.UserID)
-			}
-		} else {
-			sugar.Debugf("User ID %d was found in cache\n", userToken.UserID)
-			userFound = true
-		}
 
-		// delete JWT token from client, this should run when a user deleted their account,
-		// but kept the JWT token for any reason
-		if !userFound {
-			deleteJwtCookie := &http.Cookie{
-				Name:     "JWT",
-				Value:    "",
-				Path:     "/",
-				Expires:  time.Unix(0, 0),
-				HttpOnly: true,
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireScope only lets API keys through if they have the scope
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !hasScope(r.Context(), scope) {
+				http.Error(w, fmt.Sprintf("API key is missing the %s scope", scope), http.StatusForbidden)
+				return
 			}
 
-			http.SetCookie(w, deleteJwtCookie)
-			http.Error(w, "", http.StatusUnauthorized)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireLogin is for managing logins, API keys and bots, which only the human user themself should be able to do
+func RequireLogin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := r.Context().Value(AuthInfoKeyType{}).(authInfo)
+		if info.apiKeyID != 0 || info.isBot() {
+			http.Error(w, "Only usable with a login", http.StatusForbidden)
 			return
 		}
 
-		// renew JWT and cookie
-		timeSinceLast := time.Now().UTC().Sub(userToken.IssuedAt.Time)
-
-		if timeSinceLast >= 15*time.Minute {
-			updatedCookie, err := jwt.CreateToken(userToken.Remember, userToken.UserID)
-			if err != nil {
-				sugar.Error(err)
-				http.Error(w, "Couldn't renew cookie", http.StatusInternalServerError)
-				return
-			}
+		next.ServeHTTP(w, r)
+	})
+}
 
-			http.SetCookie(w, &updatedCookie)
+// RequireBot is for what only bots do, like registering commands and responding to interactions
+func RequireBot(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := r.Context().Value(AuthInfoKeyType{}).(authInfo)
+		if !info.isBot() {
+			http.Error(w, "Only usable by bots", http.StatusForbidden)
+			return
 		}
 
-		// this passes the authenticated user's ID to next handler
-		ctx := context.WithValue(r.Context(), UserIDKeyType{}, userToken.UserID)
-		next.ServeHTTP(w, r.WithContext(ctx))
+		next.ServeHTTP(w, r)
 	})
 }
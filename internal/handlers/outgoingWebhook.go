@@ -0,0 +1,369 @@
+package handlers
+
+import (
+	"chatapp-backend/internal/models"
+	"chatapp-backend/internal/outgoingWebhooks"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxOutgoingWebhooksPerServer = 10
+
+const maxDeliveriesListed = 50
+
+// verifyServerOwner checks if the user owns the server, writes the error response itself if not
+func verifyServerOwner(w http.ResponseWriter, userID int64, serverID int64) bool {
+	ownsServer, err := isServerOwner(userID, serverID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return false
+	}
+	if !ownsServer {
+		sugar.Warnf("User ID [%d] tried to manage webhooks of server ID [%d] they don't own", userID, serverID)
+		http.Error(w, "You don't own this server", http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+// getOwnedOutgoingWebhook returns the webhook if the user owns its server,
+// writes the error response itself if not
+func getOwnedOutgoingWebhook(w http.ResponseWriter, r *http.Request, userID int64) (models.OutgoingWebhook, bool) {
+	webhookID, err := strconv.ParseInt(r.URL.Query().Get("webhookID"), 10, 64)
+	if err != nil || webhookID == 0 {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return models.OutgoingWebhook{}, false
+	}
+
+	var webhook models.OutgoingWebhook
+	var events string
+	err = db.QueryRow("SELECT id, server_id, url, events, enabled, consecutive_failures, created_at FROM outgoing_webhooks WHERE id = $1", webhookID).
+		Scan(&webhook.ID, &webhook.ServerID, &webhook.URL, &events, &webhook.Enabled, &webhook.ConsecutiveFailures, &webhook.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Webhook not found", http.StatusNotFound)
+		} else {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+		}
+		return models.OutgoingWebhook{}, false
+	}
+	webhook.Events = strings.Fields(events)
+
+	if !verifyServerOwner(w, userID, webhook.ServerID) {
+		return models.OutgoingWebhook{}, false
+	}
+
+	return webhook, true
+}
+
+// validateOutgoingWebhookURL only checks the form of the URL,
+// private addresses are refused when connecting, as that's when the address is known for sure
+func validateOutgoingWebhookURL(rawURL string) error {
+	if len(rawURL) > 2048 {
+		return errors.New("URL can't be longer than 2048 characters")
+	}
+
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil || (parsedURL.Scheme != "https" && parsedURL.Scheme != "http") || parsedURL.Host == "" {
+		return errors.New("URL must be an http or https URL")
+	}
+	if parsedURL.User != nil {
+		return errors.New("URL can't contain credentials")
+	}
+
+	return nil
+}
+
+// CreateOutgoingWebhook subscribes a URL to events of the server, the secret the requests are signed with
+// is only returned here and when it's regenerated
+func CreateOutgoingWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	serverID, err := strconv.ParseInt(r.URL.Query().Get("serverID"), 10, 64)
+	if err != nil || serverID == 0 {
+		http.Error(w, "Invalid server ID", http.StatusBadRequest)
+		return
+	}
+
+	if !verifyServerOwner(w, userID, serverID) {
+		return
+	}
+
+	type OutgoingWebhookRequest struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}
+
+	var webhookRequest OutgoingWebhookRequest
+	err = json.NewDecoder(r.Body).Decode(&webhookRequest)
+	if err != nil {
+		sugar.Debug(err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	err = validateOutgoingWebhookURL(webhookRequest.URL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(webhookRequest.Events) == 0 {
+		http.Error(w, "At least one event is needed", http.StatusBadRequest)
+		return
+	}
+	events := []string{}
+	for _, event := range webhookRequest.Events {
+		if !outgoingWebhooks.IsEvent(event) {
+			http.Error(w, fmt.Sprintf("Unknown event [%s]", event), http.StatusBadRequest)
+			return
+		}
+		if !slices.Contains(events, event) {
+			events = append(events, event)
+		}
+	}
+
+	var webhookCount int
+	err = db.QueryRow("SELECT COUNT(*) FROM outgoing_webhooks WHERE server_id = $1", serverID).Scan(&webhookCount)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if webhookCount >= maxOutgoingWebhooksPerServer {
+		http.Error(w, fmt.Sprintf("A server can't have more than %d outgoing webhooks", maxOutgoingWebhooksPerServer), http.StatusBadRequest)
+		return
+	}
+
+	secret, err := outgoingWebhooks.NewSecret()
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	webhook := models.OutgoingWebhook{
+		ID:        snowflakeNode.Generate().Int64(),
+		ServerID:  serverID,
+		URL:       webhookRequest.URL,
+		Events:    events,
+		Enabled:   true,
+		CreatedAt: time.Now().UTC(),
+		Secret:    secret,
+	}
+
+	_, err = db.Exec("INSERT INTO outgoing_webhooks (id, created_at, server_id, creator_id, url, secret, events) VALUES($1, $2, $3, $4, $5, $6, $7)",
+		webhook.ID, webhook.CreatedAt, webhook.ServerID, userID, webhook.URL, webhook.Secret, strings.Join(webhook.Events, " "))
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(webhook)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+func GetOutgoingWebhooks(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	serverID, err := strconv.ParseInt(r.URL.Query().Get("serverID"), 10, 64)
+	if err != nil || serverID == 0 {
+		http.Error(w, "Invalid server ID", http.StatusBadRequest)
+		return
+	}
+
+	if !verifyServerOwner(w, userID, serverID) {
+		return
+	}
+
+	rows, err := db.Query("SELECT id, server_id, url, events, enabled, consecutive_failures, created_at FROM outgoing_webhooks WHERE server_id = $1 ORDER BY created_at", serverID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			sugar.Error(err)
+		}
+	}()
+
+	webhooks := []models.OutgoingWebhook{}
+	for rows.Next() {
+		var webhook models.OutgoingWebhook
+		var events string
+		err := rows.Scan(&webhook.ID, &webhook.ServerID, &webhook.URL, &events, &webhook.Enabled, &webhook.ConsecutiveFailures, &webhook.CreatedAt)
+		if err != nil {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		webhook.Events = strings.Fields(events)
+
+		webhooks = append(webhooks, webhook)
+	}
+
+	if err := rows.Err(); err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(webhooks)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+// GetOutgoingWebhookDeliveries returns the latest deliveries of the webhook, newest first
+func GetOutgoingWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	webhook, ok := getOwnedOutgoingWebhook(w, r, userID)
+	if !ok {
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT
+			id, webhook_id, event, payload, status, attempts, next_attempt_at, response_status, error, created_at
+		FROM
+			outgoing_webhook_deliveries
+		WHERE
+			webhook_id = $1
+		ORDER BY
+			created_at DESC
+		LIMIT $2
+	`, webhook.ID, maxDeliveriesListed)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			sugar.Error(err)
+		}
+	}()
+
+	deliveries := []models.OutgoingWebhookDelivery{}
+	for rows.Next() {
+		var delivery models.OutgoingWebhookDelivery
+		var payload string
+		err := rows.Scan(&delivery.ID, &delivery.WebhookID, &delivery.Event, &payload, &delivery.Status, &delivery.Attempts,
+			&delivery.NextAttemptAt, &delivery.ResponseStatus, &delivery.Error, &delivery.CreatedAt)
+		if err != nil {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		delivery.Payload = json.RawMessage(payload)
+
+		deliveries = append(deliveries, delivery)
+	}
+
+	if err := rows.Err(); err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(deliveries)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+// EnableOutgoingWebhook turns a webhook back on after it was disabled for failing too often
+func EnableOutgoingWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	webhook, ok := getOwnedOutgoingWebhook(w, r, userID)
+	if !ok {
+		return
+	}
+
+	_, err := db.Exec("UPDATE outgoing_webhooks SET enabled = TRUE, consecutive_failures = 0 WHERE id = $1", webhook.ID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+// RegenerateOutgoingWebhookSecret replaces the secret requests are signed with, retries of earlier deliveries use the new one too
+func RegenerateOutgoingWebhookSecret(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	webhook, ok := getOwnedOutgoingWebhook(w, r, userID)
+	if !ok {
+		return
+	}
+
+	secret, err := outgoingWebhooks.NewSecret()
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = db.Exec("UPDATE outgoing_webhooks SET secret = $1 WHERE id = $2", secret, webhook.ID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	webhook.Secret = secret
+
+	err = json.NewEncoder(w).Encode(webhook)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+func DeleteOutgoingWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	webhook, ok := getOwnedOutgoingWebhook(w, r, userID)
+	if !ok {
+		return
+	}
+
+	_, err := db.Exec("DELETE FROM outgoing_webhooks WHERE id = $1", webhook.ID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
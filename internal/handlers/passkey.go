@@ -0,0 +1,613 @@
+package handlers
+
+import (
+	"chatapp-backend/internal/keyValue"
+	"chatapp-backend/internal/models"
+	"chatapp-backend/internal/passkey"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+)
+
+const maxPasskeysPerUser = 25
+
+// the ceremony sessions expire on their own too, the library checks it when they're finished
+const passkeyCeremonyLifetime = 5 * time.Minute
+
+// a user registers one passkey at a time, starting again replaces the previous attempt
+func passkeyRegistrationKey(userID int64) string {
+	return fmt.Sprintf("passkey_registration:%d", userID)
+}
+
+func passkeyLoginKey(token string) string {
+	return fmt.Sprintf("passkey_login:%s", token)
+}
+
+func encodeCredentialID(id []byte) string {
+	return base64.RawURLEncoding.EncodeToString(id)
+}
+
+func hasPasskeys(userID int64) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM passkeys WHERE user_id = $1)", userID).Scan(&exists)
+	return exists, err
+}
+
+// getPasskeyUser returns sql.ErrNoRows for bots and webhooks, they can't have passkeys
+func getPasskeyUser(userID int64) (passkey.User, error) {
+	user := passkey.User{ID: userID}
+	err := db.QueryRow(`
+		SELECT username, display_name FROM users
+		WHERE id = $1 AND NOT EXISTS(SELECT 1 FROM bots WHERE bots.id = users.id) AND NOT EXISTS(SELECT 1 FROM webhooks WHERE webhooks.id = users.id)
+	`, userID).Scan(&user.Name, &user.DisplayName)
+	if err != nil {
+		return passkey.User{}, err
+	}
+
+	rows, err := db.Query("SELECT credential FROM passkeys WHERE user_id = $1", userID)
+	if err != nil {
+		return passkey.User{}, err
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			sugar.Error(err)
+		}
+	}()
+
+	for rows.Next() {
+		var credentialJSON string
+		err := rows.Scan(&credentialJSON)
+		if err != nil {
+			return passkey.User{}, err
+		}
+
+		var credential webauthn.Credential
+		err = json.Unmarshal([]byte(credentialJSON), &credential)
+		if err != nil {
+			return passkey.User{}, err
+		}
+		user.Credentials = append(user.Credentials, credential)
+	}
+
+	return user, rows.Err()
+}
+
+// deletePasskeys is used when the password is reset or changed, so a passkey added by whoever had the account
+// doesn't keep working after the user takes it back
+func deletePasskeys(userID int64) error {
+	_, err := db.Exec("DELETE FROM passkeys WHERE user_id = $1", userID)
+	return err
+}
+
+// updateUsedPasskey stores the new signature counter, so a copied key can be noticed
+func updateUsedPasskey(credential *webauthn.Credential) error {
+	credentialJSON, err := json.Marshal(credential)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("UPDATE passkeys SET credential = $1, last_used_at = $2 WHERE credential_id = $3",
+		string(credentialJSON), time.Now().UTC(), encodeCredentialID(credential.ID))
+	return err
+}
+
+// usePasskey checks a passkey given as the second factor, against the session started for the login challenge
+func usePasskey(userID int64, session string, response []byte) (bool, error) {
+	if session == "" {
+		return false, nil
+	}
+
+	user, err := getPasskeyUser(userID)
+	if err != nil {
+		return false, err
+	}
+
+	credential, err := passkey.FinishLogin(user, session, response)
+	if err != nil {
+		sugar.Debug(err)
+		return false, nil
+	}
+
+	return true, updateUsedPasskey(credential)
+}
+
+func GetPasskeys(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	rows, err := db.Query("SELECT id, name, created_at, last_used_at FROM passkeys WHERE user_id = $1 ORDER BY created_at", userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			sugar.Error(err)
+		}
+	}()
+
+	passkeys := []models.Passkey{}
+	for rows.Next() {
+		var key models.Passkey
+		var lastUsedAt sql.NullTime
+
+		err := rows.Scan(&key.ID, &key.Name, &key.CreatedAt, &lastUsedAt)
+		if err != nil {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		if lastUsedAt.Valid {
+			key.LastUsedAt = &lastUsedAt.Time
+		}
+		passkeys = append(passkeys, key)
+	}
+
+	if err := rows.Err(); err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(passkeys)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+// BeginPasskeyRegistration returns the options to pass to navigator.credentials.create().
+// a passkey logs in on its own, so adding one needs the password and the second factor, like turning that off
+func BeginPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	type Confirmation struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recoveryCode"`
+	}
+
+	var confirmation Confirmation
+	err := json.NewDecoder(r.Body).Decode(&confirmation)
+	if err != nil {
+		sugar.Debug(err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	correct, err := isCurrentPassword(userID, confirmation.Password)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if !correct {
+		http.Error(w, "wrong_password", http.StatusUnauthorized)
+		return
+	}
+
+	twoFactorEnabled, err := hasTwoFactor(userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if twoFactorEnabled {
+		ok, err := useSecondFactor(userID, confirmation.Code, confirmation.RecoveryCode)
+		if err != nil {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "wrong_code", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	user, err := getPasskeyUser(userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if len(user.Credentials) >= maxPasskeysPerUser {
+		http.Error(w, fmt.Sprintf("You can't have more than %d passkeys", maxPasskeysPerUser), http.StatusBadRequest)
+		return
+	}
+
+	creation, session, err := passkey.BeginRegistration(user)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = keyValue.Set(passkeyRegistrationKey(userID), session, passkeyCeremonyLifetime)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(creation)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+// FinishPasskeyRegistration takes what navigator.credentials.create() returned, and a name to tell the passkey apart
+func FinishPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	type Registration struct {
+		Name       string          `json:"name"`
+		Credential json.RawMessage `json:"credential"`
+	}
+
+	var registration Registration
+	err := json.NewDecoder(r.Body).Decode(&registration)
+	if err != nil {
+		sugar.Debug(err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	registration.Name = strings.TrimSpace(registration.Name)
+	if registration.Name == "" || len(registration.Name) > 64 {
+		http.Error(w, "Name must be between 1 and 64 characters", http.StatusBadRequest)
+		return
+	}
+
+	session, err := keyValue.GetDel(passkeyRegistrationKey(userID))
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if session == "" {
+		http.Error(w, "invalid_challenge", http.StatusBadRequest)
+		return
+	}
+
+	user, err := getPasskeyUser(userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	credential, err := passkey.FinishRegistration(user, session, registration.Credential)
+	if err != nil {
+		sugar.Debug(err)
+		http.Error(w, "invalid_passkey", http.StatusBadRequest)
+		return
+	}
+
+	credentialJSON, err := json.Marshal(credential)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	key := models.Passkey{
+		ID:        snowflakeNode.Generate().Int64(),
+		Name:      registration.Name,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO passkeys (id, user_id, credential_id, credential, name, created_at) VALUES($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (credential_id) DO NOTHING
+	`, key.ID, userID, encodeCredentialID(credential.ID), string(credentialJSON), key.Name, key.CreatedAt)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if affected == 0 {
+		http.Error(w, "passkey_registered", http.StatusConflict)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(key)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+func RenamePasskey(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	passkeyID, err := strconv.ParseInt(r.URL.Query().Get("passkeyID"), 10, 64)
+	if err != nil || passkeyID == 0 {
+		http.Error(w, "Invalid passkey ID", http.StatusBadRequest)
+		return
+	}
+
+	type Rename struct {
+		Name string `json:"name"`
+	}
+
+	var rename Rename
+	err = json.NewDecoder(r.Body).Decode(&rename)
+	if err != nil {
+		sugar.Debug(err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	rename.Name = strings.TrimSpace(rename.Name)
+	if rename.Name == "" || len(rename.Name) > 64 {
+		http.Error(w, "Name must be between 1 and 64 characters", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec("UPDATE passkeys SET name = $1 WHERE id = $2 AND user_id = $3", rename.Name, passkeyID, userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if affected == 0 {
+		http.Error(w, "Passkey not found", http.StatusNotFound)
+		return
+	}
+}
+
+// DeletePasskey needs the password, like turning off the other second factor
+func DeletePasskey(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	passkeyID, err := strconv.ParseInt(r.URL.Query().Get("passkeyID"), 10, 64)
+	if err != nil || passkeyID == 0 {
+		http.Error(w, "Invalid passkey ID", http.StatusBadRequest)
+		return
+	}
+
+	type Deletion struct {
+		Password string `json:"password"`
+	}
+
+	var deletion Deletion
+	err = json.NewDecoder(r.Body).Decode(&deletion)
+	if err != nil {
+		sugar.Debug(err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	correct, err := isCurrentPassword(userID, deletion.Password)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if !correct {
+		http.Error(w, "wrong_password", http.StatusUnauthorized)
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM passkeys WHERE id = $1 AND user_id = $2", passkeyID, userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if affected == 0 {
+		http.Error(w, "Passkey not found", http.StatusNotFound)
+		return
+	}
+}
+
+// BeginPasskeyLogin starts signing in without a password,
+// the options are passed to navigator.credentials.get() and the challenge is sent back with the result
+func BeginPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	assertion, session, err := passkey.BeginDiscoverableLogin()
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	token, err := uuid.NewRandom()
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = keyValue.Set(passkeyLoginKey(token.String()), session, passkeyCeremonyLifetime)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	type Login struct {
+		Challenge string `json:"challenge"`
+		Options   any    `json:"options"`
+	}
+
+	err = json.NewEncoder(w).Encode(Login{Challenge: token.String(), Options: assertion})
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+// FinishPasskeyLogin logs in with the passkey alone, the authenticator verified the user so no second factor is asked for
+func FinishPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	type Login struct {
+		Challenge  string          `json:"challenge"`
+		Credential json.RawMessage `json:"credential"`
+	}
+
+	var login Login
+	err := json.NewDecoder(r.Body).Decode(&login)
+	if err != nil {
+		sugar.Debug(err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	session, err := keyValue.GetDel(passkeyLoginKey(login.Challenge))
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if session == "" {
+		http.Error(w, "invalid_challenge", http.StatusUnauthorized)
+		return
+	}
+
+	// the library turns lookup errors into a failed login, database errors still have to be told apart
+	var lookupErr error
+	user, credential, err := passkey.FinishDiscoverableLogin(session, login.Credential, func(userID int64) (passkey.User, error) {
+		user, err := getPasskeyUser(userID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			lookupErr = err
+		}
+		return user, err
+	})
+	if lookupErr != nil {
+		sugar.Error(lookupErr)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		sugar.Debug(err)
+		http.Error(w, "invalid_passkey", http.StatusUnauthorized)
+		return
+	}
+
+	err = updateUsedPasskey(credential)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = startLogin(w, r, user.ID, r.URL.Query().Get("rememberMe") == "true")
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+// BeginPasskeySecondFactor returns the options for navigator.credentials.get() to complete a login challenge with,
+// the result is sent to CompleteLogin
+func BeginPasskeySecondFactor(w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		Challenge string `json:"challenge"`
+	}
+
+	var request Request
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		sugar.Debug(err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	key := loginChallengeKey(request.Challenge)
+
+	value, err := keyValue.Get(key)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if value == "" {
+		http.Error(w, "invalid_challenge", http.StatusUnauthorized)
+		return
+	}
+
+	var challenge loginChallenge
+	err = json.Unmarshal([]byte(value), &challenge)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	user, err := getPasskeyUser(challenge.UserID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if len(user.Credentials) == 0 {
+		http.Error(w, "no_passkeys", http.StatusBadRequest)
+		return
+	}
+
+	assertion, session, err := passkey.BeginLogin(user)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	// kept apart from the challenge, so asking again doesn't write it back with an outdated attempt count
+	err = keyValue.Set(loginChallengePasskeyKey(request.Challenge), session, loginChallengeLifetime)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(assertion)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
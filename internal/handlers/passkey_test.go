@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"chatapp-backend/internal/keyValue"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPasskeyRegistrationNeedsPassword(t *testing.T) {
+	setupTest(t)
+
+	w := serve(BeginPasskeyRegistration, testUser, `{"password": "wrong password"}`)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a wrong password to be refused, got %d", w.Code)
+	}
+
+	// the second factor is asked for too once it's turned on
+	exec(t, "INSERT INTO two_factor (user_id, secret, enabled, created_at) VALUES($1, 'secret', TRUE, $2)", testUser, time.Now().UTC())
+
+	w = serve(BeginPasskeyRegistration, testUser, fmt.Sprintf(`{"password": %q}`, testPassword))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a missing code to be refused, got %d", w.Code)
+	}
+}
+
+func TestPasswordResetDeletesPasskeys(t *testing.T) {
+	setupTest(t)
+	addPasskey(t, 1)
+	addPasskey(t, 2)
+
+	err := keyValue.Set(passwordResetKey("token"), fmt.Sprintf(`{"userID": %d}`, testUser), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(ResetPassword, 0, `{"token": "token", "password": "New password 123", "confirmPassword": "New password 123"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("reset failed with %d: %s", w.Code, w.Body.String())
+	}
+
+	if count(t, "SELECT COUNT(*) FROM passkeys WHERE user_id = $1", testUser) != 0 {
+		t.Error("passkeys should be deleted after a password reset")
+	}
+}
+
+func TestPasswordChangeDeletesPasskeys(t *testing.T) {
+	setupTest(t)
+	addPasskey(t, 1)
+
+	w := serve(ChangePassword, testUser, fmt.Sprintf(`{"currentPassword": %q, "password": "New password 123", "confirmPassword": "New password 123"}`, testPassword))
+	if w.Code != http.StatusOK {
+		t.Fatalf("change failed with %d: %s", w.Code, w.Body.String())
+	}
+
+	if count(t, "SELECT COUNT(*) FROM passkeys WHERE user_id = $1", testUser) != 0 {
+		t.Error("passkeys should be deleted after a password change")
+	}
+}
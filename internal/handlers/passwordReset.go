@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	"chatapp-backend/internal/email"
+	"chatapp-backend/internal/keyValue"
+	"chatapp-backend/internal/validator"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const passwordResetLifetime = 30 * time.Minute
+
+// resets asked for the same email within the window, on top of the limit per IP
+const (
+	passwordResetsPerEmail   = 3
+	passwordResetEmailWindow = 15 * time.Minute
+)
+
+func passwordResetKey(token string) string {
+	return fmt.Sprintf("password_reset:%s", token)
+}
+
+func passwordResetRequestsKey(emailAddress string) string {
+	return fmt.Sprintf("password_reset_requests:%s", strings.ToLower(emailAddress))
+}
+
+type passwordReset struct {
+	UserID int64 `json:"userID"`
+}
+
+// getPasswordUserByEmail returns the account with the email that can sign in with a password,
+// false if there is none, bots and webhooks have no password
+func getPasswordUserByEmail(emailAddress string) (int64, string, bool, error) {
+	var userID int64
+	var username string
+	err := db.QueryRow(`
+		SELECT id, username FROM users
+		WHERE email = $1 AND NOT EXISTS(SELECT 1 FROM bots WHERE bots.id = users.id) AND NOT EXISTS(SELECT 1 FROM webhooks WHERE webhooks.id = users.id)
+	`, emailAddress).Scan(&userID, &username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, "", false, nil
+	}
+	return userID, username, err == nil, err
+}
+
+// allowPasswordReset counts the request for the email like allowMagicLink, whether there is such an account or not
+func allowPasswordReset(emailAddress string) (bool, error) {
+	count, err := keyValue.Incr(passwordResetRequestsKey(emailAddress), passwordResetEmailWindow)
+	if err != nil {
+		return false, err
+	}
+	return count <= passwordResetsPerEmail, nil
+}
+
+// sendPasswordReset does nothing if there is no such account
+func sendPasswordReset(emailAddress string) error {
+	userID, username, found, err := getPasswordUserByEmail(emailAddress)
+	if err != nil || !found {
+		return err
+	}
+
+	token, err := uuid.NewRandom()
+	if err != nil {
+		return err
+	}
+
+	bytes, err := json.Marshal(passwordReset{UserID: userID})
+	if err != nil {
+		return err
+	}
+
+	err = keyValue.Set(passwordResetKey(token.String()), string(bytes), passwordResetLifetime)
+	if err != nil {
+		return err
+	}
+
+	return email.SendPasswordReset(emailAddress, username, token.String())
+}
+
+// RequestPasswordReset answers the same whether the email belongs to an account or not,
+// the email is sent in the background so the response time doesn't tell either
+func RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	type ResetRequest struct {
+		Email string `json:"email"`
+	}
+
+	var resetRequest ResetRequest
+	err := json.NewDecoder(r.Body).Decode(&resetRequest)
+	if err != nil {
+		sugar.Debug(err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	err = validator.Email(resetRequest.Email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	allowed, err := allowPasswordReset(resetRequest.Email)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, "too_many_requests", http.StatusTooManyRequests)
+		return
+	}
+
+	go func() {
+		err := sendPasswordReset(resetRequest.Email)
+		if err != nil {
+			sugar.Error(err)
+		}
+	}()
+
+	_, err = fmt.Fprintf(w, "reset_email_sent")
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+// ResetPassword sets the new password, logs the user out everywhere and deletes the passkeys, the token can only be used once
+func ResetPassword(w http.ResponseWriter, r *http.Request) {
+	type Reset struct {
+		Token           string `json:"token"`
+		Password        string `json:"password"`
+		ConfirmPassword string `json:"confirmPassword"`
+	}
+
+	var reset Reset
+	err := json.NewDecoder(r.Body).Decode(&reset)
+	if err != nil {
+		sugar.Debug(err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	// checked before the token is used up, so a bad password can be retried
+	if reset.Password != reset.ConfirmPassword {
+		http.Error(w, "passwords_dont_match", http.StatusBadRequest)
+		return
+	}
+
+	err = validator.Password(reset.Password)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	value, err := keyValue.GetDel(passwordResetKey(reset.Token))
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if value == "" {
+		http.Error(w, "Token isn't valid", http.StatusUnauthorized)
+		return
+	}
+
+	var pending passwordReset
+	err = json.Unmarshal([]byte(value), &pending)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	passwordBytes, err := bcrypt.GenerateFromPassword([]byte(reset.Password), 12)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = db.Exec("UPDATE users SET password = $1 WHERE id = $2", passwordBytes, pending.UserID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = revokeAllTokens(pending.UserID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = revokeApiKeys(pending.UserID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = deletePasskeys(pending.UserID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
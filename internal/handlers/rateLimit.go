@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/httprate"
+)
+
+// rateLimitKey gives every bot its own bucket instead of sharing the one of its IP address,
+// as many bots are often hosted on the same machine.
+// a bot only gets its bucket behind UserVerifier, limiters in front of it don't look at the token,
+// so requests with made up tokens can't make a database query each before being limited
+func rateLimitKey(r *http.Request) (string, error) {
+	ipKey, err := httprate.KeyByIP(r)
+	if err != nil {
+		return "", err
+	}
+
+	info, authenticated := r.Context().Value(AuthInfoKeyType{}).(authInfo)
+	if authenticated && info.isBot() {
+		return fmt.Sprintf("bot:%d", info.userID), nil
+	}
+
+	return ipKey, nil
+}
+
+// rateLimit limits requests per IP address, or per bot for bots
+func rateLimit(requestLimit int, windowLength time.Duration) func(next http.Handler) http.Handler {
+	return httprate.Limit(requestLimit, windowLength, httprate.WithKeyFuncs(rateLimitKey))
+}
+
+// requests allowed per IP address, bot or webhook within the window, on top of the limits of the routes
+const (
+	globalRequestLimit = 100
+	globalWindow       = time.Minute
+)
+
+// globalLimiter is in front of every route when rate limiting is turned on, nil otherwise
+var globalLimiter *httprate.RateLimiter
+
+type globalChargeKeyType struct{}
+
+// globalCharge is what the global limiter took from the IP address of the request
+type globalCharge struct {
+	ipKey   string
+	window  time.Time
+	claimed bool
+}
+
+// globalRateLimit charges every request to its IP address, bots and webhooks move theirs to their own bucket
+// with claimRateLimit once they are verified, so the ones hosted on the same machine don't share one bucket
+func globalRateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ipKey, err := httprate.KeyByIP(r)
+		if err != nil {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		charge := &globalCharge{ipKey: ipKey, window: time.Now().UTC().Truncate(globalWindow)}
+		if globalLimiter.RespondOnLimit(w, r, ipKey) {
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), globalChargeKeyType{}, charge)))
+	})
+}
+
+// claimRateLimit gives the request back to the IP address and charges it to the given key instead,
+// returns true if that key is over the limit, in which case the response is already written.
+// it must only be called once whoever the key belongs to is verified, later calls for the same request do nothing
+func claimRateLimit(w http.ResponseWriter, r *http.Request, key string) bool {
+	charge, ok := r.Context().Value(globalChargeKeyType{}).(*globalCharge)
+	if !ok || charge.claimed {
+		return false
+	}
+	charge.claimed = true
+
+	// a request from the previous window isn't given back, the counter has moved on since
+	if charge.window.Equal(time.Now().UTC().Truncate(globalWindow)) {
+		err := globalLimiter.Counter().IncrementBy(charge.ipKey, charge.window, -1)
+		if err != nil {
+			sugar.Error(err)
+		}
+	}
+
+	return globalLimiter.RespondOnLimit(w, r, key)
+}
@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/httprate"
+	"go.uber.org/zap"
+)
+
+func TestGlobalRateLimitClaims(t *testing.T) {
+	sugar = zap.NewNop().Sugar()
+	globalLimiter = httprate.NewRateLimiter(2, time.Minute)
+	t.Cleanup(func() { globalLimiter = nil })
+
+	// stands in for UserVerifier, which claims the request for the bot once its token is verified
+	handler := globalRateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if bot := r.Header.Get("Bot"); bot != "" && claimRateLimit(w, r, "bot:"+bot) {
+			return
+		}
+	}))
+
+	send := func(bot string) int {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		if bot != "" {
+			r.Header.Set("Bot", bot)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// bots on the same machine each have their own bucket, and don't use up the one of the IP address
+	for _, bot := range []string{"1", "1", "2", "2"} {
+		if code := send(bot); code != http.StatusOK {
+			t.Fatalf("request of bot [%s] was refused with %d", bot, code)
+		}
+	}
+	if code := send("1"); code != http.StatusTooManyRequests {
+		t.Errorf("expected the bucket of the bot to be used up, got %d", code)
+	}
+
+	for range 2 {
+		if code := send(""); code != http.StatusOK {
+			t.Fatalf("request without a bot was refused with %d", code)
+		}
+	}
+	if code := send(""); code != http.StatusTooManyRequests {
+		t.Errorf("expected the bucket of the IP address to be used up, got %d", code)
+	}
+}
@@ -0,0 +1,452 @@
+package handlers
+
+import (
+	"chatapp-backend/internal/hub"
+	"chatapp-backend/internal/models"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// every relationship has a row for each side, so a friend request is outgoing for the sender and incoming for the other user,
+// a block only has the row of the user who blocked, the blocked user just loses whatever they had
+
+const (
+	relationshipFriend   = "friend"
+	relationshipIncoming = "incoming"
+	relationshipOutgoing = "outgoing"
+	relationshipBlocked  = "blocked"
+)
+
+func getRelationshipType(userID int64, otherUserID int64) (string, error) {
+	var relationshipType string
+	err := db.QueryRow("SELECT type FROM relationships WHERE user_id = $1 AND other_user_id = $2", userID, otherUserID).Scan(&relationshipType)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return relationshipType, err
+}
+
+// isBlocked reports if either of the users blocked the other one
+func isBlocked(userID int64, otherUserID int64) (bool, error) {
+	var blocked bool
+	err := db.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM relationships
+			WHERE ((user_id = $1 AND other_user_id = $2) OR (user_id = $2 AND other_user_id = $1)) AND type = $3
+		)
+	`, userID, otherUserID, relationshipBlocked).Scan(&blocked)
+	return blocked, err
+}
+
+// usersBlocking returns the users who blocked the user
+func usersBlocking(userID int64) ([]int64, error) {
+	rows, err := db.Query("SELECT user_id FROM relationships WHERE other_user_id = $1 AND type = $2", userID, relationshipBlocked)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			sugar.Error(err)
+		}
+	}()
+
+	var userIDs []int64
+	for rows.Next() {
+		var blockerID int64
+		err := rows.Scan(&blockerID)
+		if err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, blockerID)
+	}
+
+	return userIDs, rows.Err()
+}
+
+// isBlockedInDirectChannel reports if the user and the other member of a 1:1 direct channel blocked one another,
+// groups aren't affected, blocked members' messages are only collapsed there
+func isBlockedInDirectChannel(channelID int64, userID int64) (bool, error) {
+	var blocked bool
+	err := db.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1
+			FROM
+				dm_channels
+			JOIN
+				dm_members ON dm_members.channel_id = dm_channels.id AND dm_members.user_id != $1
+			JOIN
+				relationships ON relationships.type = $2 AND (
+					(relationships.user_id = $1 AND relationships.other_user_id = dm_members.user_id) OR
+					(relationships.user_id = dm_members.user_id AND relationships.other_user_id = $1)
+				)
+			WHERE
+				dm_channels.id = $3 AND dm_channels.is_group = FALSE
+		)
+	`, userID, relationshipBlocked, channelID).Scan(&blocked)
+	return blocked, err
+}
+
+// setRelationships writes both sides of a relationship at once, an empty type removes that side.
+// returns which of the two sides actually changed
+func setRelationships(userID int64, userType string, otherUserID int64, otherType string) ([2]bool, error) {
+	var changed [2]bool
+	now := time.Now().UTC()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return changed, err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			sugar.Error(err)
+		}
+	}()
+
+	sides := []struct {
+		userID           int64
+		otherUserID      int64
+		relationshipType string
+	}{
+		{userID, otherUserID, userType},
+		{otherUserID, userID, otherType},
+	}
+
+	for i, side := range sides {
+		var result sql.Result
+		if side.relationshipType == "" {
+			result, err = tx.Exec("DELETE FROM relationships WHERE user_id = $1 AND other_user_id = $2", side.userID, side.otherUserID)
+		} else {
+			result, err = tx.Exec(`
+				INSERT INTO relationships (user_id, other_user_id, type, since) VALUES($1, $2, $3, $4)
+				ON CONFLICT (user_id, other_user_id) DO UPDATE SET type = excluded.type, since = excluded.since
+				WHERE relationships.type != excluded.type
+			`, side.userID, side.otherUserID, side.relationshipType, now)
+		}
+		if err != nil {
+			return changed, err
+		}
+
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return changed, err
+		}
+		changed[i] = affected != 0
+	}
+
+	return changed, tx.Commit()
+}
+
+// emitRelationship tells the user's sessions how they now relate to the other user
+func emitRelationship(userID int64, otherUserID int64) error {
+	var relationship models.Relationship
+	err := db.QueryRow(`
+		SELECT
+			users.id,
+			users.display_name,
+			users.picture,
+			EXISTS(SELECT 1 FROM bots WHERE bots.id = users.id),
+			relationships.type,
+			relationships.since
+		FROM
+			relationships
+		JOIN
+			users ON users.id = relationships.other_user_id
+		WHERE
+			relationships.user_id = $1 AND relationships.other_user_id = $2
+	`, userID, otherUserID).Scan(&relationship.User.ID, &relationship.User.DisplayName, &relationship.User.Picture, &relationship.User.Bot, &relationship.Type, &relationship.Since)
+	if errors.Is(err, sql.ErrNoRows) {
+		return hub.EmitToUser(hub.RelationshipRemoved, otherUserID, userID)
+	}
+	if err != nil {
+		return err
+	}
+
+	return hub.EmitToUser(hub.RelationshipModified, relationship, userID)
+}
+
+// changeRelationship writes the relationship and pushes it to the users whose side changed,
+// so blocking someone who had nothing to do with the user doesn't tell them anything
+func changeRelationship(w http.ResponseWriter, userID int64, userType string, otherUserID int64, otherType string) {
+	changed, err := setRelationships(userID, userType, otherUserID, otherType)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	for i, pair := range [][2]int64{{userID, otherUserID}, {otherUserID, userID}} {
+		if !changed[i] {
+			continue
+		}
+
+		err = emitRelationship(pair[0], pair[1])
+		if err != nil {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// getOtherUser reads the userID parameter and makes sure it's someone else who can have relationships,
+// writes the error response itself if not
+func getOtherUser(w http.ResponseWriter, r *http.Request, userID int64) (int64, bool) {
+	otherUserID, err := strconv.ParseInt(r.URL.Query().Get("userID"), 10, 64)
+	if err != nil || otherUserID == 0 {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return 0, false
+	}
+	if otherUserID == userID {
+		http.Error(w, "You can't do this to yourself", http.StatusBadRequest)
+		return 0, false
+	}
+
+	exists, err := canBeMessaged(otherUserID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return 0, false
+	}
+	if !exists {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return 0, false
+	}
+
+	return otherUserID, true
+}
+
+func GetRelationships(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	rows, err := db.Query(`
+		SELECT
+			users.id,
+			users.display_name,
+			users.picture,
+			EXISTS(SELECT 1 FROM bots WHERE bots.id = users.id),
+			relationships.type,
+			relationships.since
+		FROM
+			relationships
+		JOIN
+			users ON users.id = relationships.other_user_id
+		WHERE
+			relationships.user_id = $1
+		ORDER BY
+			relationships.since DESC
+	`, userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			sugar.Error(err)
+		}
+	}()
+
+	relationships := []models.Relationship{}
+	for rows.Next() {
+		var relationship models.Relationship
+		err := rows.Scan(&relationship.User.ID, &relationship.User.DisplayName, &relationship.User.Picture, &relationship.User.Bot, &relationship.Type, &relationship.Since)
+		if err != nil {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		relationships = append(relationships, relationship)
+	}
+
+	if err := rows.Err(); err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(relationships)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+// SendFriendRequest sends a friend request, or accepts it if the other user already sent one
+func SendFriendRequest(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	otherUserID, ok := getOtherUser(w, r, userID)
+	if !ok {
+		return
+	}
+
+	relationshipType, err := getRelationshipType(userID, otherUserID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	switch relationshipType {
+	case relationshipFriend:
+		http.Error(w, "You are already friends", http.StatusConflict)
+		return
+	case relationshipOutgoing:
+		http.Error(w, "Friend request was already sent", http.StatusConflict)
+		return
+	case relationshipBlocked:
+		http.Error(w, "You have blocked this user", http.StatusForbidden)
+		return
+	case relationshipIncoming:
+		changeRelationship(w, userID, relationshipFriend, otherUserID, relationshipFriend)
+		return
+	}
+
+	// the same answer as a user who can't be found, so blocking isn't revealed
+	otherType, err := getRelationshipType(otherUserID, userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if otherType == relationshipBlocked {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	changeRelationship(w, userID, relationshipOutgoing, otherUserID, relationshipIncoming)
+}
+
+func AcceptFriendRequest(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	otherUserID, ok := getOtherUser(w, r, userID)
+	if !ok {
+		return
+	}
+
+	relationshipType, err := getRelationshipType(userID, otherUserID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if relationshipType != relationshipIncoming {
+		http.Error(w, "No friend request from this user", http.StatusNotFound)
+		return
+	}
+
+	changeRelationship(w, userID, relationshipFriend, otherUserID, relationshipFriend)
+}
+
+// DeclineFriendRequest declines an incoming friend request, or cancels an outgoing one
+func DeclineFriendRequest(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	otherUserID, ok := getOtherUser(w, r, userID)
+	if !ok {
+		return
+	}
+
+	relationshipType, err := getRelationshipType(userID, otherUserID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if relationshipType != relationshipIncoming && relationshipType != relationshipOutgoing {
+		http.Error(w, "No friend request with this user", http.StatusNotFound)
+		return
+	}
+
+	changeRelationship(w, userID, "", otherUserID, "")
+}
+
+func RemoveFriend(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	otherUserID, ok := getOtherUser(w, r, userID)
+	if !ok {
+		return
+	}
+
+	relationshipType, err := getRelationshipType(userID, otherUserID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if relationshipType != relationshipFriend {
+		http.Error(w, "You are not friends with this user", http.StatusNotFound)
+		return
+	}
+
+	changeRelationship(w, userID, "", otherUserID, "")
+}
+
+// BlockUser ends any friendship or friend request with the user,
+// if the other user blocked this one too, their block stays
+func BlockUser(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	otherUserID, ok := getOtherUser(w, r, userID)
+	if !ok {
+		return
+	}
+
+	otherType, err := getRelationshipType(otherUserID, userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if otherType != relationshipBlocked {
+		otherType = ""
+	}
+
+	changeRelationship(w, userID, relationshipBlocked, otherUserID, otherType)
+}
+
+func UnblockUser(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	otherUserID, ok := getOtherUser(w, r, userID)
+	if !ok {
+		return
+	}
+
+	relationshipType, err := getRelationshipType(userID, otherUserID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if relationshipType != relationshipBlocked {
+		http.Error(w, "You haven't blocked this user", http.StatusNotFound)
+		return
+	}
+
+	otherType, err := getRelationshipType(otherUserID, userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	changeRelationship(w, userID, "", otherUserID, otherType)
+}
@@ -51,6 +51,13 @@ func CreateServer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err = hub.EmitToUser(hub.ServerJoined, server, userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
 	err = json.NewEncoder(w).Encode(server)
 	if err != nil {
 		sugar.Error(err)
@@ -168,3 +175,65 @@ func RenameServer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+func LeaveServer(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	serverID, err := strconv.ParseInt(r.URL.Query().Get("serverID"), 10, 64)
+	if err != nil || serverID == 0 {
+		http.Error(w, "Invalid server ID", http.StatusBadRequest)
+		return
+	}
+
+	ownsServer, err := isServerOwner(userID, serverID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if ownsServer {
+		http.Error(w, "Owner can't leave their own server", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM server_members WHERE server_id = $1 AND user_id = $2", serverID, userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if affected == 0 {
+		http.Error(w, "You are not member of given server", http.StatusBadRequest)
+		return
+	}
+
+	// commands of a bot that left would keep their names taken from the bots still in the server
+	_, err = db.Exec("DELETE FROM bot_commands WHERE server_id = $1 AND bot_id = $2", serverID, userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = hub.EmitToUser(hub.ServerRemoved, serverID, userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = emitMemberEvent(hub.MemberLeft, serverID, userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
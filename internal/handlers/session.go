@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"chatapp-backend/internal/hub"
+	"chatapp-backend/internal/keyValue"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sessions live at most as long as the longest lived login
+const sessionLifetime = time.Hour * 24 * 7 * 4
+
+func sessionKey(sessionID int64) string {
+	return fmt.Sprintf("session:%d", sessionID)
+}
+
+// createSession stores the session bound to the user, and returns the token given to the client,
+// which is the session ID and a random secret, only the hash of the secret is stored
+func createSession(userID int64) (int64, string, error) {
+	sessionID := snowflakeNode.Generate().Int64()
+
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return 0, "", err
+	}
+
+	hash := sha256.Sum256(secret)
+
+	err = keyValue.Set(sessionKey(sessionID), fmt.Sprintf("%d:%s", userID, hex.EncodeToString(hash[:])), sessionLifetime)
+	if err != nil {
+		return 0, "", err
+	}
+
+	token := fmt.Sprintf("%d.%s", sessionID, base64.RawURLEncoding.EncodeToString(secret))
+	return sessionID, token, nil
+}
+
+// parseSecretToken splits tokens in the format of "<ID>.<base64 secret>", used by sessions and API keys
+func parseSecretToken(token string) (int64, []byte, error) {
+	idStr, secretStr, found := strings.Cut(token, ".")
+	if !found {
+		return 0, nil, fmt.Errorf("token has no secret")
+	}
+
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	secret, err := base64.RawURLEncoding.DecodeString(secretStr)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return id, secret, nil
+}
+
+// getSessionOwner returns the user ID the session belongs to,
+// or 0 if the session doesn't exist or the secret doesn't match
+func getSessionOwner(sessionID int64, secret []byte) (int64, error) {
+	value, err := keyValue.Get(sessionKey(sessionID))
+	if err != nil {
+		return 0, err
+	}
+	if value == "" {
+		return 0, nil
+	}
+
+	userIDStr, storedHash, found := strings.Cut(value, ":")
+	if !found {
+		return 0, fmt.Errorf("session ID [%d] has malformed value [%s]", sessionID, value)
+	}
+
+	hash := sha256.Sum256(secret)
+	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(hash[:])), []byte(storedHash)) != 1 {
+		return 0, nil
+	}
+
+	return strconv.ParseInt(userIDStr, 10, 64)
+}
+
+// endSession invalidates the session and closes its connection
+func endSession(sessionID int64) error {
+	err := keyValue.Del(sessionKey(sessionID))
+	if err != nil {
+		return err
+	}
+
+	return hub.DisconnectSession(sessionID)
+}
+
+func deleteCookie(w http.ResponseWriter, name string, path string) {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    "",
+		Path:     path,
+		Expires:  time.Unix(0, 0),
+		HttpOnly: true,
+	}
+
+	http.SetCookie(w, cookie)
+}
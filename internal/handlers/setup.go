@@ -2,10 +2,12 @@ package handlers
 
 import (
 	"chatapp-backend/internal/models"
+	"context"
 	"database/sql"
 	"fmt"
 	"mime"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/bwmarrin/snowflake"
@@ -19,6 +21,13 @@ var sugar *zap.SugaredLogger
 var db *sql.DB
 var isHttps bool
 var snowflakeNode *snowflake.Node
+var baseURL string
+
+// server is set by Setup and read by Shutdown from the goroutine handling the termination signal,
+// shuttingDown stops Setup from serving if the signal arrived while it was still starting
+var server *http.Server
+var serverMutex sync.Mutex
+var shuttingDown bool
 
 func Setup(_isHttps bool, cfg *models.ConfigFile, _sugar *zap.SugaredLogger, _db *sql.DB, _snowflakeNode *snowflake.Node) error {
 	isHttps = _isHttps
@@ -26,6 +35,12 @@ func Setup(_isHttps bool, cfg *models.ConfigFile, _sugar *zap.SugaredLogger, _db
 	db = _db
 	snowflakeNode = _snowflakeNode
 
+	if isHttps {
+		baseURL = fmt.Sprintf("https://%s:%s", cfg.HostAddress, cfg.HostPort)
+	} else {
+		baseURL = fmt.Sprintf("http://%s:%s", cfg.HostAddress, cfg.HostPort)
+	}
+
 	// this fixes problem serving flutter web wasm,
 	// as by default it sends .mjs as text/plain
 	err := mime.AddExtensionType(".mjs", "application/javascript")
@@ -36,7 +51,8 @@ func Setup(_isHttps bool, cfg *models.ConfigFile, _sugar *zap.SugaredLogger, _db
 	r := chi.NewRouter()
 
 	if cfg.RateLimiting {
-		r.Use(httprate.LimitByIP(100, time.Minute))
+		globalLimiter = httprate.NewRateLimiter(globalRequestLimit, globalWindow)
+		r.Use(globalRateLimit)
 	}
 
 	if cfg.Cors {
@@ -52,56 +68,199 @@ func Setup(_isHttps bool, cfg *models.ConfigFile, _sugar *zap.SugaredLogger, _db
 	r.Use(middleware.Recoverer)
 	//r.Use(middleware.Compress(5))
 
-	r.Use(middleware.Timeout(60 * time.Second))
-
 	r.Route("/api", func(api chi.Router) {
+		api.Use(middleware.Timeout(60 * time.Second))
+
 		api.Get("/test", Test)
 
 		api.Route("/auth", func(r chi.Router) {
 			r.Group(func(r chi.Router) {
-				r.Use(httprate.LimitByIP(5, time.Minute))
+				r.Use(rateLimit(5, time.Minute))
 				r.Post("/login", Login)
 				r.Post("/register", Register)
 			})
-			r.With(UserVerifier).Get("/newSession", NewSession)
+			r.Group(func(r chi.Router) {
+				r.Use(rateLimit(5, time.Minute))
+				r.Post("/requestPasswordReset", RequestPasswordReset)
+				r.Post("/resetPassword", ResetPassword)
+			})
+			r.Group(func(r chi.Router) {
+				r.Use(rateLimit(5, time.Minute))
+				r.Post("/requestMagicLink", RequestMagicLink)
+				r.Post("/magicLinkLogin", MagicLinkLogin)
+			})
+			r.With(rateLimit(10, time.Minute)).Post("/completeLogin", CompleteLogin)
+			r.Route("/passkey", func(r chi.Router) {
+				r.Use(rateLimit(10, time.Minute))
+				r.Post("/beginLogin", BeginPasskeyLogin)
+				r.Post("/finishLogin", FinishPasskeyLogin)
+				r.Post("/beginSecondFactor", BeginPasskeySecondFactor)
+			})
+			r.With(UserVerifier, RequireScope(ScopeRealtime)).Get("/newSession", NewSession)
+			r.Post("/refresh", RefreshToken)
+			r.With(UserVerifier, RequireLogin).Post("/logout", Logout)
+			r.With(UserVerifier, RequireLogin).Post("/logoutEverywhere", LogoutEverywhere)
 			r.With(UserVerifier).Get("/isLoggedIn", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
 		})
 
+		api.Route("/account", func(r chi.Router) {
+			r.Use(UserVerifier, RequireLogin, rateLimit(5, time.Minute))
+			r.Post("/changePassword", ChangePassword)
+			r.Post("/changeEmail", ChangeEmail)
+			r.Post("/delete", DeleteAccount)
+		})
+
+		api.Route("/twoFactor", func(r chi.Router) {
+			r.Use(UserVerifier, RequireLogin)
+			r.Get("/fetch", GetTwoFactor)
+			r.Group(func(r chi.Router) {
+				r.Use(rateLimit(10, time.Minute))
+				r.Post("/enroll", EnrollTOTP)
+				r.Post("/activate", ActivateTOTP)
+				r.Post("/disable", DisableTOTP)
+				r.Post("/regenerateRecoveryCodes", RegenerateRecoveryCodes)
+			})
+		})
+
+		api.Route("/passkey", func(r chi.Router) {
+			r.Use(UserVerifier, RequireLogin)
+			r.Get("/fetch", GetPasskeys)
+			r.Group(func(r chi.Router) {
+				r.Use(rateLimit(10, time.Minute))
+				r.Post("/beginRegistration", BeginPasskeyRegistration)
+				r.Post("/finishRegistration", FinishPasskeyRegistration)
+				r.Post("/rename", RenamePasskey)
+				r.Post("/delete", DeletePasskey)
+			})
+		})
+
+		api.Route("/loginSession", func(r chi.Router) {
+			r.Use(UserVerifier, RequireLogin)
+			r.Get("/fetch", GetLoginSessions)
+			r.Group(func(r chi.Router) {
+				r.Use(rateLimit(10, time.Minute))
+				r.Post("/revoke", RevokeLoginSession)
+				r.Post("/revokeOthers", RevokeOtherLoginSessions)
+			})
+		})
+
+		api.Route("/apiKey", func(r chi.Router) {
+			r.Use(UserVerifier, RequireLogin)
+			r.Get("/fetch", GetApiKeys)
+			r.Group(func(r chi.Router) {
+				r.Use(rateLimit(10, time.Minute))
+				r.Post("/create", CreateApiKey)
+				r.Post("/revoke", RevokeApiKey)
+			})
+		})
+
+		api.Route("/bot", func(r chi.Router) {
+			r.Use(UserVerifier, RequireLogin)
+			r.Get("/fetch", GetBots)
+			r.Get("/authorize", GetBotAuthorization)
+			r.Group(func(r chi.Router) {
+				r.Use(rateLimit(10, time.Minute))
+				r.Post("/create", CreateBot)
+				r.Post("/regenerateToken", RegenerateBotToken)
+				r.Post("/delete", DeleteBot)
+				r.Post("/authorize", AuthorizeBot)
+			})
+		})
+
+		api.Route("/webhook", func(r chi.Router) {
+			// limited by ExecuteWebhook itself, as it can only tell webhooks apart once the token is checked
+			r.Post("/execute/{webhookID}/{token}", ExecuteWebhook)
+			r.Group(func(r chi.Router) {
+				r.Use(UserVerifier, ScopeVerifier("channel"))
+				r.Get("/fetch", GetWebhooks)
+				r.Group(func(r chi.Router) {
+					r.Use(rateLimit(10, time.Minute))
+					r.Post("/create", CreateWebhook)
+					r.Post("/regenerate", RegenerateWebhook)
+					r.Post("/delete", DeleteWebhook)
+				})
+			})
+		})
+
+		api.Route("/outgoingWebhook", func(r chi.Router) {
+			r.Use(UserVerifier, ScopeVerifier("server"))
+			r.Get("/fetch", GetOutgoingWebhooks)
+			r.Get("/deliveries", GetOutgoingWebhookDeliveries)
+			r.Group(func(r chi.Router) {
+				r.Use(rateLimit(10, time.Minute))
+				r.Post("/create", CreateOutgoingWebhook)
+				r.Post("/enable", EnableOutgoingWebhook)
+				r.Post("/regenerateSecret", RegenerateOutgoingWebhookSecret)
+				r.Post("/delete", DeleteOutgoingWebhook)
+			})
+		})
+
 		api.Route("/user", func(r chi.Router) {
-			r.Use(UserVerifier)
+			r.Use(UserVerifier, ScopeVerifier("user"))
 			r.Group(func(r chi.Router) {
-				r.Use(httprate.LimitByIP(10, time.Minute))
+				r.Use(rateLimit(10, time.Minute))
 				r.Post("/update", UpdateUserInfo)
+				r.Post("/changeUsername", ChangeUsername)
 			})
 			r.Get("/fetch", GetUserInfo)
+			r.Get("/fetchByUsername", GetUserByUsername)
+		})
+
+		api.Route("/relationship", func(r chi.Router) {
+			r.Use(UserVerifier, ScopeVerifier("user"))
+			r.Get("/fetch", GetRelationships)
+			r.Group(func(r chi.Router) {
+				r.Use(rateLimit(10, time.Minute))
+				r.Post("/request", SendFriendRequest)
+				r.Post("/accept", AcceptFriendRequest)
+				r.Post("/decline", DeclineFriendRequest)
+				r.Post("/remove", RemoveFriend)
+				r.Post("/block", BlockUser)
+				r.Post("/unblock", UnblockUser)
+			})
 		})
 
 		api.Route("/server", func(r chi.Router) {
-			r.Use(UserVerifier)
+			r.Use(UserVerifier, ScopeVerifier("server"))
 			r.Group(func(r chi.Router) {
-				r.Use(httprate.LimitByIP(10, time.Minute))
+				r.Use(rateLimit(10, time.Minute))
 				r.Post("/create", CreateServer)
 				r.Post("/delete", DeleteServer)
 				r.Post("/rename", RenameServer)
+				r.Post("/leave", LeaveServer)
 			})
 			r.With(SessionVerifier).Get("/fetch", GetServerList)
 		})
 
 		api.Route("/channel", func(r chi.Router) {
-			r.Use(UserVerifier)
+			r.Use(UserVerifier, ScopeVerifier("channel"))
 			r.Group(func(r chi.Router) {
-				r.Use(httprate.LimitByIP(10, time.Second*10))
+				r.Use(rateLimit(10, time.Second*10))
 				r.Post("/create", CreateChannel)
 				r.Post("/delete", nil)
 				r.Post("/rename", nil)
 			})
 			r.With(SessionVerifier).Get("/fetch", GetChannelList)
+			r.With(SessionVerifier).Post("/subscribe", SubscribeChannel)
+			r.With(SessionVerifier).Post("/unsubscribe", UnsubscribeChannel)
+		})
+
+		api.Route("/directChannel", func(r chi.Router) {
+			r.Use(UserVerifier, ScopeVerifier("channel"))
+			r.Get("/fetch", GetDirectChannels)
+			r.Group(func(r chi.Router) {
+				r.Use(rateLimit(10, time.Minute))
+				r.Post("/create", CreateDirectChannel)
+				r.Post("/createGroup", CreateGroupDirectChannel)
+				r.Post("/addMember", AddGroupMember)
+				r.Post("/leave", LeaveGroup)
+			})
 		})
 
 		api.Route("/message", func(r chi.Router) {
-			r.Use(UserVerifier)
+			r.Use(UserVerifier, ScopeVerifier("message"))
 			r.Group(func(r chi.Router) {
-				r.Use(httprate.LimitByIP(10, time.Second*10))
+				r.Use(rateLimit(10, time.Second*10))
 				r.Post("/create", CreateMessage)
 				r.Post("/delete", DeleteMessage)
 				r.Post("/edit", nil)
@@ -109,13 +268,33 @@ func Setup(_isHttps bool, cfg *models.ConfigFile, _sugar *zap.SugaredLogger, _db
 			r.With(SessionVerifier).Get("/fetch", GetMessageList)
 		})
 
-		api.Route("/members", func(r chi.Router) {
+		api.Route("/command", func(r chi.Router) {
 			r.Use(UserVerifier)
+			r.With(ScopeVerifier("channel")).Get("/fetch", GetChannelCommands)
+			r.Group(func(r chi.Router) {
+				r.Use(RequireBot)
+				r.Get("/fetchOwn", GetOwnCommands)
+				r.Group(func(r chi.Router) {
+					r.Use(rateLimit(30, time.Minute))
+					r.Post("/register", RegisterCommand)
+					r.Post("/delete", DeleteCommand)
+				})
+			})
+		})
+
+		api.Route("/interaction", func(r chi.Router) {
+			r.Use(UserVerifier, RequireBot)
+			r.Post("/respond", RespondToInteraction)
+		})
+
+		api.Route("/members", func(r chi.Router) {
+			r.Use(UserVerifier, ScopeVerifier("members"))
 			r.With(SessionVerifier).Get("/fetch", GetMemberList)
 		})
 
 		api.Route("/email", func(r chi.Router) {
 			r.Get("/confirm", ConfirmEmail)
+			r.Get("/confirmChange", ConfirmEmailChange)
 		})
 	})
 
@@ -125,16 +304,48 @@ func Setup(_isHttps bool, cfg *models.ConfigFile, _sugar *zap.SugaredLogger, _db
 	//	websocketPath = "/ws/"
 	//} else {
 	websocketPath = "/ws"
-	r.Handle("/cdn/*", http.StripPrefix("/cdn/", http.FileServer(http.Dir("./public"))))
-	r.Handle("/*", http.FileServer(http.Dir("./static")))
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.Timeout(60 * time.Second))
+		r.Get("/.well-known/jwks.json", GetJwks)
+		r.Handle("/cdn/*", http.StripPrefix("/cdn/", http.FileServer(http.Dir("./public"))))
+		r.Handle("/*", http.FileServer(http.Dir("./static")))
+	})
 	//}
 
-	r.With(UserVerifier).Get(websocketPath, HandleWebSocket)
+	// these are long lived, so they can't have the timeout of the other routes
+	// websocket authenticates itself, as it also accepts credentials in the first frame
+	r.Get(websocketPath, HandleWebSocket)
+	r.With(UserVerifier, RequireScope(ScopeRealtime)).Get("/sse", HandleSSE)
+	r.With(UserVerifier, RequireScope(ScopeRealtime)).Get("/poll", HandleLongPoll)
 
-	address := fmt.Sprintf("%s:%s", cfg.HostAddress, cfg.HostPort)
+	serverMutex.Lock()
+	if shuttingDown {
+		serverMutex.Unlock()
+		return http.ErrServerClosed
+	}
+	server = &http.Server{
+		Addr:    fmt.Sprintf("%s:%s", cfg.HostAddress, cfg.HostPort),
+		Handler: r,
+	}
+	serverMutex.Unlock()
 
 	if isHttps {
-		return http.ListenAndServeTLS(address, cfg.TlsCert, cfg.TlsKey, r)
+		return server.ListenAndServeTLS(cfg.TlsCert, cfg.TlsKey)
+	}
+	return server.ListenAndServe()
+}
+
+// Shutdown stops accepting new connections and waits for in-flight requests to finish,
+// Setup returns http.ErrServerClosed once this is called
+func Shutdown(ctx context.Context) error {
+	serverMutex.Lock()
+	shuttingDown = true
+	// a server set before this is shut down here, so serving it returns http.ErrServerClosed right away
+	s := server
+	serverMutex.Unlock()
+
+	if s == nil {
+		return nil
 	}
-	return http.ListenAndServe(address, r)
+	return s.Shutdown(ctx)
 }
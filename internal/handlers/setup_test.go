@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"chatapp-backend/internal/database/databaseTest"
+	"chatapp-backend/internal/keyValue"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	testUser     = 10
+	testPassword = "correct horse battery staple"
+)
+
+func setupTest(t *testing.T) {
+	t.Helper()
+
+	db = databaseTest.Open(t)
+	sugar = zap.NewNop().Sugar()
+	keyValue.Setup(sugar, nil, false)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec(t, "INSERT INTO users (id, email, username, display_name, picture, password) VALUES($1, 'user@gmail.com', 'user', 'user', '', $2)", testUser, hash)
+}
+
+func exec(t *testing.T, query string, args ...any) {
+	t.Helper()
+
+	_, err := db.Exec(query, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func count(t *testing.T, query string, args ...any) int {
+	t.Helper()
+
+	var n int
+	err := db.QueryRow(query, args...).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// serve calls the handler like the router would, logged in as the user if it isn't 0
+func serve(handler http.HandlerFunc, userID int64, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	if userID != 0 {
+		ctx := context.WithValue(r.Context(), UserIDKeyType{}, userID)
+		ctx = context.WithValue(ctx, FamilyIDKeyType{}, int64(0))
+		r = r.WithContext(ctx)
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func addPasskey(t *testing.T, id int64) {
+	t.Helper()
+
+	exec(t, "INSERT INTO passkeys (id, user_id, credential_id, credential, name, created_at) VALUES($1, $2, $3, '{}', 'key', $4)",
+		id, testUser, strings.Repeat("a", int(id)), time.Now().UTC())
+}
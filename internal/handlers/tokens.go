@@ -0,0 +1,412 @@
+package handlers
+
+import (
+	"chatapp-backend/internal/hub"
+	"chatapp-backend/internal/jwt"
+	"chatapp-backend/internal/keyValue"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func revokedFamilyKey(familyID int64) string {
+	return fmt.Sprintf("revoked_family:%d", familyID)
+}
+
+func tokensRevokedBeforeKey(userID int64) string {
+	return fmt.Sprintf("tokens_revoked_before:%d", userID)
+}
+
+func refreshSuccessorKey(tokenHash string) string {
+	return fmt.Sprintf("refresh_successor:%s", tokenHash)
+}
+
+// a token used again this soon after it was rotated is most likely the same client refreshing
+// from two tabs or retrying, those get the token it was rotated to instead of a logout
+const refreshGraceWindow = 10 * time.Second
+
+// how long used tokens are kept to catch them being reused
+const usedTokenRetention = 24 * time.Hour
+
+type refreshSuccessor struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// successorCipher encrypts the successor with a key derived from the rotated token,
+// so it can only be read by presenting that token, the store only knows the hash of it
+func successorCipher(refreshToken string) (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte("refresh_successor:" + refreshToken))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// createRefreshToken creates a new refresh token in the family
+func createRefreshToken(userID int64, familyID int64, rememberMe bool) (refreshSuccessor, error) {
+	tokenBytes := make([]byte, 32)
+	_, err := rand.Read(tokenBytes)
+	if err != nil {
+		return refreshSuccessor{}, err
+	}
+	refreshToken := base64.RawURLEncoding.EncodeToString(tokenBytes)
+
+	expirationDate := time.Now().UTC().Add(jwt.RefreshTokenLifetime(rememberMe))
+
+	_, err = db.Exec("INSERT INTO refresh_tokens (token_hash, family_id, user_id, remember, expires_at) VALUES($1, $2, $3, $4, $5)",
+		hashToken(refreshToken), familyID, userID, rememberMe, expirationDate)
+	if err != nil {
+		return refreshSuccessor{}, err
+	}
+
+	return refreshSuccessor{Token: refreshToken, ExpiresAt: expirationDate}, nil
+}
+
+// setTokenCookies sets the refresh token and a new access token belonging to its family as cookies
+func setTokenCookies(w http.ResponseWriter, userID int64, familyID int64, rememberMe bool, refreshToken refreshSuccessor) error {
+	accessCookie, err := jwt.CreateToken(userID, familyID)
+	if err != nil {
+		return err
+	}
+
+	refreshCookie := jwt.CreateRefreshCookie(refreshToken.Token, rememberMe, refreshToken.ExpiresAt)
+
+	http.SetCookie(w, &accessCookie)
+	http.SetCookie(w, &refreshCookie)
+
+	return nil
+}
+
+// issueTokens creates a new refresh token in the family and an access token belonging to it,
+// and sets both as cookies
+func issueTokens(w http.ResponseWriter, userID int64, familyID int64, rememberMe bool) error {
+	refreshToken, err := createRefreshToken(userID, familyID, rememberMe)
+	if err != nil {
+		return err
+	}
+
+	return setTokenCookies(w, userID, familyID, rememberMe, refreshToken)
+}
+
+// rotateRefreshToken replaces the used token with a new one, which is kept encrypted for the grace window
+// so a request racing with this one can be given the same token
+func rotateRefreshToken(w http.ResponseWriter, refreshToken string, userID int64, familyID int64, rememberMe bool) error {
+	successor, err := createRefreshToken(userID, familyID, rememberMe)
+	if err != nil {
+		return err
+	}
+
+	bytes, err := json.Marshal(successor)
+	if err != nil {
+		return err
+	}
+
+	aead, err := successorCipher(refreshToken)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+	sealed := aead.Seal(nonce, nonce, bytes, nil)
+
+	err = keyValue.Set(refreshSuccessorKey(hashToken(refreshToken)), base64.RawStdEncoding.EncodeToString(sealed), refreshGraceWindow)
+	if err != nil {
+		return err
+	}
+
+	err = pruneRefreshTokens(userID)
+	if err != nil {
+		return err
+	}
+
+	return setTokenCookies(w, userID, familyID, rememberMe, successor)
+}
+
+// pruneRefreshTokens deletes the expired tokens of the user and the ones used long enough ago,
+// a reuse of those is still rejected, it just doesn't log the family out anymore
+func pruneRefreshTokens(userID int64) error {
+	now := time.Now().UTC()
+	_, err := db.Exec("DELETE FROM refresh_tokens WHERE user_id = $1 AND (expires_at < $2 OR used_at < $3)",
+		userID, now, now.Add(-usedTokenRetention))
+	return err
+}
+
+// successorOf returns the token a just rotated token was replaced with, false if the grace window is over
+func successorOf(refreshToken string) (refreshSuccessor, bool, error) {
+	value, err := keyValue.Get(refreshSuccessorKey(hashToken(refreshToken)))
+	if err != nil || value == "" {
+		return refreshSuccessor{}, false, err
+	}
+
+	sealed, err := base64.RawStdEncoding.DecodeString(value)
+	if err != nil {
+		return refreshSuccessor{}, false, err
+	}
+
+	aead, err := successorCipher(refreshToken)
+	if err != nil {
+		return refreshSuccessor{}, false, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return refreshSuccessor{}, false, errors.New("sealed refresh successor is too short")
+	}
+
+	bytes, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return refreshSuccessor{}, false, err
+	}
+
+	var successor refreshSuccessor
+	err = json.Unmarshal(bytes, &successor)
+	if err != nil {
+		return refreshSuccessor{}, false, err
+	}
+
+	return successor, true, nil
+}
+
+// startLogin begins a new refresh token family for the user,
+// which is also recorded as a login session the user can see and revoke
+func startLogin(w http.ResponseWriter, r *http.Request, userID int64, rememberMe bool) error {
+	familyID := snowflakeNode.Generate().Int64()
+
+	userAgent := r.UserAgent()
+	now := time.Now().UTC()
+
+	_, err := db.Exec("INSERT INTO login_sessions (id, user_id, device, user_agent, ip, last_used_at) VALUES($1, $2, $3, $4, $5, $6)",
+		familyID, userID, deviceFromUserAgent(userAgent), userAgent, hub.RemoteIP(r), now)
+	if err != nil {
+		return err
+	}
+
+	// logging in is how a scheduled account deletion is cancelled
+	_, err = db.Exec("DELETE FROM account_deletions WHERE user_id = $1", userID)
+	if err != nil {
+		return err
+	}
+
+	err = pruneRefreshTokens(userID)
+	if err != nil {
+		return err
+	}
+
+	return issueTokens(w, userID, familyID, rememberMe)
+}
+
+// revokeFamily deletes every refresh token of the family and its login session,
+// rejects access tokens issued from it until they would expire anyway,
+// and closes the connections opened with it
+func revokeFamily(userID int64, familyID int64) error {
+	_, err := db.Exec("DELETE FROM refresh_tokens WHERE family_id = $1", familyID)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("DELETE FROM login_sessions WHERE id = $1", familyID)
+	if err != nil {
+		return err
+	}
+
+	err = keyValue.Set(revokedFamilyKey(familyID), "y", jwt.AccessTokenLifetime)
+	if err != nil {
+		return err
+	}
+
+	return hub.DisconnectLoginSession(userID, familyID)
+}
+
+// revokeAllTokens logs the user out everywhere
+func revokeAllTokens(userID int64) error {
+	_, err := db.Exec("DELETE FROM refresh_tokens WHERE user_id = $1", userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("DELETE FROM login_sessions WHERE user_id = $1", userID)
+	if err != nil {
+		return err
+	}
+
+	err = keyValue.Set(tokensRevokedBeforeKey(userID), strconv.FormatInt(time.Now().Unix(), 10), jwt.AccessTokenLifetime)
+	if err != nil {
+		return err
+	}
+
+	return hub.DisconnectUser(userID)
+}
+
+// isTokenRevoked checks if the access token was issued before a logout,
+// the issue time only has seconds, so one issued in the same second as the logout is rejected too
+func isTokenRevoked(userToken jwt.UserToken) (bool, error) {
+	value, err := keyValue.Get(revokedFamilyKey(userToken.FamilyID))
+	if err != nil {
+		return false, err
+	}
+	if value != "" {
+		return true, nil
+	}
+
+	value, err = keyValue.Get(tokensRevokedBeforeKey(userToken.UserID))
+	if err != nil {
+		return false, err
+	}
+	if value == "" {
+		return false, nil
+	}
+
+	revokedBefore, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return false, err
+	}
+
+	return userToken.IssuedAt.Unix() <= revokedBefore, nil
+}
+
+func RefreshToken(w http.ResponseWriter, r *http.Request) {
+	refreshCookie, err := r.Cookie("refresh")
+	if err != nil {
+		sugar.Debug(err)
+		switch {
+		case errors.Is(err, http.ErrNoCookie):
+			http.Error(w, "No refresh cookie was provided", http.StatusUnauthorized)
+		default:
+			http.Error(w, "Couldn't read refresh cookie", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	tokenHash := hashToken(refreshCookie.Value)
+
+	var familyID, userID int64
+	var rememberMe bool
+	var expiresAt time.Time
+	var usedAt sql.NullTime
+	err = db.QueryRow("SELECT family_id, user_id, remember, used_at, expires_at FROM refresh_tokens WHERE token_hash = $1", tokenHash).
+		Scan(&familyID, &userID, &rememberMe, &usedAt, &expiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			sugar.Debug(err)
+			deleteCookie(w, "refresh", "/api/auth")
+			http.Error(w, "Login expired", http.StatusUnauthorized)
+		} else {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if time.Now().UTC().After(expiresAt.UTC()) {
+		deleteCookie(w, "refresh", "/api/auth")
+		http.Error(w, "Login expired", http.StatusUnauthorized)
+		return
+	}
+
+	now := time.Now().UTC()
+	used := usedAt.Valid
+	if !used {
+		// the update only succeeds once, the request that loses a race with the same token is treated as a reuse right after
+		result, err := db.Exec("UPDATE refresh_tokens SET used_at = $1 WHERE token_hash = $2 AND used_at IS NULL", now, tokenHash)
+		if err != nil {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		affected, err := result.RowsAffected()
+		if err != nil {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		if affected == 0 {
+			used = true
+			usedAt = sql.NullTime{Time: now, Valid: true}
+		}
+	}
+
+	if used && now.Sub(usedAt.Time.UTC()) < refreshGraceWindow {
+		successor, ok, err := successorOf(refreshCookie.Value)
+		if err != nil {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		// the request that rotated it hasn't finished yet, the client can retry with the cookie that one sets
+		if !ok {
+			http.Error(w, "refresh_in_progress", http.StatusConflict)
+			return
+		}
+
+		err = setTokenCookies(w, userID, familyID, rememberMe, successor)
+		if err != nil {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// an already used token means it was likely stolen, so the whole family is logged out
+	if used {
+		sugar.Warnf("Refresh token of family ID [%d] of user ID [%d] was reused, revoking family", familyID, userID)
+
+		err = revokeFamily(userID, familyID)
+		if err != nil {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		deleteCookie(w, "refresh", "/api/auth")
+		http.Error(w, "Login expired", http.StatusUnauthorized)
+		return
+	}
+
+	_, err = db.Exec("UPDATE login_sessions SET last_used_at = $1, ip = $2 WHERE id = $3", now, hub.RemoteIP(r), familyID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = rotateRefreshToken(w, refreshCookie.Value, userID, familyID, rememberMe)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+// GetJwks publishes the public keys of the access tokens, so other services can verify them
+func GetJwks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	// verifiers are expected to refetch when they see an unknown key ID anyway
+	w.Header().Set("Cache-Control", "public, max-age=300")
+
+	err := json.NewEncoder(w).Encode(jwt.PublicKeys())
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"chatapp-backend/internal/jwt"
+	"chatapp-backend/internal/keyValue"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testFamily = 50
+
+func setupTokensTest(t *testing.T) {
+	t.Helper()
+
+	setupTest(t)
+
+	err := jwt.Setup("secret", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exec(t, "INSERT INTO login_sessions (id, user_id, device, user_agent, ip, last_used_at) VALUES($1, $2, '', '', '', $3)", testFamily, testUser, time.Now().UTC())
+}
+
+func newRefreshToken(t *testing.T) string {
+	t.Helper()
+
+	token, err := createRefreshToken(testUser, testFamily, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token.Token
+}
+
+// refresh returns the response and the refresh token it set, empty if it didn't set one
+func refresh(token string) (*httptest.ResponseRecorder, string) {
+	r := httptest.NewRequest(http.MethodPost, "/api/auth/refresh", nil)
+	r.AddCookie(&http.Cookie{Name: "refresh", Value: token})
+
+	w := httptest.NewRecorder()
+	RefreshToken(w, r)
+
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "refresh" {
+			return w, cookie.Value
+		}
+	}
+	return w, ""
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	setupTokensTest(t)
+	token := newRefreshToken(t)
+
+	w, successor := refresh(token)
+	if w.Code != http.StatusOK || successor == "" || successor == token {
+		t.Fatalf("expected the token to be rotated, got %d", w.Code)
+	}
+
+	// the same token again within the grace window gets the same successor
+	w, again := refresh(token)
+	if w.Code != http.StatusOK || again != successor {
+		t.Fatalf("expected the successor within the grace window, got %d", w.Code)
+	}
+
+	value, err := keyValue.Get(refreshSuccessorKey(hashToken(token)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value == "" || value == successor {
+		t.Error("the successor should be stored encrypted")
+	}
+
+	w, next := refresh(successor)
+	if w.Code != http.StatusOK || next == "" || next == successor {
+		t.Errorf("expected the successor to be rotated as well, got %d", w.Code)
+	}
+}
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	setupTokensTest(t)
+	token := newRefreshToken(t)
+
+	w, successor := refresh(token)
+	if w.Code != http.StatusOK {
+		t.Fatalf("rotation failed with %d", w.Code)
+	}
+
+	// once the grace window is over, using the token again is a reuse
+	exec(t, "UPDATE refresh_tokens SET used_at = $1 WHERE token_hash = $2", time.Now().UTC().Add(-time.Minute), hashToken(token))
+
+	w, _ = refresh(token)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected the reuse to be refused, got %d", w.Code)
+	}
+
+	if count(t, "SELECT COUNT(*) FROM refresh_tokens WHERE family_id = $1", testFamily) != 0 {
+		t.Error("tokens of the family should be deleted")
+	}
+	if count(t, "SELECT COUNT(*) FROM login_sessions WHERE id = $1", testFamily) != 0 {
+		t.Error("login session of the family should be deleted")
+	}
+
+	w, _ = refresh(successor)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the successor to be revoked too, got %d", w.Code)
+	}
+
+	revoked, err := isTokenRevoked(jwt.UserToken{UserID: testUser, FamilyID: testFamily})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !revoked {
+		t.Error("access tokens of the family should be rejected")
+	}
+}
+
+func TestRefreshTokenPruning(t *testing.T) {
+	setupTokensTest(t)
+	token := newRefreshToken(t)
+
+	now := time.Now().UTC()
+	insert := "INSERT INTO refresh_tokens (token_hash, family_id, user_id, remember, used_at, expires_at) VALUES($1, $2, $3, FALSE, $4, $5)"
+	exec(t, insert, "expired", testFamily, testUser, nil, now.Add(-time.Minute))
+	exec(t, insert, "used long ago", testFamily, testUser, now.Add(-usedTokenRetention-time.Minute), now.Add(time.Hour))
+	exec(t, insert, "used recently", testFamily, testUser, now.Add(-time.Hour), now.Add(time.Hour))
+
+	w, _ := refresh(token)
+	if w.Code != http.StatusOK {
+		t.Fatalf("rotation failed with %d", w.Code)
+	}
+
+	if count(t, "SELECT COUNT(*) FROM refresh_tokens WHERE token_hash IN ('expired', 'used long ago')") != 0 {
+		t.Error("expired and long used tokens should be pruned")
+	}
+	if count(t, "SELECT COUNT(*) FROM refresh_tokens WHERE token_hash = 'used recently'") != 1 {
+		t.Error("recently used tokens should be kept to catch a reuse")
+	}
+}
+
+func TestRevokeAllTokensInSameSecond(t *testing.T) {
+	setupTokensTest(t)
+
+	// another family, the revoked one of the reuse test is remembered by the key/value store
+	cookie, err := jwt.CreateToken(testUser, testFamily+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userToken, err := jwt.VerifyToken(cookie.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = revokeAllTokens(testUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	revoked, err := isTokenRevoked(userToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !revoked {
+		t.Error("token issued right before the logout should be rejected")
+	}
+}
@@ -0,0 +1,570 @@
+package handlers
+
+import (
+	"chatapp-backend/internal/keyValue"
+	"chatapp-backend/internal/twoFactor"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	loginChallengeLifetime = 5 * time.Minute
+	// the challenge is dropped after this many wrong codes, the password has to be entered again
+	maxLoginChallengeAttempts = 5
+)
+
+const (
+	secondFactorTOTP         = "totp"
+	secondFactorRecoveryCode = "recoveryCode"
+	secondFactorPasskey      = "passkey"
+)
+
+func loginChallengeKey(token string) string {
+	return fmt.Sprintf("login_challenge:%s", token)
+}
+
+// wrong codes are counted apart from the challenge, so requests racing each other can't lose a count
+func loginChallengeAttemptsKey(token string) string {
+	return fmt.Sprintf("login_challenge_attempts:%s", token)
+}
+
+// the passkey session is set once the client asks to use a passkey
+func loginChallengePasskeyKey(token string) string {
+	return fmt.Sprintf("login_challenge_passkey:%s", token)
+}
+
+type loginChallenge struct {
+	UserID     int64 `json:"userID"`
+	RememberMe bool  `json:"rememberMe"`
+}
+
+// hasTwoFactor is only true with TOTP turned on, passkeys are offered as another way to complete the challenge.
+// a passkey alone doesn't turn it on, as losing it without recovery codes would lock the user out
+func hasTwoFactor(userID int64) (bool, error) {
+	var enabled bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM two_factor WHERE user_id = $1 AND enabled = TRUE)", userID).Scan(&enabled)
+	return enabled, err
+}
+
+// startLoginChallenge is used instead of startLogin once the password is checked, if the user has a second factor
+func startLoginChallenge(w http.ResponseWriter, userID int64, rememberMe bool) error {
+	token, err := uuid.NewRandom()
+	if err != nil {
+		return err
+	}
+
+	bytes, err := json.Marshal(loginChallenge{UserID: userID, RememberMe: rememberMe})
+	if err != nil {
+		return err
+	}
+
+	err = keyValue.Set(loginChallengeKey(token.String()), string(bytes), loginChallengeLifetime)
+	if err != nil {
+		return err
+	}
+
+	methods := []string{secondFactorTOTP, secondFactorRecoveryCode}
+
+	passkeys, err := hasPasskeys(userID)
+	if err != nil {
+		return err
+	}
+	if passkeys {
+		methods = append(methods, secondFactorPasskey)
+	}
+
+	type Challenge struct {
+		Challenge string    `json:"challenge"`
+		Methods   []string  `json:"methods"`
+		ExpiresAt time.Time `json:"expiresAt"`
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	return json.NewEncoder(w).Encode(Challenge{
+		Challenge: token.String(),
+		Methods:   methods,
+		ExpiresAt: time.Now().Add(loginChallengeLifetime),
+	})
+}
+
+// useTOTPCode checks the code against the enabled secret, or the pending one while enrolling.
+// the time step of the code is remembered, so the same code can't be used twice
+func useTOTPCode(userID int64, code string, enabled bool) (bool, error) {
+	var secret string
+	err := db.QueryRow("SELECT secret FROM two_factor WHERE user_id = $1 AND enabled = $2", userID, enabled).Scan(&secret)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	step, ok := twoFactor.MatchCode(secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+
+	result, err := db.Exec("UPDATE two_factor SET last_used_step = $1 WHERE user_id = $2 AND last_used_step < $1", step, userID)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+func useRecoveryCode(userID int64, code string) (bool, error) {
+	result, err := db.Exec("DELETE FROM recovery_codes WHERE user_id = $1 AND code_hash = $2", userID, hashToken(twoFactor.NormalizeRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+// useSecondFactor accepts either a code from the authenticator app or one of the recovery codes
+func useSecondFactor(userID int64, code string, recoveryCode string) (bool, error) {
+	if code != "" {
+		return useTOTPCode(userID, code, true)
+	}
+	if recoveryCode != "" {
+		return useRecoveryCode(userID, recoveryCode)
+	}
+	return false, nil
+}
+
+// replaceRecoveryCodes invalidates the previous codes, only the hashes are stored
+func replaceRecoveryCodes(tx *sql.Tx, userID int64) ([]string, error) {
+	codes, err := twoFactor.NewRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("DELETE FROM recovery_codes WHERE user_id = $1", userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, code := range codes {
+		_, err = tx.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES($1, $2)", userID, hashToken(twoFactor.NormalizeRecoveryCode(code)))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return codes, nil
+}
+
+// CompleteLogin finishes a login that was answered with a challenge, with a TOTP code, a recovery code,
+// or a passkey after BeginPasskeySecondFactor
+func CompleteLogin(w http.ResponseWriter, r *http.Request) {
+	type Completion struct {
+		Challenge    string          `json:"challenge"`
+		Code         string          `json:"code"`
+		RecoveryCode string          `json:"recoveryCode"`
+		Passkey      json.RawMessage `json:"passkey"`
+	}
+
+	var completion Completion
+	err := json.NewDecoder(r.Body).Decode(&completion)
+	if err != nil {
+		sugar.Debug(err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	key := loginChallengeKey(completion.Challenge)
+
+	value, err := keyValue.Get(key)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if value == "" {
+		http.Error(w, "invalid_challenge", http.StatusUnauthorized)
+		return
+	}
+
+	var challenge loginChallenge
+	err = json.Unmarshal([]byte(value), &challenge)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	var ok bool
+	if len(completion.Passkey) != 0 {
+		// a passkey session can only be answered once
+		var session string
+		session, err = keyValue.GetDel(loginChallengePasskeyKey(completion.Challenge))
+		if err == nil {
+			ok, err = usePasskey(challenge.UserID, session, completion.Passkey)
+		}
+	} else {
+		ok, err = useSecondFactor(challenge.UserID, completion.Code, completion.RecoveryCode)
+	}
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	if !ok {
+		var attempts int64
+		attempts, err = keyValue.Incr(loginChallengeAttemptsKey(completion.Challenge), loginChallengeLifetime)
+		if err == nil && attempts >= maxLoginChallengeAttempts {
+			err = keyValue.Del(key)
+		}
+		if err != nil {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		http.Error(w, "wrong_code", http.StatusUnauthorized)
+		return
+	}
+
+	// a challenge can only be completed once
+	value, err = keyValue.GetDel(key)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if value == "" {
+		http.Error(w, "invalid_challenge", http.StatusUnauthorized)
+		return
+	}
+
+	err = startLogin(w, r, challenge.UserID, challenge.RememberMe)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+func GetTwoFactor(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	type TwoFactor struct {
+		Enabled           bool `json:"enabled"`
+		RecoveryCodesLeft int  `json:"recoveryCodesLeft"`
+	}
+
+	var result TwoFactor
+	err := db.QueryRow(`
+		SELECT
+			EXISTS(SELECT 1 FROM two_factor WHERE user_id = $1 AND enabled = TRUE),
+			(SELECT COUNT(*) FROM recovery_codes WHERE user_id = $1)
+	`, userID).Scan(&result.Enabled, &result.RecoveryCodesLeft)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(result)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+// EnrollTOTP creates a new secret, it's only used once it's activated with a code from the authenticator app.
+// enrolling again before that replaces the secret
+func EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	enabled, err := hasTwoFactor(userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		http.Error(w, "two_factor_enabled", http.StatusConflict)
+		return
+	}
+
+	var username string
+	err = db.QueryRow("SELECT username FROM users WHERE id = $1", userID).Scan(&username)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	secret, uri, err := twoFactor.NewKey(username)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO two_factor (user_id, secret, enabled, last_used_step, created_at) VALUES($1, $2, FALSE, 0, $3)
+		ON CONFLICT (user_id) DO UPDATE SET secret = excluded.secret, last_used_step = 0, created_at = excluded.created_at
+		WHERE two_factor.enabled = FALSE
+	`, userID, secret, time.Now().UTC())
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	type Enrollment struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}
+
+	err = json.NewEncoder(w).Encode(Enrollment{Secret: secret, URI: uri})
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+// ActivateTOTP turns on the enrolled secret and returns the recovery codes, they're never shown again
+func ActivateTOTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	type Activation struct {
+		Code string `json:"code"`
+	}
+
+	var activation Activation
+	err := json.NewDecoder(r.Body).Decode(&activation)
+	if err != nil {
+		sugar.Debug(err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	ok, err := useTOTPCode(userID, activation.Code, false)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "wrong_code", http.StatusUnauthorized)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			sugar.Error(err)
+		}
+	}()
+
+	result, err := tx.Exec("UPDATE two_factor SET enabled = TRUE WHERE user_id = $1 AND enabled = FALSE", userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if affected == 0 {
+		http.Error(w, "two_factor_enabled", http.StatusConflict)
+		return
+	}
+
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(map[string][]string{"recoveryCodes": codes})
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+// DisableTOTP needs the password and a code, so a stolen session alone can't turn it off
+func DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	type Disabling struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recoveryCode"`
+	}
+
+	var disabling Disabling
+	err := json.NewDecoder(r.Body).Decode(&disabling)
+	if err != nil {
+		sugar.Debug(err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	correct, err := isCurrentPassword(userID, disabling.Password)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if !correct {
+		http.Error(w, "wrong_password", http.StatusUnauthorized)
+		return
+	}
+
+	ok, err := useSecondFactor(userID, disabling.Code, disabling.RecoveryCode)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "wrong_code", http.StatusUnauthorized)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			sugar.Error(err)
+		}
+	}()
+
+	_, err = tx.Exec("DELETE FROM two_factor WHERE user_id = $1", userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec("DELETE FROM recovery_codes WHERE user_id = $1", userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+// RegenerateRecoveryCodes replaces every recovery code, the used up and the unused ones
+func RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	type Regeneration struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+
+	var regeneration Regeneration
+	err := json.NewDecoder(r.Body).Decode(&regeneration)
+	if err != nil {
+		sugar.Debug(err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	correct, err := isCurrentPassword(userID, regeneration.Password)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if !correct {
+		http.Error(w, "wrong_password", http.StatusUnauthorized)
+		return
+	}
+
+	ok, err := useTOTPCode(userID, regeneration.Code, true)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "wrong_code", http.StatusUnauthorized)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			sugar.Error(err)
+		}
+	}()
+
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(map[string][]string{"recoveryCodes": codes})
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
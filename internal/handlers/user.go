@@ -1,14 +1,29 @@
 package handlers
 
 import (
+	"chatapp-backend/internal/database"
 	"chatapp-backend/internal/fileHandlers"
+	"chatapp-backend/internal/hub"
 	"chatapp-backend/internal/models"
+	"chatapp-backend/internal/validator"
+	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 )
 
+const usernameCooldown = 7 * 24 * time.Hour
+
+// isUsernameTaken checks regardless of case, exceptUserID lets users change the case of their own username
+func isUsernameTaken(username string, exceptUserID int64) (bool, error) {
+	var taken bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE LOWER(username) = LOWER($1) AND id != $2)", username, exceptUserID).Scan(&taken)
+	return taken, err
+}
+
 func GetUserInfo(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	userID := ctx.Value(UserIDKeyType{}).(int64)
@@ -33,7 +48,8 @@ func GetUserInfo(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var userClient models.User
-	err := db.QueryRow("SELECT display_name, picture FROM users WHERE id = $1", requestedUserID).Scan(&userClient.DisplayName, &userClient.Picture)
+	err := db.QueryRow("SELECT username, display_name, picture, EXISTS(SELECT 1 FROM bots WHERE bots.id = users.id) FROM users WHERE id = $1", requestedUserID).
+		Scan(&userClient.UserName, &userClient.DisplayName, &userClient.Picture, &userClient.Bot)
 	if err != nil {
 		sugar.Error(err)
 		http.Error(w, "", http.StatusInternalServerError)
@@ -74,4 +90,127 @@ func UpdateUserInfo(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	}
+
+	// sync the changes to the user's other sessions
+	user := models.User{ID: userID}
+	err := db.QueryRow("SELECT username, display_name, picture FROM users WHERE id = $1", userID).Scan(&user.UserName, &user.DisplayName, &user.Picture)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = hub.EmitToUser(hub.UserModified, user, userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+// GetUserByUsername looks up a user by their username, regardless of case
+func GetUserByUsername(w http.ResponseWriter, r *http.Request) {
+	username := r.URL.Query().Get("username")
+	if username == "" {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	var user models.User
+	err := db.QueryRow(`
+		SELECT
+			id, username, display_name, picture, EXISTS(SELECT 1 FROM bots WHERE bots.id = users.id)
+		FROM
+			users
+		WHERE
+			LOWER(username) = LOWER($1) AND NOT EXISTS(SELECT 1 FROM webhooks WHERE webhooks.id = users.id)
+	`, username).Scan(&user.ID, &user.UserName, &user.DisplayName, &user.Picture, &user.Bot)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "User not found", http.StatusNotFound)
+		} else {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(user)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+// ChangeUsername can be used once per cooldown, only changing the case of the username is just as limited
+func ChangeUsername(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	if ctx.Value(AuthInfoKeyType{}).(authInfo).isBot() {
+		http.Error(w, "Bots can't change their username", http.StatusForbidden)
+		return
+	}
+
+	username := r.URL.Query().Get("username")
+	err := validator.Username(username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var changedAt sql.NullTime
+	err = db.QueryRow("SELECT username_changed_at FROM users WHERE id = $1", userID).Scan(&changedAt)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	if changedAt.Valid {
+		nextChange := changedAt.Time.Add(usernameCooldown)
+		if time.Now().UTC().Before(nextChange) {
+			http.Error(w, fmt.Sprintf("Username can be changed again after %s", nextChange.Format(time.RFC3339)), http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	taken, err := isUsernameTaken(username, userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		http.Error(w, "username_taken", http.StatusConflict)
+		return
+	}
+
+	// the unique index decides if two users tried to take the same username at once
+	_, err = db.Exec("UPDATE users SET username = $1, username_changed_at = $2 WHERE id = $3", username, time.Now().UTC(), userID)
+	if database.IsUniqueViolation(err) {
+		http.Error(w, "username_taken", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	user := models.User{ID: userID, UserName: username}
+	err = db.QueryRow("SELECT display_name, picture FROM users WHERE id = $1", userID).Scan(&user.DisplayName, &user.Picture)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	err = hub.EmitToUser(hub.UserModified, user, userID)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
 }
@@ -2,12 +2,84 @@ package handlers
 
 import (
 	"chatapp-backend/internal/hub"
+	"errors"
+	"fmt"
 	"net/http"
+	"slices"
 )
 
+// HandleWebSocket accepts credentials in the upgrade request like every other endpoint,
+// but since browsers can't set headers on websockets, clients without cookies may send them in the first frame instead
 func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	_, err := r.Cookie("JWT")
+	if r.Header.Get("Authorization") == "" && errors.Is(err, http.ErrNoCookie) {
+		hub.HandleUnauthenticatedClient(w, r, authenticateFirstFrame)
+		return
+	}
+
+	UserVerifier(RequireScope(ScopeRealtime)(http.HandlerFunc(handleAuthenticatedWebSocket))).ServeHTTP(w, r)
+}
+
+func handleAuthenticatedWebSocket(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	userID := ctx.Value(UserIDKeyType{}).(int64)
 
-	hub.HandleClient(w, r, userID)
+	sessionID, ok := verifySessionCookie(w, r, userID)
+	if !ok {
+		return
+	}
+
+	hub.HandleClient(w, r, userID, sessionID, loginSessionID(ctx))
+}
+
+// authenticateFirstFrame checks the same credentials as UserVerifier and SessionVerifier would
+func authenticateFirstFrame(token string, sessionToken string) (hub.Identity, error) {
+	info, err := authenticate(token)
+	if err != nil {
+		return hub.Identity{}, toIdentifyError(err)
+	}
+
+	if info.apiKeyID != 0 && !slices.Contains(info.scopes, ScopeRealtime) {
+		return hub.Identity{}, fmt.Errorf("%w: API key ID [%d] is missing the %s scope", hub.ErrAuthenticationFailed, info.apiKeyID, ScopeRealtime)
+	}
+
+	sessionID, err := checkSessionToken(sessionToken, info.userID)
+	if err != nil {
+		return hub.Identity{}, toIdentifyError(err)
+	}
+
+	return hub.Identity{UserID: info.userID, SessionID: sessionID, LoginSessionID: info.loginSessionID()}, nil
+}
+
+// toIdentifyError tells the hub which errors were rejected credentials
+func toIdentifyError(err error) error {
+	var rejection *authError
+	if errors.As(err, &rejection) {
+		return fmt.Errorf("%w: %s", hub.ErrAuthenticationFailed, rejection.message)
+	}
+	return err
+}
+
+func HandleSSE(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	sessionID, ok := verifySessionCookie(w, r, userID)
+	if !ok {
+		return
+	}
+
+	hub.HandleSSE(w, r, userID, sessionID, loginSessionID(ctx))
+}
+
+func HandleLongPoll(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := ctx.Value(UserIDKeyType{}).(int64)
+
+	sessionID, ok := verifySessionCookie(w, r, userID)
+	if !ok {
+		return
+	}
+
+	hub.HandleLongPoll(w, r, userID, sessionID, loginSessionID(ctx))
 }
@@ -0,0 +1,61 @@
+package hub
+
+import (
+	"encoding/binary"
+	"slices"
+)
+
+// an event published to a channel can be limited to some of its users, or to everyone but them,
+// which lets some users get a different version of the same event.
+// the audience is put in front of the encoded event and removed before the event reaches the client:
+// the marker, whether the users are the only ones or the excluded ones, their count and their IDs
+
+// the first byte of an event is the first byte of the length of its json frame, which is never this big
+const audienceMarker = 0xff
+
+const (
+	audienceOnly   = 1
+	audienceExcept = 0
+)
+
+// withAudience limits the event to the users if only is set, otherwise sends it to everyone but them
+func withAudience(payload string, only bool, userIDs []int64) string {
+	buf := make([]byte, 0, 6+8*len(userIDs)+len(payload))
+	buf = append(buf, audienceMarker)
+	if only {
+		buf = append(buf, audienceOnly)
+	} else {
+		buf = append(buf, audienceExcept)
+	}
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(userIDs)))
+	for _, userID := range userIDs {
+		buf = binary.BigEndian.AppendUint64(buf, uint64(userID))
+	}
+	return string(append(buf, payload...))
+}
+
+// receives reports if the event is meant for the user of the client,
+// and returns the event without its audience
+func (client *Client) receives(payload string) (string, bool) {
+	if len(payload) == 0 || payload[0] != audienceMarker {
+		return payload, true
+	}
+	if len(payload) < 6 {
+		sugar.Errorf("Event audience is too short: %d bytes", len(payload))
+		return "", false
+	}
+
+	only := payload[1] == audienceOnly
+	count := int(binary.BigEndian.Uint32([]byte(payload[2:6])))
+	if len(payload) < 6+8*count {
+		sugar.Errorf("Event audience of %d users doesn't fit in %d bytes", count, len(payload))
+		return "", false
+	}
+
+	userIDs := make([]int64, count)
+	for i := range userIDs {
+		userIDs[i] = int64(binary.BigEndian.Uint64([]byte(payload[6+8*i : 14+8*i])))
+	}
+
+	return payload[6+8*count:], slices.Contains(userIDs, client.UserID) == only
+}
@@ -0,0 +1,38 @@
+package hub
+
+import (
+	"testing"
+)
+
+func TestAudience(t *testing.T) {
+	event, err := encodeEvent(MessageCreated, map[string]string{"message": "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userIDs := []int64{2, 3}
+	tests := []struct {
+		name     string
+		payload  string
+		userID   int64
+		receives bool
+	}{
+		{"no audience", event, 1, true},
+		{"only, not listed", withAudience(event, true, userIDs), 1, false},
+		{"only, listed", withAudience(event, true, userIDs), 3, true},
+		{"except, not listed", withAudience(event, false, userIDs), 1, true},
+		{"except, listed", withAudience(event, false, userIDs), 2, false},
+	}
+
+	for _, test := range tests {
+		client := &Client{UserID: test.userID}
+
+		payload, receives := client.receives(test.payload)
+		if receives != test.receives {
+			t.Errorf("%s: expected receiving to be %v", test.name, test.receives)
+		}
+		if receives && payload != event {
+			t.Errorf("%s: audience wasn't removed from the event", test.name)
+		}
+	}
+}
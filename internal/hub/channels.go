@@ -1,107 +1,310 @@
 package hub
 
 import (
-	"bytes"
 	"chatapp-backend/internal/globals"
-	"encoding/json"
 	"fmt"
+	"slices"
 )
 
+func (client *Client) subscribeKey(key string) error {
+	if !useRedis {
+		localPubSub.Subscribe(key, client.SessionID)
+		return nil
+	}
+
+	return client.PubSub.Subscribe(client.Ctx, key)
+}
+
+func (client *Client) unsubscribeKey(key string) error {
+	if !useRedis {
+		localPubSub.Unsubscribe(key, client.SessionID)
+		return nil
+	}
+
+	return client.PubSub.Unsubscribe(client.Ctx, key)
+}
+
+// addChannel adds the channel to the end of the subscribed channels,
+// evicting the oldest unfocused one if the limit is reached, client must be locked
+func (client *Client) addChannel(channelID int64) error {
+	client.Channels = append(client.Channels, channelID)
+
+	if len(client.Channels) <= maxChannelSubscriptions {
+		return nil
+	}
+
+	for i, oldChannelID := range client.Channels {
+		if oldChannelID == client.FocusedChannelID || oldChannelID == channelID {
+			continue
+		}
+
+		sugar.Debugf("Session ID %d reached the limit of %d subscribed channels, evicting channel ID %d", client.SessionID, maxChannelSubscriptions, oldChannelID)
+		client.Channels = slices.Delete(client.Channels, i, i+1)
+		return client.unsubscribeKey(fmt.Sprintf("%s:%d", globals.ChannelTypeChannelActivity, oldChannelID))
+	}
+
+	return nil
+}
+
+// focusChannel makes the channel the one the client receives every event of,
+// the previously focused channel stays subscribed but only receives activity notifications
+func (client *Client) focusChannel(channelID int64) error {
+	client.Mutex.Lock()
+	defer client.Mutex.Unlock()
+
+	if client.FocusedChannelID == channelID {
+		return nil
+	}
+
+	if client.FocusedChannelID != 0 {
+		err := client.unsubscribeKey(fmt.Sprintf("%s:%d", globals.ChannelTypeChannel, client.FocusedChannelID))
+		if err != nil {
+			return err
+		}
+		err = client.subscribeKey(fmt.Sprintf("%s:%d", globals.ChannelTypeChannelActivity, client.FocusedChannelID))
+		if err != nil {
+			return err
+		}
+		// it's an unfocused channel from now on, so it can be evicted for the new one
+		client.FocusedChannelID = 0
+	}
+
+	index := slices.Index(client.Channels, channelID)
+	if index != -1 {
+		// move to the end so least recently focused channels get evicted first
+		client.Channels = append(slices.Delete(client.Channels, index, index+1), channelID)
+
+		err := client.unsubscribeKey(fmt.Sprintf("%s:%d", globals.ChannelTypeChannelActivity, channelID))
+		if err != nil {
+			return err
+		}
+	} else {
+		err := client.addChannel(channelID)
+		if err != nil {
+			return err
+		}
+	}
+
+	client.FocusedChannelID = channelID
+
+	return client.subscribeKey(fmt.Sprintf("%s:%d", globals.ChannelTypeChannel, channelID))
+}
+
+// Subscribe subscribes the session to the channel, if the session is connected to a different node,
+// the request is forwarded to that node
 func Subscribe(channel int64, channelType string, sessionID int64) error {
 	client, exists := GetClient(sessionID)
 	if !exists {
-		debugText := "redis channel"
 		if !useRedis {
-			debugText = "local channel"
+			return fmt.Errorf("session ID [%d] tried to subscribe to local channel [%d] but the session isn't connected to hub", sessionID, channel)
 		}
 
-		return fmt.Errorf("session ID [%d] tried to subscribe to %s [%d] but the session isn't connected to hub", sessionID, debugText, channel)
+		return sendCommand(command{Op: commandSubscribe, SessionID: sessionID, ChannelType: channelType, Channel: channel})
 	}
 
-	unsub := func(oldKey string, sessionID int64) error {
-		if !useRedis {
-			localPubSub.Unsubscribe(oldKey, sessionID)
-		} else {
-			err := client.PubSub.Unsubscribe(client.Ctx, oldKey)
-			if err != nil {
-				return err
-			}
-		}
-		// sugar.Debugf("Unsubscribed session ID %d from channel %d", sessionID, oldKey)
-		return nil
-	}
+	return client.subscribe(channel, channelType)
+}
+
+func (client *Client) subscribe(channel int64, channelType string) error {
+	sessionID := client.SessionID
 
 	switch channelType {
 	case globals.ChannelTypeChannel:
-		sugar.Debugf("Session ID %d unsubscribed from channel ID %d", sessionID, client.CurrentChannelID)
-		oldKey := fmt.Sprintf("%s:%d", channelType, client.CurrentChannelID)
-		err := unsub(oldKey, sessionID)
+		err := client.focusChannel(channel)
+		if err != nil {
+			return err
+		}
+		sugar.Debugf("Session ID %d focused channel ID %d", sessionID, channel)
+		return nil
+	case globals.ChannelTypeChannelActivity:
+		client.Mutex.Lock()
+		defer client.Mutex.Unlock()
+
+		// focused channel already receives everything
+		if slices.Contains(client.Channels, channel) {
+			return nil
+		}
+		err := client.addChannel(channel)
 		if err != nil {
 			return err
 		}
-		client.CurrentChannelID = channel
 	case globals.ChannelTypeServer:
+		client.Mutex.Lock()
+		defer client.Mutex.Unlock()
+
 		sugar.Debugf("Session ID %d unsubscribed from server ID %d", sessionID, client.CurrentServerID)
 		oldKey := fmt.Sprintf("%s:%d", channelType, client.CurrentServerID)
-		err := unsub(oldKey, sessionID)
+		err := client.unsubscribeKey(oldKey)
 		if err != nil {
 			return err
 		}
 		client.CurrentServerID = channel
 	case globals.ChannelTypeServerList:
 		// no need to unsubscribe anything as it's a list of multiple servers constantly in view
+	case globals.ChannelTypeUser:
+		// stays subscribed for the whole lifetime of the session
 	default:
 		sugar.Fatal("Wrong channelType was provided to SubscribeMessage")
 	}
 
 	newKey := fmt.Sprintf("%s:%d", channelType, channel)
 
-	if !useRedis {
-		localPubSub.Subscribe(newKey, sessionID)
-	} else {
-		err := client.PubSub.Subscribe(client.Ctx, newKey)
+	err := client.subscribeKey(newKey)
+	if err != nil {
+		return err
+	}
+
+	sugar.Debugf("Session ID %d subscribed to channel type %s %d", sessionID, channelType, channel)
+
+	return nil
+}
+
+func Unsubscribe(channel int64, channelType string, sessionID int64) error {
+	client, exists := GetClient(sessionID)
+	if !exists {
+		if !useRedis {
+			return fmt.Errorf("session ID [%d] tried to unsubscribe from [%d] but the session isn't connected to hub", sessionID, channel)
+		}
+
+		return sendCommand(command{Op: commandUnsubscribe, SessionID: sessionID, ChannelType: channelType, Channel: channel})
+	}
+
+	return client.unsubscribe(channel, channelType)
+}
+
+// UnsubscribeUser unsubscribes every session of the user from the channel, like when they lose access to it
+func UnsubscribeUser(channel int64, channelType string, userID int64) error {
+	sessionIDs, err := GetUserSessions(userID)
+	if err != nil {
+		return err
+	}
+
+	for _, sessionID := range sessionIDs {
+		err = Unsubscribe(channel, channelType, sessionID)
 		if err != nil {
 			return err
 		}
 	}
 
-	sugar.Debugf("Session ID %d subscribed to channel type %s %d", sessionID, channelType, channel)
+	return nil
+}
+
+func (client *Client) unsubscribe(channel int64, channelType string) error {
+	sessionID := client.SessionID
+
+	client.Mutex.Lock()
+	defer client.Mutex.Unlock()
+
+	switch channelType {
+	case globals.ChannelTypeChannel, globals.ChannelTypeChannelActivity:
+		index := slices.Index(client.Channels, channel)
+		if index == -1 {
+			return nil
+		}
+		client.Channels = slices.Delete(client.Channels, index, index+1)
+
+		if client.FocusedChannelID == channel {
+			client.FocusedChannelID = 0
+			channelType = globals.ChannelTypeChannel
+		} else {
+			channelType = globals.ChannelTypeChannelActivity
+		}
+	case globals.ChannelTypeServer:
+		if client.CurrentServerID != channel {
+			return nil
+		}
+		client.CurrentServerID = 0
+	case globals.ChannelTypeServerList:
+	default:
+		sugar.Fatal("Wrong channelType was provided to Unsubscribe")
+	}
+
+	err := client.unsubscribeKey(fmt.Sprintf("%s:%d", channelType, channel))
+	if err != nil {
+		return err
+	}
+
+	sugar.Debugf("Session ID %d unsubscribed from channel type %s %d", sessionID, channelType, channel)
 
 	return nil
 }
 
+// EmitHook is called for every event emitted on this node, after it was published
+type EmitHook func(messageType string, channelType string, message any, channel int64)
+
+var emitHooks []EmitHook
+
+// OnEmit registers a hook for emitted events, it must be quick as it runs in the emitting request,
+// hooks must be registered before serving requests
+func OnEmit(hook EmitHook) {
+	emitHooks = append(emitHooks, hook)
+}
+
+func publish(channel string, payload string) error {
+	sugar.Debugf("Sending message to those on channel %s", channel)
+
+	if !useRedis {
+		localPubSub.Publish(channel, payload)
+		return nil
+	}
+	return redisClient.Publish(redisCtx, channel, payload).Err()
+}
+
 func Emit(messageType string, channelType string, message any, _channel int64) error {
 	channel := fmt.Sprintf("%s:%d", channelType, _channel)
 
-	jsonBytes, err := json.Marshal(message)
+	payload, err := encodeEvent(messageType, message)
 	if err != nil {
 		return err
 	}
 
-	msgTypeStr := fmt.Sprintf("%s\n", messageType)
+	err = publish(channel, payload)
+	if err != nil {
+		return err
+	}
 
-	var buf bytes.Buffer
-	buf.Grow(len(msgTypeStr) + len(jsonBytes))
+	for _, hook := range emitHooks {
+		hook(messageType, channelType, message, _channel)
+	}
 
-	_, err = buf.WriteString(msgTypeStr)
+	return nil
+}
+
+// EmitWithOverride is like Emit, except the given users get override instead of message,
+// hooks only see message
+func EmitWithOverride(messageType string, channelType string, message any, _channel int64, override any, userIDs []int64) error {
+	if len(userIDs) == 0 {
+		return Emit(messageType, channelType, message, _channel)
+	}
+
+	channel := fmt.Sprintf("%s:%d", channelType, _channel)
+
+	payload, err := encodeEvent(messageType, message)
 	if err != nil {
 		return err
 	}
-	_, err = buf.Write(jsonBytes)
+	overridePayload, err := encodeEvent(messageType, override)
 	if err != nil {
 		return err
 	}
 
-	sugar.Debugf("Sending message to those on channel %s", channel)
+	err = publish(channel, withAudience(payload, false, userIDs))
+	if err != nil {
+		return err
+	}
+	err = publish(channel, withAudience(overridePayload, true, userIDs))
+	if err != nil {
+		return err
+	}
 
-	if !useRedis {
-		localPubSub.Publish(channel, buf.String())
-	} else {
-		err = redisClient.Publish(redisCtx, channel, buf.String()).Err()
-		if err != nil {
-			return err
-		}
+	for _, hook := range emitHooks {
+		hook(messageType, channelType, message, _channel)
 	}
 
 	return nil
 }
+
+// EmitToUser sends the message to every connected session of the user
+func EmitToUser(messageType string, message any, userID int64) error {
+	return Emit(messageType, globals.ChannelTypeUser, message, userID)
+}
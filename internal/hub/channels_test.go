@@ -0,0 +1,90 @@
+package hub
+
+import (
+	"chatapp-backend/internal/globals"
+	"slices"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// subscribedKeys returns the local pub/sub keys the session is subscribed to, sorted
+func subscribedKeys(sessionID int64) []string {
+	var keys []string
+	for key, sessionIDs := range localPubSub.hashMap {
+		if slices.Contains(sessionIDs, sessionID) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func TestChannelSubscriptions(t *testing.T) {
+	sugar = zap.NewNop().Sugar()
+	useRedis = false
+	localPubSub.Setup()
+	maxChannelSubscriptions = 3
+
+	client := &Client{SessionID: 1}
+
+	steps := []struct {
+		name        string
+		channelType string
+		channelID   int64
+		channels    []int64
+		keys        []string
+	}{
+		{"focus", globals.ChannelTypeChannel, 1, []int64{1}, []string{"channel:1"}},
+		{"focus another", globals.ChannelTypeChannel, 2, []int64{1, 2}, []string{"channel:2", "channel_activity:1"}},
+		{"follow activity", globals.ChannelTypeChannelActivity, 3, []int64{1, 2, 3}, []string{"channel:2", "channel_activity:1", "channel_activity:3"}},
+		// the focused channel is moved to the end, so it's evicted last once it isn't focused
+		{"focus followed", globals.ChannelTypeChannel, 1, []int64{2, 3, 1}, []string{"channel:1", "channel_activity:2", "channel_activity:3"}},
+		{"evict oldest", globals.ChannelTypeChannelActivity, 4, []int64{3, 1, 4}, []string{"channel:1", "channel_activity:3", "channel_activity:4"}},
+		{"focused isn't evicted", globals.ChannelTypeChannelActivity, 5, []int64{1, 4, 5}, []string{"channel:1", "channel_activity:4", "channel_activity:5"}},
+		{"already followed", globals.ChannelTypeChannelActivity, 4, []int64{1, 4, 5}, []string{"channel:1", "channel_activity:4", "channel_activity:5"}},
+	}
+
+	for _, step := range steps {
+		err := client.subscribe(step.channelID, step.channelType)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !slices.Equal(client.Channels, step.channels) {
+			t.Errorf("%s: expected channels %v, got %v", step.name, step.channels, client.Channels)
+		}
+		if keys := subscribedKeys(client.SessionID); !slices.Equal(keys, step.keys) {
+			t.Errorf("%s: expected subscriptions %v, got %v", step.name, step.keys, keys)
+		}
+	}
+
+	err := client.unsubscribe(1, globals.ChannelTypeChannel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.FocusedChannelID != 0 || !slices.Equal(subscribedKeys(client.SessionID), []string{"channel_activity:4", "channel_activity:5"}) {
+		t.Errorf("unsubscribing the focused channel left %v", subscribedKeys(client.SessionID))
+	}
+}
+
+func TestSingleChannelSubscription(t *testing.T) {
+	sugar = zap.NewNop().Sugar()
+	useRedis = false
+	localPubSub.Setup()
+	maxChannelSubscriptions = 1
+
+	client := &Client{SessionID: 1}
+
+	for _, channelID := range []int64{1, 2} {
+		err := client.subscribe(channelID, globals.ChannelTypeChannel)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// with a limit of one, the previously focused channel goes as soon as another is focused
+	if !slices.Equal(client.Channels, []int64{2}) || !slices.Equal(subscribedKeys(client.SessionID), []string{"channel:2"}) {
+		t.Errorf("expected only the focused channel, got %v and %v", client.Channels, subscribedKeys(client.SessionID))
+	}
+}
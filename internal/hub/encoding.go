@@ -0,0 +1,157 @@
+package hub
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	EncodingJson    = "json"
+	EncodingMsgpack = "msgpack"
+)
+
+// encodingFromRequest picks the encoding the client asked for, query parameter takes priority over subprotocol
+func encodingFromRequest(r *http.Request, subprotocol string) (string, error) {
+	encoding := r.URL.Query().Get("encoding")
+	if encoding == "" {
+		encoding = subprotocol
+	}
+
+	switch encoding {
+	case "", EncodingJson:
+		return EncodingJson, nil
+	case EncodingMsgpack:
+		return EncodingMsgpack, nil
+	default:
+		return "", fmt.Errorf("unknown encoding [%s]", encoding)
+	}
+}
+
+// encodeEvent encodes the event in every supported format at once, so it only needs to be done once
+// per event instead of once per client. The first 4 bytes are the length of the json frame,
+// followed by the json frame, then the msgpack frame.
+func encodeEvent(messageType string, message any) (string, error) {
+	jsonBytes, err := json.Marshal(message)
+	if err != nil {
+		return "", err
+	}
+
+	// msgpack is made from the json representation, so both formats look the same,
+	// including int64 IDs that are sent as strings
+	decoder := json.NewDecoder(bytes.NewReader(jsonBytes))
+	decoder.UseNumber()
+
+	var generic any
+	err = decoder.Decode(&generic)
+	if err != nil {
+		return "", err
+	}
+
+	generic, err = convertNumbers(generic)
+	if err != nil {
+		return "", err
+	}
+
+	msgpackBytes, err := msgpack.Marshal([]any{messageType, generic})
+	if err != nil {
+		return "", err
+	}
+
+	msgTypeStr := fmt.Sprintf("%s\n", messageType)
+	jsonFrameLength := len(msgTypeStr) + len(jsonBytes)
+
+	var buf bytes.Buffer
+	buf.Grow(4 + jsonFrameLength + len(msgpackBytes))
+
+	err = binary.Write(&buf, binary.BigEndian, uint32(jsonFrameLength))
+	if err != nil {
+		return "", err
+	}
+	_, err = buf.WriteString(msgTypeStr)
+	if err != nil {
+		return "", err
+	}
+	_, err = buf.Write(jsonBytes)
+	if err != nil {
+		return "", err
+	}
+	_, err = buf.Write(msgpackBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// decodeEvent returns the websocket message type and frame of the event in the given encoding
+func decodeEvent(payload string, encoding string) (int, []byte, error) {
+	if len(payload) < 4 {
+		return 0, nil, fmt.Errorf("event payload is too short: %d bytes", len(payload))
+	}
+
+	jsonFrameLength := int(binary.BigEndian.Uint32([]byte(payload[:4])))
+	if len(payload) < 4+jsonFrameLength {
+		return 0, nil, fmt.Errorf("event payload is %d bytes but json frame is supposed to be %d bytes", len(payload), jsonFrameLength)
+	}
+
+	switch encoding {
+	case EncodingMsgpack:
+		return websocket.BinaryMessage, []byte(payload[4+jsonFrameLength:]), nil
+	default:
+		return websocket.TextMessage, []byte(payload[4 : 4+jsonFrameLength]), nil
+	}
+}
+
+// eventType returns the type of the event without decoding it
+func eventType(payload string) (string, error) {
+	_, frame, err := decodeEvent(payload, EncodingJson)
+	if err != nil {
+		return "", err
+	}
+
+	eventType, _, found := strings.Cut(string(frame), "\n")
+	if !found {
+		return "", fmt.Errorf("event has no type: %s", frame)
+	}
+
+	return eventType, nil
+}
+
+// convertNumbers turns json.Number values back into int64 or float64
+func convertNumbers(value any) (any, error) {
+	switch v := value.(type) {
+	case json.Number:
+		integer, err := v.Int64()
+		if err == nil {
+			return integer, nil
+		}
+		return v.Float64()
+	case map[string]any:
+		for key, item := range v {
+			converted, err := convertNumbers(item)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = converted
+		}
+		return v, nil
+	case []any:
+		for i, item := range v {
+			converted, err := convertNumbers(item)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = converted
+		}
+		return v, nil
+	default:
+		return v, nil
+	}
+}
@@ -0,0 +1,80 @@
+package hub
+
+import (
+	"chatapp-backend/internal/models"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestEncodeEvent(t *testing.T) {
+	msg := models.Message{
+		ID:        1229874653212475392,
+		ChannelID: 1229874653212475393,
+		UserID:    1229874653212475394,
+		Message:   "hello",
+		Edited:    true,
+	}
+
+	payload, err := encodeEvent(MessageCreated, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("json", func(t *testing.T) {
+		messageType, frame, err := decodeEvent(payload, EncodingJson)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if messageType != websocket.TextMessage {
+			t.Errorf("expected text message, got %d", messageType)
+		}
+
+		eventType, data, found := strings.Cut(string(frame), "\n")
+		if !found || eventType != MessageCreated {
+			t.Fatalf("unexpected frame: %s", frame)
+		}
+
+		var decoded models.Message
+		err = json.Unmarshal([]byte(data), &decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.ID != msg.ID || decoded.Message != msg.Message || decoded.Edited != msg.Edited {
+			t.Errorf("expected %+v, got %+v", msg, decoded)
+		}
+	})
+
+	t.Run("msgpack", func(t *testing.T) {
+		messageType, frame, err := decodeEvent(payload, EncodingMsgpack)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if messageType != websocket.BinaryMessage {
+			t.Errorf("expected binary message, got %d", messageType)
+		}
+
+		var decoded []any
+		err = msgpack.Unmarshal(frame, &decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(decoded) != 2 || decoded[0] != MessageCreated {
+			t.Fatalf("unexpected frame: %v", decoded)
+		}
+
+		data, ok := decoded[1].(map[string]any)
+		if !ok {
+			t.Fatalf("expected map, got %T", decoded[1])
+		}
+		if data["id"] != "1229874653212475392" {
+			t.Errorf("expected ID to be sent as string like in json, got %#v", data["id"])
+		}
+		if data["edited"] != true {
+			t.Errorf("expected edited to be true, got %#v", data["edited"])
+		}
+	})
+}
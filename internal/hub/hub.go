@@ -1,21 +1,29 @@
 package hub
 
 import (
+	"chatapp-backend/internal/globals"
+	"chatapp-backend/internal/models"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
-	"strconv"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/redis/go-redis/v9"
+	"github.com/vmihailenco/msgpack/v5"
 	"go.uber.org/zap"
 )
 
 const (
 	ServerDeleted  = "ServerDeleted"
 	ServerModified = "ServerModified"
+	ServerJoined   = "ServerJoined"
+	ServerRemoved  = "ServerRemoved"
+
+	UserModified = "UserModified"
 
 	ChannelCreated  = "ChannelCreated"
 	ChannelDeleted  = "ChannelDeleted"
@@ -24,6 +32,20 @@ const (
 	MessageCreated  = "MessageCreated"
 	MessageDeleted  = "MessageDeleted"
 	MessageModified = "MessageModified"
+
+	ChannelActivity = "ChannelActivity"
+
+	MemberJoined = "MemberJoined"
+	MemberLeft   = "MemberLeft"
+
+	InteractionCreated = "InteractionCreated"
+
+	DirectChannelCreated  = "DirectChannelCreated"
+	DirectChannelModified = "DirectChannelModified"
+	DirectChannelRemoved  = "DirectChannelRemoved"
+
+	RelationshipModified = "RelationshipModified"
+	RelationshipRemoved  = "RelationshipRemoved"
 )
 
 const (
@@ -31,93 +53,335 @@ const (
 	pingInterval   = 60 * time.Second
 	pongWaitTime   = pingInterval * 11 / 10
 	maxMessageSize = 8192
+	// how long a client authenticating with its first frame has to send it
+	identifyTimeout = 10 * time.Second
 )
 
+const (
+	TransportWebSocket = "websocket"
+	TransportSSE       = "sse"
+	TransportLongPoll  = "long_poll"
+)
+
+var errShuttingDown = errors.New("hub is shutting down")
+
 type Client struct {
 	UserID           int64
-	Conn             *websocket.Conn
+	Transport        string
+	Conn             *websocket.Conn // only set when using websocket transport
 	SessionID        int64
+	LoginSessionID   int64 // login the connection was authenticated with
+	IP               string
+	Encoding         string
 	CurrentServerID  int64
-	CurrentChannelID int64
+	FocusedChannelID int64
+	Channels         []int64 // subscribed channel IDs, least recently focused first
+	Mutex            sync.Mutex
 	PubSub           *redis.PubSub
-	LocalChannel     chan string
+	Events           chan string
 	Ctx              context.Context
 	CtxCancel        context.CancelFunc
 	PingTimer        *time.Ticker
+	CloseCode        int
+	CloseReason      string
+	LastPoll         time.Time       // only used by long polling transport
+	Polling          bool            // only used by long polling transport, if a poll is waiting for events
+	AllowedEvents    map[string]bool // events allowed by the intents of the client, nil allows everything
 }
 
 var clients = make(map[int64]*Client)
+
+// admittedClients are the clients that were admitted but haven't been set yet, they count towards the session limits
+var admittedClients = make(map[int64]*Client)
 var clientsMutex sync.RWMutex
+var clientsWaitGroup sync.WaitGroup
+var shuttingDown bool
 
 var sugar *zap.SugaredLogger
 var redisClient *redis.Client
 var localPubSub LocalPubSub
 var useRedis bool
+var maxChannelSubscriptions int
+var nodeID int64
+var allowedOrigins []string
+var maxSessionsPerUser int
+var maxSessionsPerIP int
 
 var redisCtx = context.Background()
 
-func Setup(_sugar *zap.SugaredLogger, _redisClient *redis.Client, _useRedis bool) {
+func Setup(_sugar *zap.SugaredLogger, _redisClient *redis.Client, cfg *models.ConfigFile) {
 	sugar = _sugar
 	redisClient = _redisClient
-	useRedis = _useRedis
+	useRedis = cfg.UseRedis
+	maxChannelSubscriptions = cfg.MaxChannelSubscriptions
+	nodeID = cfg.SnowflakeWorkerID
+	allowedOrigins = cfg.AllowedOrigins
+	maxSessionsPerUser = cfg.MaxSessionsPerUser
+	maxSessionsPerIP = cfg.MaxSessionsPerIP
 
 	localPubSub.Setup()
+
+	if useRedis {
+		go listenForCommands()
+	}
+}
+
+// admitClient decides if the client is allowed to connect, if it is,
+// connectClient and deleteClient must be called once the connection ends
+func admitClient(client *Client) error {
+	if useRedis {
+		err := reserveSession(client)
+		if err != nil {
+			return err
+		}
+	}
+
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+
+	if shuttingDown {
+		// the record belongs to the previous connection of the session if it's still here
+		if _, connected := clients[client.SessionID]; useRedis && !connected {
+			err := unregisterSession(client)
+			if err != nil {
+				sugar.Error(err)
+			}
+		}
+		return errShuttingDown
+	}
+
+	if !useRedis {
+		err := checkLocalSessionLimits(client)
+		if err != nil {
+			return err
+		}
+		admittedClients[client.SessionID] = client
+	}
+	clientsWaitGroup.Add(1)
+
+	return nil
+}
+
+// connectClient registers the client on this node and subscribes it to its user
+func connectClient(client *Client) error {
+	client.Events = make(chan string, 100)
+	client.PingTimer = time.NewTicker(15 * time.Second)
+	client.Ctx, client.CtxCancel = context.WithCancel(context.Background())
+
+	if useRedis {
+		client.PubSub = redisClient.Subscribe(client.Ctx)
+
+		// redis messages are forwarded so every transport only has to listen to one channel
+		go func() {
+			for msg := range client.PubSub.Channel() {
+				payload, ok := client.receives(msg.Payload)
+				if !ok {
+					continue
+				}
+
+				select {
+				case client.Events <- payload:
+				case <-client.Ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	setClient(client.SessionID, client)
+
+	err := registerSession(client)
+	if err != nil {
+		return err
+	}
+
+	// every session listens to events targeting its user, like changes made on other devices
+	return client.subscribe(client.UserID, globals.ChannelTypeUser)
+}
+
+// Identity is who a connection belongs to
+type Identity struct {
+	UserID         int64
+	SessionID      int64
+	LoginSessionID int64
+}
+
+// Authenticator checks the credentials a client sent in its first frame,
+// rejected credentials must be reported by wrapping ErrAuthenticationFailed
+type Authenticator func(token string, sessionToken string) (Identity, error)
+
+var ErrAuthenticationFailed = errors.New("authentication failed")
+
+// identifyFrame is the first frame of clients that couldn't send credentials with the upgrade request
+type identifyFrame struct {
+	Token   string `json:"token" msgpack:"token"`
+	Session string `json:"session" msgpack:"session"`
+	// replaces the intents of the upgrade request if set
+	Intents string `json:"intents" msgpack:"intents"`
 }
 
-func HandleClient(w http.ResponseWriter, r *http.Request, userID int64) {
+// HandleClient connects a client that was already authenticated by the upgrade request
+func HandleClient(w http.ResponseWriter, r *http.Request, userID int64, sessionID int64, loginSessionID int64) {
 	sugar.Debugf("Connecting user ID [%d] to WebSocket", userID)
 
-	sessionCookie, err := r.Cookie("session")
+	client, ok := upgradeClient(w, r)
+	if !ok {
+		return
+	}
+
+	client.UserID = userID
+	client.SessionID = sessionID
+	client.LoginSessionID = loginSessionID
+
+	serveClient(client)
+}
+
+// HandleUnauthenticatedClient connects a client that sends its credentials in the first frame,
+// for clients that can neither set headers nor cookies
+func HandleUnauthenticatedClient(w http.ResponseWriter, r *http.Request, authenticate Authenticator) {
+	client, ok := upgradeClient(w, r)
+	if !ok {
+		return
+	}
+
+	identity, err := identify(client, authenticate)
 	if err != nil {
-		sugar.Debug(err)
-		switch {
-		case errors.Is(err, http.ErrNoCookie):
-			http.Error(w, "No session cookie was provided", http.StatusUnauthorized)
-		default:
-			http.Error(w, "Couldn't read session cookie", http.StatusInternalServerError)
+		if errors.Is(err, ErrAuthenticationFailed) {
+			sugar.Debug(err)
+			writeCloseFrame(client.Conn, CloseCodeAuthenticationFailed, "authentication_failed")
+		} else {
+			sugar.Error(err)
+			writeCloseFrame(client.Conn, websocket.CloseInternalServerErr, "")
+		}
+		err = client.Conn.Close()
+		if err != nil {
+			sugar.Error(err)
 		}
 		return
 	}
 
-	sessionID, err := strconv.ParseInt(sessionCookie.Value, 10, 64)
+	sugar.Debugf("Connecting user ID [%d] to WebSocket after first frame authentication", identity.UserID)
+
+	client.UserID = identity.UserID
+	client.SessionID = identity.SessionID
+	client.LoginSessionID = identity.LoginSessionID
+
+	serveClient(client)
+}
+
+// identify reads the credentials from the first frame, which is in the encoding the client asked for
+func identify(client *Client, authenticate Authenticator) (Identity, error) {
+	client.Conn.SetReadLimit(maxMessageSize)
+	err := client.Conn.SetReadDeadline(time.Now().Add(identifyTimeout))
 	if err != nil {
-		sugar.Error(err)
-		http.Error(w, "Session cookie is in improper format", http.StatusBadRequest)
-		return
+		return Identity{}, err
+	}
+
+	messageType, data, err := client.Conn.ReadMessage()
+	if err != nil {
+		return Identity{}, fmt.Errorf("%w: couldn't read first frame: %w", ErrAuthenticationFailed, err)
+	}
+
+	var frame identifyFrame
+	if messageType == websocket.BinaryMessage {
+		err = msgpack.Unmarshal(data, &frame)
+	} else {
+		err = json.Unmarshal(data, &frame)
+	}
+	if err != nil {
+		return Identity{}, fmt.Errorf("%w: malformed first frame: %w", ErrAuthenticationFailed, err)
+	}
+
+	if frame.Intents != "" {
+		client.AllowedEvents, err = parseIntents(frame.Intents)
+		if err != nil {
+			return Identity{}, fmt.Errorf("%w: %w", ErrAuthenticationFailed, err)
+		}
+	}
+
+	return authenticate(frame.Token, frame.Session)
+}
+
+// upgradeClient makes the websocket connection, it writes the error response itself if it fails
+func upgradeClient(w http.ResponseWriter, r *http.Request) (*Client, bool) {
+	_, err := encodingFromRequest(r, "")
+	if err != nil {
+		sugar.Debug(err)
+		http.Error(w, "Unknown encoding", http.StatusBadRequest)
+		return nil, false
+	}
+
+	allowedEvents, err := parseIntents(r.URL.Query().Get("intents"))
+	if err != nil {
+		sugar.Debug(err)
+		http.Error(w, "Unknown intent", http.StatusBadRequest)
+		return nil, false
 	}
 
 	var upgrader = websocket.Upgrader{
 		ReadBufferSize:    4096,
 		WriteBufferSize:   4096,
 		EnableCompression: true,
+		Subprotocols:      []string{EncodingJson, EncodingMsgpack},
+	}
+
+	// without an allowlist the upgrader only accepts same origin requests
+	if len(allowedOrigins) != 0 {
+		upgrader.CheckOrigin = checkOrigin
 	}
 
 	client := &Client{
-		UserID:       userID,
-		SessionID:    sessionID,
-		LocalChannel: make(chan string, 100),
-		PingTimer:    time.NewTicker(15 * time.Second),
+		IP:            RemoteIP(r),
+		Transport:     TransportWebSocket,
+		AllowedEvents: allowedEvents,
 	}
 
+	// the upgrader already wrote the error response
 	client.Conn, err = upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		sugar.Debug(err)
+		return nil, false
+	}
+
+	client.Encoding, err = encodingFromRequest(r, client.Conn.Subprotocol())
 	if err != nil {
 		sugar.Error(err)
-		http.Error(w, "", http.StatusInternalServerError)
-		return
+		writeCloseFrame(client.Conn, websocket.CloseInternalServerErr, "")
+		err = client.Conn.Close()
+		if err != nil {
+			sugar.Error(err)
+		}
+		return nil, false
 	}
 
-	client.Ctx, client.CtxCancel = context.WithCancel(context.Background())
+	return client, true
+}
 
-	if useRedis {
-		client.PubSub = redisClient.Subscribe(client.Ctx)
+// serveClient runs the connection of an authenticated client until it ends
+func serveClient(client *Client) {
+	err := admitClient(client)
+	if err != nil {
+		switch {
+		case errors.Is(err, errShuttingDown):
+			writeCloseFrame(client.Conn, websocket.CloseServiceRestart, "reconnect")
+		case errors.Is(err, errTooManySessions):
+			writeCloseFrame(client.Conn, CloseCodeTooManySessions, "too_many_sessions")
+		default:
+			sugar.Error(err)
+			writeCloseFrame(client.Conn, websocket.CloseInternalServerErr, "")
+		}
+		err = client.Conn.Close()
+		if err != nil {
+			sugar.Error(err)
+		}
+		return
 	}
+	defer deleteClient(client)
 
-	setClient(sessionID, client)
-	defer deleteClient(sessionID)
-
-	var redisChannel <-chan *redis.Message
-	if client.PubSub != nil {
-		redisChannel = client.PubSub.Channel()
+	err = connectClient(client)
+	if err != nil {
+		sugar.Error(err)
+		return
 	}
 
 	// handling incoming messages from client
@@ -157,39 +421,30 @@ func HandleClient(w http.ResponseWriter, r *http.Request, userID int64) {
 		select {
 		case <-client.Ctx.Done():
 			return
-		case msg, ok := <-redisChannel:
-			if client.PubSub == nil || client.Conn == nil || !ok {
+		case msg := <-client.Events:
+			if client.Conn == nil {
 				return
 			}
-			err := client.Conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err != nil {
-				return
+			if !client.wantsEvent(msg) {
+				continue
 			}
-			err = client.Conn.WriteMessage(websocket.TextMessage, []byte(msg.Payload))
+			err := client.write(msg)
 			if err != nil {
 				sugar.Error(err)
 				return
 			}
-		case msg, ok := <-client.LocalChannel:
-			if client.Conn == nil || !ok {
-				return
-			}
-			err := client.Conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err != nil {
-				sugar.Error(err)
+		case <-client.PingTimer.C:
+			if client.Conn == nil {
 				return
 			}
-			err = client.Conn.WriteMessage(websocket.TextMessage, []byte(msg))
+
+			err := refreshSession(client)
 			if err != nil {
 				sugar.Error(err)
 				return
 			}
-		case <-client.PingTimer.C:
-			if client.Conn == nil {
-				return
-			}
 
-			err := client.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			err = client.Conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if err != nil {
 				sugar.Error(err)
 				return
@@ -203,20 +458,60 @@ func HandleClient(w http.ResponseWriter, r *http.Request, userID int64) {
 	}
 }
 
+// write sends the event to the client in the encoding it asked for
+func (client *Client) write(payload string) error {
+	messageType, frame, err := decodeEvent(payload, client.Encoding)
+	if err != nil {
+		return err
+	}
+
+	err = client.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if err != nil {
+		return err
+	}
+
+	return client.Conn.WriteMessage(messageType, frame)
+}
+
 func setClient(sessionID int64, client *Client) {
-	sugar.Debugf("Adding user ID [%d] to clients as session ID [%d]", client.UserID, sessionID)
+	sugar.Debugf("Adding user ID [%d] to clients as session ID [%d] using %s", client.UserID, sessionID, client.Transport)
 
 	clientsMutex.Lock()
 	clients[sessionID] = client
+	if admittedClients[sessionID] == client {
+		delete(admittedClients, sessionID)
+	}
+	// a client admitted right before the shutdown started was missed by it, so it's told to reconnect here
+	closing := shuttingDown
 	clientsMutex.Unlock()
+
+	if closing {
+		disconnect(client, websocket.CloseServiceRestart, "reconnect")
+	}
 }
 
-func deleteClient(sessionID int64) {
-	sugar.Debugf("Removing Session ID [%d] from clients", sessionID)
+func deleteClient(client *Client) {
+	sugar.Debugf("Removing Session ID [%d] from clients", client.SessionID)
+	defer clientsWaitGroup.Done()
 
-	client, exists := GetClient(sessionID)
-	if !exists {
-		return
+	clientsMutex.Lock()
+	// the session might have reconnected in the meantime
+	replaced := clients[client.SessionID] != client
+	if !replaced {
+		delete(clients, client.SessionID)
+	}
+	// connecting failed before it was set
+	if admittedClients[client.SessionID] == client {
+		delete(admittedClients, client.SessionID)
+	}
+	clientsMutex.Unlock()
+
+	_, stillConnected := GetClient(client.SessionID)
+	if !stillConnected {
+		err := unregisterSession(client)
+		if err != nil {
+			sugar.Error(err)
+		}
 	}
 
 	if useRedis {
@@ -228,23 +523,20 @@ func deleteClient(sessionID int64) {
 		if err != nil {
 			sugar.Error(err)
 		}
-	} else {
-		localPubSub.UnsubscribeFromAll(sessionID)
+	} else if !replaced {
+		// local subscriptions are by session ID, so the ones of the client that replaced this one would go too
+		localPubSub.UnsubscribeFromAll(client.SessionID)
 	}
 
 	client.CtxCancel()
 	client.PingTimer.Stop()
-	close(client.LocalChannel)
 
-	err := client.Conn.Close()
-	if err != nil {
-		sugar.Error(err)
+	if client.Conn != nil {
+		err := client.Conn.Close()
+		if err != nil {
+			sugar.Error(err)
+		}
 	}
-
-	clientsMutex.Lock()
-	delete(clients, sessionID)
-	clientsMutex.Unlock()
-
 }
 
 func GetClient(sessionID int64) (*Client, bool) {
@@ -256,14 +548,45 @@ func GetClient(sessionID int64) (*Client, bool) {
 }
 
 func GetUserID(sessionID int64) int64 {
-	clientsMutex.RLock()
-	defer clientsMutex.RUnlock()
-
-	client, exists := clients[sessionID]
+	info, exists, err := GetSession(sessionID)
+	if err != nil {
+		sugar.Error(err)
+		return 0
+	}
 
 	if exists {
-		return client.UserID
+		return info.UserID
 	} else {
 		return 0
 	}
 }
+
+// Shutdown rejects new connections and tells every connected client to reconnect to a different node,
+// then waits until all of them are disconnected or the context is done
+func Shutdown(ctx context.Context) error {
+	clientsMutex.Lock()
+	shuttingDown = true
+	toClose := make([]*Client, 0, len(clients))
+	for _, client := range clients {
+		toClose = append(toClose, client)
+	}
+	clientsMutex.Unlock()
+
+	sugar.Infof("Closing %d client connections...", len(toClose))
+	for _, client := range toClose {
+		disconnect(client, websocket.CloseServiceRestart, "reconnect")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		clientsWaitGroup.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,66 @@
+package hub
+
+import (
+	"fmt"
+	"strings"
+)
+
+// intents let websocket clients choose which groups of events they want to receive, mostly useful for bots
+// that only care about a few events, without any intents every event is sent
+const (
+	IntentServers        = "servers"
+	IntentChannels       = "channels"
+	IntentMessages       = "messages"
+	IntentUsers          = "users"
+	IntentMembers        = "members"
+	IntentInteractions   = "interactions"
+	IntentDirectChannels = "direct_channels"
+	IntentRelationships  = "relationships"
+)
+
+var intentEvents = map[string][]string{
+	IntentServers:        {ServerDeleted, ServerModified, ServerJoined, ServerRemoved},
+	IntentChannels:       {ChannelCreated, ChannelDeleted, ChannelModified},
+	IntentMessages:       {MessageCreated, MessageDeleted, MessageModified, ChannelActivity},
+	IntentUsers:          {UserModified},
+	IntentMembers:        {MemberJoined, MemberLeft},
+	IntentInteractions:   {InteractionCreated},
+	IntentDirectChannels: {DirectChannelCreated, DirectChannelModified, DirectChannelRemoved},
+	IntentRelationships:  {RelationshipModified, RelationshipRemoved},
+}
+
+// parseIntents turns the comma separated list of intents into the set of events they allow,
+// nil means every event is allowed
+func parseIntents(intents string) (map[string]bool, error) {
+	if intents == "" {
+		return nil, nil
+	}
+
+	events := make(map[string]bool)
+	for _, intent := range strings.Split(intents, ",") {
+		eventTypes, exists := intentEvents[strings.TrimSpace(intent)]
+		if !exists {
+			return nil, fmt.Errorf("unknown intent [%s]", intent)
+		}
+		for _, eventType := range eventTypes {
+			events[eventType] = true
+		}
+	}
+
+	return events, nil
+}
+
+// wantsEvent reports if the event is allowed by the intents of the client
+func (client *Client) wantsEvent(payload string) bool {
+	if client.AllowedEvents == nil {
+		return true
+	}
+
+	eventType, err := eventType(payload)
+	if err != nil {
+		sugar.Error(err)
+		return true
+	}
+
+	return client.AllowedEvents[eventType]
+}
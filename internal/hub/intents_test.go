@@ -0,0 +1,48 @@
+package hub
+
+import (
+	"testing"
+)
+
+func TestIntents(t *testing.T) {
+	messageEvent, err := encodeEvent(MessageCreated, map[string]string{"message": "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverEvent, err := encodeEvent(ServerJoined, map[string]string{"name": "server"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		intents       string
+		wantsMessages bool
+		wantsServers  bool
+	}{
+		{"", true, true},
+		{IntentMessages, true, false},
+		{IntentServers, false, true},
+		{IntentMessages + "," + IntentServers, true, true},
+		{IntentUsers, false, false},
+	}
+
+	for _, test := range tests {
+		allowedEvents, err := parseIntents(test.intents)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &Client{AllowedEvents: allowedEvents}
+
+		if client.wantsEvent(messageEvent) != test.wantsMessages {
+			t.Errorf("intents [%s]: expected wanting message events to be %v", test.intents, test.wantsMessages)
+		}
+		if client.wantsEvent(serverEvent) != test.wantsServers {
+			t.Errorf("intents [%s]: expected wanting server events to be %v", test.intents, test.wantsServers)
+		}
+	}
+
+	_, err = parseIntents("messages,typing")
+	if err == nil {
+		t.Error("expected error for unknown intent")
+	}
+}
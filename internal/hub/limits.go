@@ -0,0 +1,144 @@
+package hub
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// close codes sent to websocket clients, so they can show why they got disconnected
+const (
+	CloseCodeDisconnected         = 4001
+	CloseCodeAuthenticationFailed = 4004
+	CloseCodeTooManySessions      = 4008
+)
+
+var errTooManySessions = errors.New("too many sessions")
+
+// checkOrigin allows requests without an origin header, since those don't come from browsers
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	if !slices.Contains(allowedOrigins, origin) {
+		sugar.Warnf("Rejected connection to %s from origin [%s] that isn't allowed", r.URL.Path, origin)
+		return false
+	}
+
+	return true
+}
+
+// originAllowed is used by transports that don't go through the websocket upgrader
+func originAllowed(r *http.Request) bool {
+	if len(allowedOrigins) == 0 {
+		return true
+	}
+
+	return checkOrigin(r)
+}
+
+// RemoteIP is the address the request came from, without the port
+func RemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// reserveSessionScript counts the sessions of the user and the IP that still have a record, the session itself
+// reconnecting isn't counted, and registers the session in the same step if neither is at its limit.
+// returns 1 if the user is at the limit, 2 if the IP is, 0 if the session was registered
+var reserveSessionScript = redis.NewScript(`
+	local function count(set, limit)
+		if limit <= 0 then
+			return false
+		end
+		local n = 0
+		for _, member in ipairs(redis.call('SMEMBERS', set)) do
+			-- same key as sessionKey
+			if member ~= ARGV[1] and redis.call('EXISTS', 'hub_session:' .. member) == 1 then
+				n = n + 1
+			end
+		end
+		return n >= limit
+	end
+
+	if count(KEYS[1], tonumber(ARGV[4])) then
+		return 1
+	end
+	if count(KEYS[2], tonumber(ARGV[5])) then
+		return 2
+	end
+
+	redis.call('SET', KEYS[3], ARGV[2], 'PX', ARGV[3])
+	redis.call('SADD', KEYS[1], ARGV[1])
+	redis.call('PEXPIRE', KEYS[1], ARGV[3])
+	redis.call('SADD', KEYS[2], ARGV[1])
+	redis.call('PEXPIRE', KEYS[2], ARGV[3])
+	return 0
+`)
+
+// reserveSession registers the session in redis if the user and the IP of the client are below their limits,
+// checking and registering at once so concurrent connections can't all pass the check
+func reserveSession(client *Client) error {
+	result, err := reserveSessionScript.Run(redisCtx, redisClient,
+		[]string{userSessionsKey(client.UserID), ipSessionsKey(client.IP), sessionKey(client.SessionID)},
+		client.SessionID, sessionValue(client), sessionRecordTTL.Milliseconds(), maxSessionsPerUser, maxSessionsPerIP,
+	).Int()
+	if err != nil {
+		return err
+	}
+
+	return sessionLimitResult(client, result)
+}
+
+// checkLocalSessionLimits counts the connected and the admitted clients of the user and the IP,
+// clientsMutex must be locked so the client can be admitted in the same step
+func checkLocalSessionLimits(client *Client) error {
+	userSessions, ipSessions := 0, 0
+	count := func(sessionID int64, other *Client) {
+		if sessionID == client.SessionID {
+			return
+		}
+		if other.UserID == client.UserID {
+			userSessions++
+		}
+		if other.IP == client.IP {
+			ipSessions++
+		}
+	}
+
+	for sessionID, other := range clients {
+		count(sessionID, other)
+	}
+	for sessionID, other := range admittedClients {
+		count(sessionID, other)
+	}
+
+	switch {
+	case maxSessionsPerUser > 0 && userSessions >= maxSessionsPerUser:
+		return sessionLimitResult(client, 1)
+	case maxSessionsPerIP > 0 && ipSessions >= maxSessionsPerIP:
+		return sessionLimitResult(client, 2)
+	}
+	return nil
+}
+
+// sessionLimitResult turns what reserveSessionScript returned into errTooManySessions
+func sessionLimitResult(client *Client, result int) error {
+	switch result {
+	case 1:
+		sugar.Warnf("User ID [%d] tried to open more than %d sessions, rejecting session ID [%d]", client.UserID, maxSessionsPerUser, client.SessionID)
+		return errTooManySessions
+	case 2:
+		sugar.Warnf("IP [%s] tried to open more than %d sessions, rejecting session ID [%d] of user ID [%d]", client.IP, maxSessionsPerIP, client.SessionID, client.UserID)
+		return errTooManySessions
+	}
+	return nil
+}
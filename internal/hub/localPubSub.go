@@ -17,6 +17,11 @@ func (ps *LocalPubSub) Unsubscribe(channel string, sessionID int64) {
 	ps.mutex.Lock()
 	defer ps.mutex.Unlock()
 
+	ps.unsubscribe(channel, sessionID)
+}
+
+// unsubscribe expects the mutex to be locked
+func (ps *LocalPubSub) unsubscribe(channel string, sessionID int64) {
 	sessionIDs := ps.hashMap[channel]
 
 	// this won't run in case channel doesn't exist since length will be 0
@@ -35,8 +40,11 @@ func (ps *LocalPubSub) Unsubscribe(channel string, sessionID int64) {
 }
 
 func (ps *LocalPubSub) UnsubscribeFromAll(sessionID int64) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
 	for key := range ps.hashMap {
-		ps.Unsubscribe(key, sessionID)
+		ps.unsubscribe(key, sessionID)
 	}
 }
 
@@ -55,7 +63,17 @@ func (ps *LocalPubSub) Publish(channel string, message string) {
 	for i := range sessionIDs {
 		client, exists := GetClient(sessionIDs[i])
 		if exists {
-			client.LocalChannel <- message
+			payload, ok := client.receives(message)
+			if !ok {
+				continue
+			}
+
+			// don't let a slow client, or a long polling one that stopped polling, block everyone else
+			select {
+			case client.Events <- payload:
+			default:
+				sugar.Warnf("Session ID %d has too many pending events, dropping event", sessionIDs[i])
+			}
 		} else {
 			sugar.Warnf("Session ID %d is supposed to be available", sessionIDs[i])
 		}
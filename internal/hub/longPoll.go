@@ -0,0 +1,199 @@
+package hub
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	longPollTimeout     = 25 * time.Second
+	longPollIdleTimeout = 60 * time.Second
+)
+
+// longPollMutex makes finding or creating the client of a session one step,
+// so concurrent first polls of a session don't both create one
+var longPollMutex sync.Mutex
+
+type longPollEvent struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+type longPollClosed struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// HandleLongPoll returns the events of the session that arrived since the last poll,
+// or waits for new ones. The session is kept in hub between polls, and is removed
+// if the client doesn't poll for a while.
+func HandleLongPoll(w http.ResponseWriter, r *http.Request, userID int64, sessionID int64, loginSessionID int64) {
+	if !originAllowed(r) {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	client, ok := getLongPollClient(w, r, userID, sessionID, loginSessionID)
+	if !ok {
+		return
+	}
+
+	// events are taken from the channel by the poll, a second one at the same time would get part of them
+	client.Mutex.Lock()
+	if client.Polling {
+		client.Mutex.Unlock()
+		http.Error(w, "Session is already polling", http.StatusConflict)
+		return
+	}
+	client.Polling = true
+	client.LastPoll = time.Now()
+	client.Mutex.Unlock()
+
+	defer func() {
+		client.Mutex.Lock()
+		client.Polling = false
+		client.LastPoll = time.Now()
+		client.Mutex.Unlock()
+	}()
+
+	timer := time.NewTimer(longPollTimeout)
+	defer timer.Stop()
+
+	events := []longPollEvent{}
+
+	// wait for the first event, then return it together with everything else that's pending
+	select {
+	case <-r.Context().Done():
+		return
+	case <-timer.C:
+	case <-client.Ctx.Done():
+		client.Mutex.Lock()
+		closed := longPollClosed{Code: client.CloseCode, Reason: client.CloseReason}
+		client.Mutex.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusGone)
+		err := json.NewEncoder(w).Encode(closed)
+		if err != nil {
+			sugar.Error(err)
+		}
+		return
+	case msg := <-client.Events:
+		event, err := toLongPollEvent(msg)
+		if err != nil {
+			sugar.Error(err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		events = append(events, event)
+
+	pending:
+		for {
+			select {
+			case msg := <-client.Events:
+				event, err := toLongPollEvent(msg)
+				if err != nil {
+					sugar.Error(err)
+					http.Error(w, "", http.StatusInternalServerError)
+					return
+				}
+				events = append(events, event)
+			default:
+				break pending
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(events)
+	if err != nil {
+		sugar.Error(err)
+		return
+	}
+}
+
+// getLongPollClient returns the client of the session, connecting it on its first poll,
+// it writes the error response itself if it fails
+func getLongPollClient(w http.ResponseWriter, r *http.Request, userID int64, sessionID int64, loginSessionID int64) (*Client, bool) {
+	longPollMutex.Lock()
+	defer longPollMutex.Unlock()
+
+	client, exists := GetClient(sessionID)
+	if exists {
+		if client.Transport != TransportLongPoll {
+			http.Error(w, "Session is connected using a different transport", http.StatusConflict)
+			return nil, false
+		}
+		return client, true
+	}
+
+	sugar.Debugf("Connecting user ID [%d] to long polling", userID)
+
+	client = &Client{
+		UserID:         userID,
+		SessionID:      sessionID,
+		LoginSessionID: loginSessionID,
+		IP:             RemoteIP(r),
+		Transport:      TransportLongPoll,
+		Encoding:       EncodingJson,
+		LastPoll:       time.Now(),
+	}
+
+	err := admitClient(client)
+	if err != nil {
+		rejectClient(w, err)
+		return nil, false
+	}
+
+	err = connectClient(client)
+	if err != nil {
+		sugar.Error(err)
+		deleteClient(client)
+		http.Error(w, "", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	go runLongPoll(client)
+
+	return client, true
+}
+
+func toLongPollEvent(payload string) (longPollEvent, error) {
+	_, frame, err := decodeEvent(payload, EncodingJson)
+	if err != nil {
+		return longPollEvent{}, err
+	}
+
+	eventType, data, _ := strings.Cut(string(frame), "\n")
+	return longPollEvent{Type: eventType, Data: json.RawMessage(data)}, nil
+}
+
+// runLongPoll keeps the long polling session alive between polls
+func runLongPoll(client *Client) {
+	defer deleteClient(client)
+
+	for {
+		select {
+		case <-client.Ctx.Done():
+			return
+		case <-client.PingTimer.C:
+			client.Mutex.Lock()
+			idle := time.Since(client.LastPoll)
+			client.Mutex.Unlock()
+
+			if idle > longPollIdleTimeout {
+				sugar.Debugf("Session ID [%d] stopped long polling", client.SessionID)
+				return
+			}
+
+			err := refreshSession(client)
+			if err != nil {
+				sugar.Error(err)
+				return
+			}
+		}
+	}
+}
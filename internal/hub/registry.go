@@ -0,0 +1,328 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+)
+
+// sessions are kept alive in redis by the node holding them, so if a node dies
+// its sessions disappear from the registry after this time
+const sessionRecordTTL = time.Minute
+
+const (
+	commandSubscribe   = "subscribe"
+	commandUnsubscribe = "unsubscribe"
+	commandDisconnect  = "disconnect"
+)
+
+type SessionInfo struct {
+	UserID         int64
+	NodeID         int64
+	LoginSessionID int64
+}
+
+// command is sent to the node holding a session when a request for it landed on a different node
+type command struct {
+	Op          string `json:"op"`
+	SessionID   int64  `json:"sessionID,string"`
+	ChannelType string `json:"channelType,omitempty"`
+	Channel     int64  `json:"channel,string,omitempty"`
+}
+
+func sessionKey(sessionID int64) string {
+	return fmt.Sprintf("hub_session:%d", sessionID)
+}
+
+func userSessionsKey(userID int64) string {
+	return fmt.Sprintf("hub_user_sessions:%d", userID)
+}
+
+func ipSessionsKey(ip string) string {
+	return fmt.Sprintf("hub_ip_sessions:%s", ip)
+}
+
+func nodeKey(nodeID int64) string {
+	return fmt.Sprintf("hub_node:%d", nodeID)
+}
+
+// sessionValue is what the session record holds, GetSession parses it
+func sessionValue(client *Client) string {
+	return fmt.Sprintf("%d:%d:%d", client.UserID, nodeID, client.LoginSessionID)
+}
+
+func registerSession(client *Client) error {
+	if !useRedis {
+		return nil
+	}
+
+	pipe := redisClient.TxPipeline()
+	pipe.Set(redisCtx, sessionKey(client.SessionID), sessionValue(client), sessionRecordTTL)
+	pipe.SAdd(redisCtx, userSessionsKey(client.UserID), client.SessionID)
+	pipe.Expire(redisCtx, userSessionsKey(client.UserID), sessionRecordTTL)
+	pipe.SAdd(redisCtx, ipSessionsKey(client.IP), client.SessionID)
+	pipe.Expire(redisCtx, ipSessionsKey(client.IP), sessionRecordTTL)
+	_, err := pipe.Exec(redisCtx)
+	return err
+}
+
+func refreshSession(client *Client) error {
+	if !useRedis {
+		return nil
+	}
+
+	pipe := redisClient.TxPipeline()
+	pipe.Expire(redisCtx, sessionKey(client.SessionID), sessionRecordTTL)
+	pipe.Expire(redisCtx, userSessionsKey(client.UserID), sessionRecordTTL)
+	pipe.Expire(redisCtx, ipSessionsKey(client.IP), sessionRecordTTL)
+	_, err := pipe.Exec(redisCtx)
+	return err
+}
+
+func unregisterSession(client *Client) error {
+	if !useRedis {
+		return nil
+	}
+
+	pipe := redisClient.TxPipeline()
+	pipe.Del(redisCtx, sessionKey(client.SessionID))
+	pipe.SRem(redisCtx, userSessionsKey(client.UserID), client.SessionID)
+	pipe.SRem(redisCtx, ipSessionsKey(client.IP), client.SessionID)
+	_, err := pipe.Exec(redisCtx)
+	return err
+}
+
+// GetSession returns which user owns the session and which node holds its connection
+func GetSession(sessionID int64) (SessionInfo, bool, error) {
+	client, exists := GetClient(sessionID)
+	if exists {
+		return SessionInfo{UserID: client.UserID, NodeID: nodeID, LoginSessionID: client.LoginSessionID}, true, nil
+	}
+
+	if !useRedis {
+		return SessionInfo{}, false, nil
+	}
+
+	value, err := redisClient.Get(redisCtx, sessionKey(sessionID)).Result()
+	if errors.Is(err, redis.Nil) {
+		return SessionInfo{}, false, nil
+	} else if err != nil {
+		return SessionInfo{}, false, err
+	}
+
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return SessionInfo{}, false, fmt.Errorf("session ID [%d] has malformed registry value [%s]", sessionID, value)
+	}
+
+	var info SessionInfo
+	info.UserID, err = strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return SessionInfo{}, false, err
+	}
+	info.NodeID, err = strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return SessionInfo{}, false, err
+	}
+	info.LoginSessionID, err = strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return SessionInfo{}, false, err
+	}
+
+	return info, true, nil
+}
+
+// GetUserSessions returns the IDs of every session of the user connected to any node
+func GetUserSessions(userID int64) ([]int64, error) {
+	return getSessionSet(userSessionsKey(userID), func(client *Client) bool {
+		return client.UserID == userID
+	})
+}
+
+// getSessionSet returns the sessions in the given redis set, or the local clients matching the filter
+// when redis isn't used
+func getSessionSet(key string, filter func(client *Client) bool) ([]int64, error) {
+	if !useRedis {
+		clientsMutex.RLock()
+		defer clientsMutex.RUnlock()
+
+		var sessionIDs []int64
+		for sessionID, client := range clients {
+			if filter(client) {
+				sessionIDs = append(sessionIDs, sessionID)
+			}
+		}
+		return sessionIDs, nil
+	}
+
+	members, err := redisClient.SMembers(redisCtx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var sessionIDs []int64
+	for _, member := range members {
+		sessionID, err := strconv.ParseInt(member, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		// the set may still contain sessions of a node that died
+		_, exists, err := GetSession(sessionID)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			err = redisClient.SRem(redisCtx, key, sessionID).Err()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		sessionIDs = append(sessionIDs, sessionID)
+	}
+
+	return sessionIDs, nil
+}
+
+// DisconnectSession closes the connection of the session, no matter which node holds it
+func DisconnectSession(sessionID int64) error {
+	client, exists := GetClient(sessionID)
+	if exists {
+		sugar.Debugf("Disconnecting session ID [%d]", sessionID)
+		disconnect(client, CloseCodeDisconnected, "session_disconnected")
+		return nil
+	}
+
+	return sendCommand(command{Op: commandDisconnect, SessionID: sessionID})
+}
+
+// DisconnectUser closes every connection of the user on every node
+func DisconnectUser(userID int64) error {
+	sessionIDs, err := GetUserSessions(userID)
+	if err != nil {
+		return err
+	}
+
+	for _, sessionID := range sessionIDs {
+		err = DisconnectSession(sessionID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DisconnectLoginSession closes every connection that was opened using the given login of the user
+func DisconnectLoginSession(userID int64, loginSessionID int64) error {
+	sessionIDs, err := GetUserSessions(userID)
+	if err != nil {
+		return err
+	}
+
+	for _, sessionID := range sessionIDs {
+		info, exists, err := GetSession(sessionID)
+		if err != nil {
+			return err
+		}
+		if !exists || info.LoginSessionID != loginSessionID {
+			continue
+		}
+
+		err = DisconnectSession(sessionID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// disconnect ends the connection of the client, the close code and reason are passed to the client
+// in a way specific to the transport it's using
+func disconnect(client *Client, closeCode int, reason string) {
+	client.Mutex.Lock()
+	client.CloseCode = closeCode
+	client.CloseReason = reason
+	client.Mutex.Unlock()
+
+	if client.Conn != nil {
+		writeCloseFrame(client.Conn, closeCode, reason)
+	}
+	client.CtxCancel()
+}
+
+func writeCloseFrame(conn *websocket.Conn, closeCode int, reason string) {
+	err := conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeCode, reason), time.Now().Add(writeWait))
+	if err != nil && !errors.Is(err, websocket.ErrCloseSent) {
+		sugar.Debug(err)
+	}
+}
+
+// sendCommand forwards the command to the node holding the session,
+// does nothing if the session isn't connected anywhere
+func sendCommand(cmd command) error {
+	info, exists, err := GetSession(cmd.SessionID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		sugar.Debugf("Session ID [%d] isn't connected to any node, dropping %s command", cmd.SessionID, cmd.Op)
+		return nil
+	}
+	if info.NodeID == nodeID {
+		return fmt.Errorf("session ID [%d] is registered on this node but isn't connected to it", cmd.SessionID)
+	}
+
+	jsonBytes, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+
+	sugar.Debugf("Forwarding %s command of session ID [%d] to node %d", cmd.Op, cmd.SessionID, info.NodeID)
+
+	return redisClient.Publish(redisCtx, nodeKey(info.NodeID), jsonBytes).Err()
+}
+
+// listenForCommands handles commands other nodes send about sessions connected to this one
+func listenForCommands() {
+	pubSub := redisClient.Subscribe(context.Background(), nodeKey(nodeID))
+
+	for msg := range pubSub.Channel() {
+		var cmd command
+		err := json.Unmarshal([]byte(msg.Payload), &cmd)
+		if err != nil {
+			sugar.Error(err)
+			continue
+		}
+
+		client, exists := GetClient(cmd.SessionID)
+		if !exists {
+			sugar.Debugf("Received %s command for session ID [%d] that isn't connected anymore", cmd.Op, cmd.SessionID)
+			continue
+		}
+
+		switch cmd.Op {
+		case commandSubscribe:
+			err = client.subscribe(cmd.Channel, cmd.ChannelType)
+		case commandUnsubscribe:
+			err = client.unsubscribe(cmd.Channel, cmd.ChannelType)
+		case commandDisconnect:
+			disconnect(client, CloseCodeDisconnected, "session_disconnected")
+		default:
+			err = fmt.Errorf("unknown hub command [%s]", cmd.Op)
+		}
+		if err != nil {
+			sugar.Error(err)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// HandleSSE streams events to the client using server-sent events,
+// for clients behind proxies that break websockets
+func HandleSSE(w http.ResponseWriter, r *http.Request, userID int64, sessionID int64, loginSessionID int64) {
+	sugar.Debugf("Connecting user ID [%d] to SSE", userID)
+
+	if !originAllowed(r) {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	client := &Client{
+		UserID:         userID,
+		SessionID:      sessionID,
+		LoginSessionID: loginSessionID,
+		IP:             RemoteIP(r),
+		Transport:      TransportSSE,
+		Encoding:       EncodingJson,
+	}
+
+	err := admitClient(client)
+	if err != nil {
+		rejectClient(w, err)
+		return
+	}
+	defer deleteClient(client)
+
+	err = connectClient(client)
+	if err != nil {
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	controller := http.NewResponseController(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	err = controller.Flush()
+	if err != nil {
+		sugar.Error(err)
+		return
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-client.Ctx.Done():
+			client.Mutex.Lock()
+			closeCode, closeReason := client.CloseCode, client.CloseReason
+			client.Mutex.Unlock()
+
+			if closeCode != 0 {
+				data := fmt.Sprintf(`{"code":%d,"reason":"%s"}`, closeCode, closeReason)
+				err := writeSSE(w, controller, "Close", data)
+				if err != nil {
+					sugar.Debug(err)
+				}
+			}
+			return
+		case msg := <-client.Events:
+			_, frame, err := decodeEvent(msg, EncodingJson)
+			if err != nil {
+				sugar.Error(err)
+				return
+			}
+
+			eventType, data, _ := strings.Cut(string(frame), "\n")
+			err = writeSSE(w, controller, eventType, data)
+			if err != nil {
+				sugar.Error(err)
+				return
+			}
+		case <-client.PingTimer.C:
+			err := refreshSession(client)
+			if err != nil {
+				sugar.Error(err)
+				return
+			}
+
+			// comment lines keep proxies from closing the idle connection
+			err = writeSSE(w, controller, "", "")
+			if err != nil {
+				sugar.Debug(err)
+				return
+			}
+		}
+	}
+}
+
+// rejectClient responds to transports that aren't upgraded to websocket when admitClient fails
+func rejectClient(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errShuttingDown):
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+	case errors.Is(err, errTooManySessions):
+		http.Error(w, "too_many_sessions", http.StatusTooManyRequests)
+	default:
+		sugar.Error(err)
+		http.Error(w, "", http.StatusInternalServerError)
+	}
+}
+
+func writeSSE(w http.ResponseWriter, controller *http.ResponseController, eventType string, data string) error {
+	err := controller.SetWriteDeadline(time.Now().Add(writeWait))
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+
+	if eventType == "" {
+		_, err = fmt.Fprint(w, ": ping\n\n")
+	} else {
+		_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventType, data)
+	}
+	if err != nil {
+		return err
+	}
+
+	return controller.Flush()
+}
@@ -8,41 +8,61 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
+const AccessTokenLifetime = 15 * time.Minute
+
 type UserToken struct {
 	UserID   int64 `json:"userID"`
-	Remember bool  `json:"rem"`
+	FamilyID int64 `json:"fam,string"` // refresh token family the token was issued from
 	jwt.RegisteredClaims
 }
 
-var jwtSecret []byte
+var keys map[string]*signingKey
+var activeKey *signingKey
 var isHttps bool
 
-func Setup(_key string, _isHttps bool) {
-	jwtSecret = []byte(_key)
+// Setup loads the signing keys from the keys file,
+// or uses the secret as the only key if no keys file is given
+func Setup(secret string, keysFile string, _isHttps bool) error {
 	isHttps = _isHttps
+
+	keyConfigs := []KeyConfig{{KeyID: legacyKeyID, Algorithm: jwt.SigningMethodHS512.Alg(), Secret: secret, Active: true}}
+	if keysFile != "" {
+		var err error
+		keyConfigs, err = readKeysFile(keysFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	var err error
+	keys, activeKey, err = loadKeys(keyConfigs)
+	return err
 }
 
-func CreateToken(rememberMe bool, userId int64) (http.Cookie, error) {
-	var tokenLifeTime time.Duration
+func RefreshTokenLifetime(rememberMe bool) time.Duration {
 	if rememberMe {
-		tokenLifeTime = time.Hour * 24 * 7 * 4 // 4 weeks
-	} else {
-		tokenLifeTime = time.Hour * 24 // 1 day
+		return time.Hour * 24 * 7 * 4 // 4 weeks
 	}
+	return time.Hour * 24 // 1 day
+}
 
+// CreateToken creates the short lived access token, it can be renewed using the refresh token of the family
+func CreateToken(userId int64, familyID int64) (http.Cookie, error) {
 	currentTime := time.Now().UTC()
-	expirationDate := currentTime.Add(tokenLifeTime)
+	expirationDate := currentTime.Add(AccessTokenLifetime)
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS512, UserToken{
+	token := jwt.NewWithClaims(activeKey.method, UserToken{
 		UserID:   userId,
-		Remember: rememberMe,
+		FamilyID: familyID,
 		RegisteredClaims: jwt.RegisteredClaims{
 			IssuedAt:  jwt.NewNumericDate(currentTime),
 			ExpiresAt: jwt.NewNumericDate(expirationDate),
 		},
 	})
 
-	tokenString, err := token.SignedString(jwtSecret)
+	token.Header["kid"] = activeKey.id
+
+	tokenString, err := token.SignedString(activeKey.private)
 	if err != nil {
 		return http.Cookie{}, err
 	}
@@ -56,17 +76,30 @@ func CreateToken(rememberMe bool, userId int64) (http.Cookie, error) {
 		SameSite: http.SameSiteLaxMode,
 	}
 
+	return cookie, nil
+}
+
+// CreateRefreshCookie only sends the refresh token to auth endpoints,
+// it's kept after closing the browser only if the user wanted to be remembered
+func CreateRefreshCookie(token string, rememberMe bool, expirationDate time.Time) http.Cookie {
+	cookie := http.Cookie{
+		Name:     "refresh",
+		Value:    token,
+		Path:     "/api/auth",
+		HttpOnly: true,
+		Secure:   isHttps,
+		SameSite: http.SameSiteStrictMode,
+	}
+
 	if rememberMe {
 		cookie.Expires = expirationDate
 	}
 
-	return cookie, nil
+	return cookie
 }
 
 func VerifyToken(tokenString string) (UserToken, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &UserToken{}, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
+	token, err := jwt.ParseWithClaims(tokenString, &UserToken{}, keyFunc)
 	if err != nil {
 		return UserToken{}, err
 	} else if claims, ok := token.Claims.(*UserToken); ok {
@@ -0,0 +1,180 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func writeKey(t *testing.T, privateKey any) string {
+	t.Helper()
+
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "key.pem")
+	err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func useKeys(t *testing.T, keyConfigs []KeyConfig) {
+	t.Helper()
+
+	var err error
+	keys, activeKey, err = loadKeys(keyConfigs)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func createToken(t *testing.T) string {
+	t.Helper()
+
+	cookie, err := CreateToken(1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cookie.Value
+}
+
+func TestKeyRotation(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPath := writeKey(t, edKey)
+	ecPath := writeKey(t, ecKey)
+
+	// signed before rotation, without a key ID
+	err = Setup("secret", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyToken := createToken(t)
+
+	useKeys(t, []KeyConfig{
+		{KeyID: "ed", Algorithm: "EdDSA", PrivateKey: edPath, Active: true},
+		{KeyID: legacyKeyID, Algorithm: "HS512", Secret: "secret"},
+	})
+	edToken := createToken(t)
+
+	parsed, _, err := jwt.NewParser().ParseUnverified(edToken, &UserToken{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Header["kid"] != "ed" || parsed.Method.Alg() != "EdDSA" {
+		t.Errorf("expected token signed by key ed with EdDSA, got %v", parsed.Header)
+	}
+
+	for name, token := range map[string]string{"legacy": legacyToken, "ed": edToken} {
+		userToken, err := VerifyToken(token)
+		if err != nil {
+			t.Errorf("%s token should verify: %v", name, err)
+		} else if userToken.UserID != 1 || userToken.FamilyID != 2 {
+			t.Errorf("%s token has wrong claims: %+v", name, userToken)
+		}
+	}
+
+	// rotate to ES256, ed key is still accepted until its cutoff
+	future := time.Now().Add(time.Hour)
+	past := time.Now().Add(-time.Hour)
+	useKeys(t, []KeyConfig{
+		{KeyID: "ec", Algorithm: "ES256", PrivateKey: ecPath, Active: true},
+		{KeyID: "ed", Algorithm: "EdDSA", PrivateKey: edPath, VerifyUntil: &future},
+		{KeyID: legacyKeyID, Algorithm: "HS512", Secret: "secret", VerifyUntil: &past},
+	})
+
+	_, err = VerifyToken(edToken)
+	if err != nil {
+		t.Errorf("rotated out key should verify until cutoff: %v", err)
+	}
+	_, err = VerifyToken(legacyToken)
+	if err == nil {
+		t.Error("key past its cutoff shouldn't verify")
+	}
+	_, err = VerifyToken(createToken(t))
+	if err != nil {
+		t.Errorf("ES256 token should verify: %v", err)
+	}
+
+	jwks := PublicKeys()
+	if len(jwks.Keys) != 2 {
+		t.Fatalf("expected the 2 asymmetric keys to be published, got %+v", jwks.Keys)
+	}
+	for _, jwk := range jwks.Keys {
+		switch jwk.KeyID {
+		case "ed":
+			x, _ := base64.RawURLEncoding.DecodeString(jwk.X)
+			if jwk.KeyType != "OKP" || jwk.Curve != "Ed25519" || string(x) != string(edKey.Public().(ed25519.PublicKey)) {
+				t.Errorf("wrong ed25519 jwk: %+v", jwk)
+			}
+		case "ec":
+			x, _ := base64.RawURLEncoding.DecodeString(jwk.X)
+			y, _ := base64.RawURLEncoding.DecodeString(jwk.Y)
+			if jwk.KeyType != "EC" || jwk.Curve != "P-256" || len(x) != 32 || len(y) != 32 {
+				t.Errorf("wrong P-256 jwk: %+v", jwk)
+			}
+		default:
+			t.Errorf("unexpected jwk: %+v", jwk)
+		}
+	}
+}
+
+func TestRejectsAlgorithmMismatch(t *testing.T) {
+	useKeys(t, []KeyConfig{{KeyID: "hs", Algorithm: "HS512", Secret: "secret", Active: true}})
+
+	// same secret, but the header claims a different algorithm than the key has
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, UserToken{UserID: 1, FamilyID: 2})
+	token.Header["kid"] = "hs"
+	tokenString, err := token.SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = VerifyToken(tokenString)
+	if err == nil {
+		t.Error("token with a different algorithm than its key shouldn't verify")
+	}
+}
+
+func TestLoadKeysErrors(t *testing.T) {
+	tests := map[string][]KeyConfig{
+		"no active key": {{KeyID: "a", Algorithm: "HS512", Secret: "s"}},
+		"two active keys": {
+			{KeyID: "a", Algorithm: "HS512", Secret: "s", Active: true},
+			{KeyID: "b", Algorithm: "HS512", Secret: "s", Active: true},
+		},
+		"duplicate key ID": {
+			{KeyID: "a", Algorithm: "HS512", Secret: "s", Active: true},
+			{KeyID: "a", Algorithm: "HS512", Secret: "s"},
+		},
+		"missing key ID":        {{Algorithm: "HS512", Secret: "s", Active: true}},
+		"unsupported algorithm": {{KeyID: "a", Algorithm: "RS256", Active: true}},
+	}
+
+	for name, keyConfigs := range tests {
+		_, _, err := loadKeys(keyConfigs)
+		if err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
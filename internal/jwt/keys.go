@@ -0,0 +1,253 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// legacyKeyID is the ID of the key made from JWT_SECRET, tokens without a kid header
+// were signed before key rotation existed and are verified with it
+const legacyKeyID = "default"
+
+// KeyConfig is an entry of the keys file
+type KeyConfig struct {
+	KeyID string `json:"kid"`
+	// HS512, EdDSA or ES256
+	Algorithm string `json:"alg"`
+	// only for HS512
+	Secret string `json:"secret,omitempty"`
+	// path to a PKCS #8 PEM private key, only for EdDSA and ES256
+	PrivateKey string `json:"privateKey,omitempty"`
+	// new tokens are signed with the active key, exactly one key must be active
+	Active bool `json:"active,omitempty"`
+	// tokens signed with the key are rejected after this time, no cutoff if empty
+	VerifyUntil *time.Time `json:"verifyUntil,omitempty"`
+}
+
+type signingKey struct {
+	id          string
+	method      jwt.SigningMethod
+	private     any
+	public      any
+	verifyUntil *time.Time
+}
+
+// Jwk is a public key in the format of RFC 7517
+type Jwk struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	Y         string `json:"y,omitempty"`
+}
+
+type Jwks struct {
+	Keys []Jwk `json:"keys"`
+}
+
+// readKeysFile reads the key list from the json file at path
+func readKeysFile(path string) ([]KeyConfig, error) {
+	fileBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keyConfigs []KeyConfig
+	err = json.Unmarshal(fileBytes, &keyConfigs)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse jwt keys file [%s]: %w", path, err)
+	}
+
+	return keyConfigs, nil
+}
+
+// loadKeys turns the key configs into signing keys and returns them by ID, along with the active one
+func loadKeys(keyConfigs []KeyConfig) (map[string]*signingKey, *signingKey, error) {
+	keys := make(map[string]*signingKey, len(keyConfigs))
+	var activeKey *signingKey
+
+	for _, keyConfig := range keyConfigs {
+		if keyConfig.KeyID == "" {
+			return nil, nil, errors.New("jwt key is missing kid")
+		}
+		if _, exists := keys[keyConfig.KeyID]; exists {
+			return nil, nil, fmt.Errorf("jwt key ID [%s] is used more than once", keyConfig.KeyID)
+		}
+
+		key, err := loadKey(keyConfig)
+		if err != nil {
+			return nil, nil, fmt.Errorf("couldn't load jwt key ID [%s]: %w", keyConfig.KeyID, err)
+		}
+
+		if keyConfig.Active {
+			if activeKey != nil {
+				return nil, nil, fmt.Errorf("jwt keys [%s] and [%s] are both active", activeKey.id, key.id)
+			}
+			if key.verifyUntil != nil {
+				return nil, nil, fmt.Errorf("active jwt key ID [%s] can't have verifyUntil", key.id)
+			}
+			activeKey = key
+		}
+
+		keys[key.id] = key
+	}
+
+	if activeKey == nil {
+		return nil, nil, errors.New("no jwt key is active")
+	}
+
+	return keys, activeKey, nil
+}
+
+func loadKey(keyConfig KeyConfig) (*signingKey, error) {
+	key := &signingKey{
+		id:          keyConfig.KeyID,
+		verifyUntil: keyConfig.VerifyUntil,
+	}
+
+	switch keyConfig.Algorithm {
+	case jwt.SigningMethodHS512.Alg():
+		if keyConfig.Secret == "" {
+			return nil, errors.New("HS512 key needs a secret")
+		}
+		key.method = jwt.SigningMethodHS512
+		key.private = []byte(keyConfig.Secret)
+		key.public = key.private
+		return key, nil
+	case jwt.SigningMethodEdDSA.Alg(), jwt.SigningMethodES256.Alg():
+	default:
+		return nil, fmt.Errorf("unsupported algorithm [%s]", keyConfig.Algorithm)
+	}
+
+	pemBytes, err := os.ReadFile(keyConfig.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in [%s]", keyConfig.PrivateKey)
+	}
+
+	privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	switch privateKey := privateKey.(type) {
+	case ed25519.PrivateKey:
+		if keyConfig.Algorithm != jwt.SigningMethodEdDSA.Alg() {
+			return nil, fmt.Errorf("ed25519 key can't be used with %s", keyConfig.Algorithm)
+		}
+		key.method = jwt.SigningMethodEdDSA
+		key.private = privateKey
+		key.public = privateKey.Public()
+	case *ecdsa.PrivateKey:
+		if keyConfig.Algorithm != jwt.SigningMethodES256.Alg() || privateKey.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("ES256 needs a P-256 key")
+		}
+		key.method = jwt.SigningMethodES256
+		key.private = privateKey
+		key.public = privateKey.Public()
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", privateKey)
+	}
+
+	return key, nil
+}
+
+// expired reports if tokens signed with the key shouldn't be accepted anymore
+func (key *signingKey) expired(now time.Time) bool {
+	return key.verifyUntil != nil && now.After(*key.verifyUntil)
+}
+
+// jwk returns the public key in JWK format, symmetric keys can't be published
+func (key *signingKey) jwk() (Jwk, bool) {
+	jwk := Jwk{
+		Use:       "sig",
+		Algorithm: key.method.Alg(),
+		KeyID:     key.id,
+	}
+
+	switch publicKey := key.public.(type) {
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(publicKey)
+	case *ecdsa.PublicKey:
+		ecdhKey, err := publicKey.ECDH()
+		if err != nil {
+			return Jwk{}, false
+		}
+		// uncompressed point: 0x04 || X || Y
+		point := ecdhKey.Bytes()
+		size := (len(point) - 1) / 2
+
+		jwk.KeyType = "EC"
+		jwk.Curve = "P-256"
+		jwk.X = base64.RawURLEncoding.EncodeToString(point[1 : 1+size])
+		jwk.Y = base64.RawURLEncoding.EncodeToString(point[1+size:])
+	default:
+		return Jwk{}, false
+	}
+
+	return jwk, true
+}
+
+// PublicKeys returns the public keys other services can verify access tokens with,
+// keys past their cutoff are left out
+func PublicKeys() Jwks {
+	now := time.Now().UTC()
+
+	jwks := Jwks{Keys: []Jwk{}}
+	for _, key := range keys {
+		if key.expired(now) {
+			continue
+		}
+
+		jwk, ok := key.jwk()
+		if ok {
+			jwks.Keys = append(jwks.Keys, jwk)
+		}
+	}
+
+	return jwks
+}
+
+// keyFunc picks the key the token claims to be signed with
+func keyFunc(token *jwt.Token) (any, error) {
+	keyID, _ := token.Header["kid"].(string)
+	if keyID == "" {
+		keyID = legacyKeyID
+	}
+
+	key, exists := keys[keyID]
+	if !exists {
+		return nil, fmt.Errorf("unknown key ID [%s]", keyID)
+	}
+
+	// the algorithm in the header must match the key, otherwise a public key could be used as an HMAC secret
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("key ID [%s] is %s but token is %s", keyID, key.method.Alg(), token.Method.Alg())
+	}
+
+	if key.expired(time.Now().UTC()) {
+		return nil, fmt.Errorf("key ID [%s] isn't accepted anymore", keyID)
+	}
+
+	// for HMAC this is the secret itself
+	return key.public, nil
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -41,9 +43,7 @@ func checkForLocalExpiredKeys() {
 	for range ticker.C {
 		mutex.Lock()
 		for key, v := range hashmap {
-			// fmt.Printf("Key: %s, Value: %s, Expires in: %s\n", key, v.value, time.Until(v.expires).Round(time.Second))
 			if v.expires.Before(time.Now()) {
-				// sugar.Debugf("Key %s expired, deleting...", key)
 				delete(hashmap, key)
 			}
 		}
@@ -51,17 +51,31 @@ func checkForLocalExpiredKeys() {
 	}
 }
 
+// keyKind is what gets logged instead of the key, keys often hold tokens
+func keyKind(key string) string {
+	kind, _, _ := strings.Cut(key, ":")
+	return kind
+}
+
+// localValue returns the value of the key if it hasn't expired yet, expired keys are only deleted now and then.
+// the mutex must be locked
+func localValue(key string) string {
+	v, exists := hashmap[key]
+	if !exists || !v.expires.After(time.Now()) {
+		return ""
+	}
+	return v.value
+}
+
 func Get(key string) (string, error) {
-	debugText := fmt.Sprintf("Getting value of key [%s]", key)
+	debugText := fmt.Sprintf("Getting value of [%s] key", keyKind(key))
 	if !useRedis {
 		sugar.Debugf("%s from hashmap", debugText)
 
 		mutex.RLock()
 		defer mutex.RUnlock()
 
-		value := hashmap[key].value
-
-		return value, nil
+		return localValue(key), nil
 	}
 
 	sugar.Debugf("%s from redis", debugText)
@@ -77,14 +91,14 @@ func Get(key string) (string, error) {
 }
 
 func GetDel(key string) (string, error) {
-	debugText := fmt.Sprintf("Getting and deleting value of key [%s]", key)
+	debugText := fmt.Sprintf("Getting and deleting value of [%s] key", keyKind(key))
 	if !useRedis {
 		sugar.Debugf("%s from hashmap", debugText)
 
 		mutex.Lock()
 		defer mutex.Unlock()
 
-		value := hashmap[key].value
+		value := localValue(key)
 		delete(hashmap, key)
 
 		return value, nil
@@ -103,7 +117,7 @@ func GetDel(key string) (string, error) {
 }
 
 func Set(key string, value string, expires time.Duration) error {
-	debugText := fmt.Sprintf("Setting value of key [%s] to [%s]", key, value)
+	debugText := fmt.Sprintf("Setting value of [%s] key", keyKind(key))
 	if !useRedis {
 		sugar.Debugf("%s in hashmap", debugText)
 
@@ -119,3 +133,60 @@ func Set(key string, value string, expires time.Duration) error {
 	_, err := redisClient.Set(redisCtx, key, value, expires).Result()
 	return err
 }
+
+// Incr adds one to the number stored at the key and returns it,
+// a missing key counts as 0 and is created with the expiry, which later increments leave as it is
+func Incr(key string, expires time.Duration) (int64, error) {
+	debugText := fmt.Sprintf("Incrementing value of [%s] key", keyKind(key))
+	if !useRedis {
+		sugar.Debugf("%s in hashmap", debugText)
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		var count int64
+		v, exists := hashmap[key]
+		if exists && v.expires.After(time.Now()) {
+			var err error
+			count, err = strconv.ParseInt(v.value, 10, 64)
+			if err != nil {
+				return 0, err
+			}
+		} else {
+			v.expires = time.Now().Add(expires)
+		}
+		count++
+
+		hashmap[key] = Value{strconv.FormatInt(count, 10), v.expires}
+
+		return count, nil
+	}
+
+	sugar.Debugf("%s in redis", debugText)
+
+	count, err := redisClient.Incr(redisCtx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if count == 1 {
+		err = redisClient.Expire(redisCtx, key, expires).Err()
+	}
+	return count, err
+}
+
+func Del(key string) error {
+	debugText := fmt.Sprintf("Deleting [%s] key", keyKind(key))
+	if !useRedis {
+		sugar.Debugf("%s from hashmap", debugText)
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		delete(hashmap, key)
+
+		return nil
+	}
+
+	sugar.Debugf("%s from redis", debugText)
+	return redisClient.Del(redisCtx, key).Err()
+}
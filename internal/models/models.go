@@ -1,5 +1,10 @@
 package models
 
+import (
+	"encoding/json"
+	"time"
+)
+
 type User struct {
 	ID          int64  `json:"id,string,omitempty"`
 	Email       string `json:"email,omitempty"`
@@ -7,6 +12,7 @@ type User struct {
 	DisplayName string `json:"displayName"`
 	Picture     string `json:"picture"`
 	Password    []byte `json:"password,omitempty"`
+	Bot         bool   `json:"bot,omitempty"`
 }
 
 type Server struct {
@@ -23,6 +29,25 @@ type Channel struct {
 	Name     string `json:"name"`
 }
 
+// Relationship is how the user relates to another user, seen from the user's side
+type Relationship struct {
+	User User `json:"user"`
+	// friend, incoming, outgoing or blocked
+	Type  string    `json:"type"`
+	Since time.Time `json:"since"`
+}
+
+// DirectChannel is a channel between users that doesn't belong to a server,
+// either between two users or a group
+type DirectChannel struct {
+	ID             int64     `json:"id,string"`
+	Name           string    `json:"name"`
+	Group          bool      `json:"group"`
+	Members        []User    `json:"members"`
+	LastActivityAt time.Time `json:"lastActivityAt"`
+	CreatedAt      time.Time `json:"createdAt"`
+}
+
 type Message struct {
 	ID          int64  `json:"id,string"`
 	ChannelID   int64  `json:"channelID,string"`
@@ -31,31 +56,160 @@ type Message struct {
 	Attachments string `json:"attachments"`
 	Edited      bool   `json:"edited"`
 	User        User   `json:"user"`
+	WebhookID   int64  `json:"webhookID,string,omitempty"` // set if the message was posted by a webhook
+	Ephemeral   bool   `json:"ephemeral,omitempty"`        // only shown to the user, never stored
+	Blocked     bool   `json:"blocked,omitempty"`          // the author is blocked by the user, so clients can collapse it
+}
+
+type ChannelActivity struct {
+	ChannelID int64 `json:"channelID,string"`
+	MessageID int64 `json:"messageID,string"`
+}
+
+type LoginSession struct {
+	ID         int64     `json:"id,string"`
+	Device     string    `json:"device"`
+	UserAgent  string    `json:"userAgent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	Current    bool      `json:"current"`
+}
+
+type ApiKey struct {
+	ID         int64      `json:"id,string"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	// only sent once when the key is created
+	Key string `json:"key,omitempty"`
+}
+
+type Passkey struct {
+	ID         int64      `json:"id,string"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+}
+
+// ServerMember is sent when a member joins or leaves a server
+type ServerMember struct {
+	ServerID int64 `json:"serverID,string"`
+	User     User  `json:"user"`
+}
+
+type Bot struct {
+	ID        int64     `json:"id,string"`
+	OwnerID   int64     `json:"ownerID,string"`
+	Name      string    `json:"name"`
+	Picture   string    `json:"picture"`
+	Public    bool      `json:"public"`
+	CreatedAt time.Time `json:"createdAt"`
+	// only sent when the token is created
+	Token string `json:"token,omitempty"`
+}
+
+type Webhook struct {
+	ID        int64     `json:"id,string"`
+	ChannelID int64     `json:"channelID,string"`
+	Name      string    `json:"name"`
+	Avatar    string    `json:"avatar"`
+	CreatedAt time.Time `json:"createdAt"`
+	// only sent when the token is created
+	URL string `json:"url,omitempty"`
+}
+
+type CommandOption struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// string, integer, number, boolean, user or channel
+	Type     string `json:"type"`
+	Required bool   `json:"required"`
+}
+
+type Command struct {
+	ID          int64           `json:"id,string"`
+	BotID       int64           `json:"botID,string"`
+	ServerID    int64           `json:"serverID,string"`
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Options     []CommandOption `json:"options"`
+	CreatedAt   time.Time       `json:"createdAt"`
+	// only set when listing the commands of a channel
+	Bot *User `json:"bot,omitempty"`
+}
+
+// Interaction is sent to a bot when a user runs one of its commands
+type Interaction struct {
+	ID          int64          `json:"id,string"`
+	CommandID   int64          `json:"commandID,string"`
+	CommandName string         `json:"commandName"`
+	BotID       int64          `json:"botID,string"`
+	ServerID    int64          `json:"serverID,string"`
+	ChannelID   int64          `json:"channelID,string"`
+	User        User           `json:"user"`
+	Options     map[string]any `json:"options"`
+	// the bot has to respond before this
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type OutgoingWebhook struct {
+	ID                  int64     `json:"id,string"`
+	ServerID            int64     `json:"serverID,string"`
+	URL                 string    `json:"url"`
+	Events              []string  `json:"events"`
+	Enabled             bool      `json:"enabled"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	CreatedAt           time.Time `json:"createdAt"`
+	// only sent when the secret is created
+	Secret string `json:"secret,omitempty"`
+}
+
+type OutgoingWebhookDelivery struct {
+	ID             int64           `json:"id,string"`
+	WebhookID      int64           `json:"webhookID,string"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  time.Time       `json:"nextAttemptAt"`
+	ResponseStatus int             `json:"responseStatus"`
+	Error          string          `json:"error"`
+	CreatedAt      time.Time       `json:"createdAt"`
 }
 
 type ConfigFile struct {
 	HostAddress string
 	HostPort    string
 	//BehindNginx       bool
-	TlsCert           string
-	TlsKey            string
-	RateLimiting      bool
-	Cors              bool
-	PrintHttpRequests bool
-	LogToFile         bool
-	LogLevel          string
-	JwtSecret         string
-	SnowflakeWorkerID int64
-	UseRedis          bool
-	UsePostgres       bool
-	DbUser            string
-	DbPassword        string
-	DbAddress         string
-	DbPort            string
-	DbDatabase        string
-	UseSmtp           bool
-	SmtpUsername      string
-	SmtpPassword      string
-	SmtpServer        string
-	SmtpPort          string
+	TlsCert                 string
+	TlsKey                  string
+	RateLimiting            bool
+	Cors                    bool
+	PrintHttpRequests       bool
+	LogToFile               bool
+	LogLevel                string
+	JwtSecret               string
+	JwtKeysFile             string
+	SnowflakeWorkerID       int64
+	MaxChannelSubscriptions int
+	ShutdownTimeout         time.Duration
+	AllowedOrigins          []string
+	MaxSessionsPerUser      int
+	MaxSessionsPerIP        int
+	UseRedis                bool
+	UsePostgres             bool
+	DbUser                  string
+	DbPassword              string
+	DbAddress               string
+	DbPort                  string
+	DbDatabase              string
+	AllowPrivateWebhookURLs bool
+	UseSmtp                 bool
+	SmtpUsername            string
+	SmtpPassword            string
+	SmtpServer              string
+	SmtpPort                string
+	PasskeyRPID             string
 }
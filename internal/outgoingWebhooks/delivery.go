@@ -0,0 +1,283 @@
+package outgoingWebhooks
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var errPrivateAddress = errors.New("webhook URL resolves to a private address")
+
+var client *http.Client
+
+type delivery struct {
+	id        int64
+	webhookID int64
+	event     string
+	payload   string
+	attempts  int
+	url       string
+	secret    string
+	enabled   bool
+}
+
+// newClient returns the http client deliveries are sent with, unless allowed it refuses to connect
+// to private addresses, the check is done on the resolved address so DNS can't be used to get around it
+func newClient(allowPrivateURLs bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if !allowPrivateURLs {
+		dialer.Control = func(network string, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+
+			ip := net.ParseIP(host)
+			if ip == nil || !isPublicIP(ip) {
+				return errPrivateAddress
+			}
+			return nil
+		}
+	}
+
+	return &http.Client{
+		Timeout: requestTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 5 * time.Second,
+			MaxIdleConnsPerHost: 2,
+			IdleConnTimeout:     time.Minute,
+		},
+		// a redirect counts as a failure, following it could lead to a private address
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func isPublicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() && !ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast() && !ip.IsMulticast()
+}
+
+// backoff returns how long to wait before the next attempt after the given number of failed ones
+func backoff(attempts int) time.Duration {
+	delay := baseBackoff
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= maxBackoff {
+			return maxBackoff
+		}
+	}
+	return delay
+}
+
+// deliverDue sends the deliveries whose next attempt is due, returns how many were attempted
+func deliverDue() (int, error) {
+	now := time.Now().UTC()
+
+	deliveries, err := dueDeliveries(now)
+	if err != nil {
+		return 0, err
+	}
+
+	var attempts sync.WaitGroup
+	attempted := 0
+	for _, d := range deliveries {
+		if !d.enabled {
+			_, err := db.Exec("UPDATE outgoing_webhook_deliveries SET status = $1, error = $2 WHERE id = $3", StatusFailed, "webhook is disabled", d.id)
+			if err != nil {
+				return attempted, err
+			}
+			continue
+		}
+
+		claimed, err := claimDelivery(d, now)
+		if err != nil {
+			return attempted, err
+		}
+		if !claimed {
+			continue
+		}
+
+		attempted++
+		attempts.Add(1)
+		go func() {
+			defer attempts.Done()
+			err := attemptDelivery(d)
+			if err != nil {
+				sugar.Error(err)
+			}
+		}()
+	}
+
+	attempts.Wait()
+	return attempted, nil
+}
+
+func dueDeliveries(now time.Time) ([]delivery, error) {
+	rows, err := db.Query(`
+		SELECT
+			outgoing_webhook_deliveries.id,
+			outgoing_webhook_deliveries.webhook_id,
+			outgoing_webhook_deliveries.event,
+			outgoing_webhook_deliveries.payload,
+			outgoing_webhook_deliveries.attempts,
+			outgoing_webhooks.url,
+			outgoing_webhooks.secret,
+			outgoing_webhooks.enabled
+		FROM
+			outgoing_webhook_deliveries
+		JOIN
+			outgoing_webhooks ON outgoing_webhooks.id = outgoing_webhook_deliveries.webhook_id
+		WHERE
+			outgoing_webhook_deliveries.status = $1 AND outgoing_webhook_deliveries.next_attempt_at <= $2
+		ORDER BY
+			outgoing_webhook_deliveries.next_attempt_at
+		LIMIT $3
+	`, StatusPending, now, batchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			sugar.Error(err)
+		}
+	}()
+
+	var deliveries []delivery
+	for rows.Next() {
+		var d delivery
+		err := rows.Scan(&d.id, &d.webhookID, &d.event, &d.payload, &d.attempts, &d.url, &d.secret, &d.enabled)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// claimDelivery moves the next attempt of the delivery into the future, so other nodes skip it while it's being sent,
+// if the node stops before finishing, the delivery is picked up again once the claim runs out
+func claimDelivery(d delivery, now time.Time) (bool, error) {
+	result, err := db.Exec("UPDATE outgoing_webhook_deliveries SET next_attempt_at = $1 WHERE id = $2 AND status = $3 AND attempts = $4 AND next_attempt_at <= $5",
+		now.Add(claimDuration), d.id, StatusPending, d.attempts, now)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected == 1, nil
+}
+
+// attemptDelivery sends the delivery once and records the outcome
+func attemptDelivery(d delivery) error {
+	responseStatus, sendErr := send(d)
+	attempts := d.attempts + 1
+
+	if sendErr == nil {
+		_, err := db.Exec("UPDATE outgoing_webhook_deliveries SET status = $1, attempts = $2, response_status = $3, error = $4 WHERE id = $5",
+			StatusSucceeded, attempts, responseStatus, "", d.id)
+		if err != nil {
+			return err
+		}
+
+		_, err = db.Exec("UPDATE outgoing_webhooks SET consecutive_failures = 0 WHERE id = $1", d.webhookID)
+		return err
+	}
+
+	errorMessage := sendErr.Error()
+	if len(errorMessage) > 256 {
+		errorMessage = errorMessage[:256]
+	}
+
+	status := StatusPending
+	if attempts >= maxAttempts {
+		status = StatusFailed
+	}
+
+	_, err := db.Exec("UPDATE outgoing_webhook_deliveries SET status = $1, attempts = $2, response_status = $3, error = $4, next_attempt_at = $5 WHERE id = $6",
+		status, attempts, responseStatus, errorMessage, time.Now().UTC().Add(backoff(attempts)), d.id)
+	if err != nil {
+		return err
+	}
+
+	var failures int
+	err = db.QueryRow("UPDATE outgoing_webhooks SET consecutive_failures = consecutive_failures + 1 WHERE id = $1 RETURNING consecutive_failures", d.webhookID).Scan(&failures)
+	if err != nil {
+		return err
+	}
+
+	if failures >= maxConsecutiveFailures {
+		return disable(d.webhookID)
+	}
+
+	return nil
+}
+
+// disable stops the webhook from getting new deliveries and gives up on the pending ones,
+// the owner has to enable it again once the endpoint works
+func disable(webhookID int64) error {
+	sugar.Warnf("Disabling outgoing webhook ID [%d] after %d failed attempts in a row", webhookID, maxConsecutiveFailures)
+
+	_, err := db.Exec("UPDATE outgoing_webhooks SET enabled = FALSE WHERE id = $1", webhookID)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("UPDATE outgoing_webhook_deliveries SET status = $1, error = $2 WHERE webhook_id = $3 AND status = $4",
+		StatusFailed, "webhook was disabled after too many failures", webhookID, StatusPending)
+	return err
+}
+
+// send posts the payload to the webhook, returns the response status if there was a response
+func send(d delivery) (int, error) {
+	timestamp := time.Now().Unix()
+
+	request, err := http.NewRequest(http.MethodPost, d.url, strings.NewReader(d.payload))
+	if err != nil {
+		return 0, err
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "chatapp-webhooks")
+	request.Header.Set("X-Webhook-ID", strconv.FormatInt(d.webhookID, 10))
+	request.Header.Set("X-Webhook-Delivery", strconv.FormatInt(d.id, 10))
+	request.Header.Set("X-Webhook-Event", d.event)
+	request.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+	request.Header.Set("X-Webhook-Signature", "sha256="+Sign(d.secret, timestamp, []byte(d.payload)))
+
+	response, err := client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := response.Body.Close(); err != nil {
+			sugar.Error(err)
+		}
+	}()
+
+	// reading the body lets the connection be reused
+	_, err = io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+	if err != nil {
+		return response.StatusCode, err
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("endpoint responded with status %d", response.StatusCode)
+	}
+
+	return response.StatusCode, nil
+}
@@ -0,0 +1,309 @@
+package outgoingWebhooks
+
+import (
+	"chatapp-backend/internal/globals"
+	"chatapp-backend/internal/hub"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/snowflake"
+	"go.uber.org/zap"
+)
+
+// outgoing webhooks let server owners receive the events of their server on their own http endpoint,
+// every event is stored as a delivery first, which works as both the retry queue and the delivery log
+
+const (
+	StatusPending   = "pending"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// Events webhooks can subscribe to, the rest are either private to a user or duplicates of these
+var Events = []string{
+	hub.ServerModified,
+	hub.ChannelCreated,
+	hub.ChannelDeleted,
+	hub.ChannelModified,
+	hub.MessageCreated,
+	hub.MessageDeleted,
+	hub.MessageModified,
+	hub.MemberJoined,
+	hub.MemberLeft,
+}
+
+// variables so tests can make them shorter
+var (
+	baseBackoff = 10 * time.Second
+	maxBackoff  = time.Hour
+	// attempts of a single delivery before it's given up
+	maxAttempts = 8
+	// failed attempts in a row, across deliveries, before the webhook is disabled
+	maxConsecutiveFailures = 20
+	pollInterval           = time.Second
+	requestTimeout         = 10 * time.Second
+	// how long a node may work on a delivery before another one can take it over
+	claimDuration = 2 * requestTimeout
+	batchSize     = 20
+	logRetention  = 7 * 24 * time.Hour
+)
+
+type event struct {
+	messageType string
+	channelType string
+	channel     int64
+	data        json.RawMessage
+	createdAt   time.Time
+}
+
+// Payload is the body of every request sent to a webhook
+type Payload struct {
+	ID        int64           `json:"id,string"`
+	Event     string          `json:"event"`
+	ServerID  int64           `json:"serverID,string"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Data      json.RawMessage `json:"data"`
+}
+
+var sugar *zap.SugaredLogger
+var db *sql.DB
+var snowflakeNode *snowflake.Node
+
+var events = make(chan event, 1024)
+var wake = make(chan struct{}, 1)
+var ctx, cancel = context.WithCancel(context.Background())
+var waitGroup sync.WaitGroup
+
+func Setup(_sugar *zap.SugaredLogger, _db *sql.DB, _snowflakeNode *snowflake.Node, allowPrivateURLs bool) {
+	sugar = _sugar
+	db = _db
+	snowflakeNode = _snowflakeNode
+	client = newClient(allowPrivateURLs)
+
+	hub.OnEmit(onEmit)
+
+	waitGroup.Add(2)
+	go runQueue()
+	go runDeliveries()
+}
+
+// Shutdown stops taking new events and waits for the deliveries in progress,
+// those not finished in time are retried by the next node to start
+func Shutdown(ctx context.Context) error {
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		waitGroup.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// IsEvent reports if webhooks can subscribe to the event
+func IsEvent(eventType string) bool {
+	return slices.Contains(Events, eventType)
+}
+
+// NewSecret returns the secret requests to a webhook are signed with
+func NewSecret() (string, error) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(secret), nil
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of "<timestamp>.<body>", the timestamp is signed too,
+// so receivers can reject old requests that are replayed
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(fmt.Appendf(nil, "%d.", timestamp))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// onEmit queues the events of servers, the database work is done in the background
+// so it doesn't slow down the request that emitted the event
+func onEmit(messageType string, channelType string, message any, channel int64) {
+	if !IsEvent(messageType) {
+		return
+	}
+	if channelType != globals.ChannelTypeServer && channelType != globals.ChannelTypeChannel {
+		return
+	}
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		sugar.Error(err)
+		return
+	}
+
+	select {
+	case events <- event{messageType: messageType, channelType: channelType, channel: channel, data: data, createdAt: time.Now().UTC()}:
+	case <-ctx.Done():
+	default:
+		// the emit happens in the request that caused the event, which shouldn't wait for the database to catch up
+		sugar.Warnf("Outgoing webhook queue is full, dropped [%s] event of channel [%d]", messageType, channel)
+	}
+}
+
+func runQueue() {
+	defer waitGroup.Done()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-events:
+			queued, err := enqueue(ev)
+			if err != nil {
+				sugar.Error(err)
+				continue
+			}
+			if queued > 0 {
+				select {
+				case wake <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
+}
+
+func runDeliveries() {
+	defer waitGroup.Done()
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	pruneTicker := time.NewTicker(time.Hour)
+	defer pruneTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-pruneTicker.C:
+			err := pruneDeliveries()
+			if err != nil {
+				sugar.Error(err)
+			}
+		case <-wake:
+		case <-ticker.C:
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		_, err := deliverDue()
+		if err != nil {
+			sugar.Error(err)
+		}
+	}
+}
+
+// serverOfEvent returns the server the event happened in, 0 if it doesn't exist anymore
+// or if it happened in a direct channel, which servers have nothing to do with
+func serverOfEvent(ev event) (int64, error) {
+	if ev.channelType == globals.ChannelTypeServer {
+		return ev.channel, nil
+	}
+
+	var serverID sql.NullInt64
+	err := db.QueryRow("SELECT server_id FROM channels WHERE id = $1", ev.channel).Scan(&serverID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return serverID.Int64, err
+}
+
+// enqueue stores a delivery for every enabled webhook of the server subscribed to the event,
+// returns how many were stored
+func enqueue(ev event) (int, error) {
+	serverID, err := serverOfEvent(ev)
+	if err != nil || serverID == 0 {
+		return 0, err
+	}
+
+	webhookIDs, err := subscribedWebhooks(serverID, ev.messageType)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, webhookID := range webhookIDs {
+		payload := Payload{
+			ID:        snowflakeNode.Generate().Int64(),
+			Event:     ev.messageType,
+			ServerID:  serverID,
+			CreatedAt: ev.createdAt,
+			Data:      ev.data,
+		}
+
+		body, err := json.Marshal(payload)
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = db.Exec("INSERT INTO outgoing_webhook_deliveries (id, created_at, webhook_id, event, payload, status, next_attempt_at) VALUES($1, $2, $3, $4, $5, $6, $7)",
+			payload.ID, ev.createdAt, webhookID, ev.messageType, string(body), StatusPending, ev.createdAt)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(webhookIDs), nil
+}
+
+func subscribedWebhooks(serverID int64, eventType string) ([]int64, error) {
+	rows, err := db.Query("SELECT id, events FROM outgoing_webhooks WHERE server_id = $1 AND enabled = TRUE", serverID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			sugar.Error(err)
+		}
+	}()
+
+	var webhookIDs []int64
+	for rows.Next() {
+		var webhookID int64
+		var webhookEvents string
+		err := rows.Scan(&webhookID, &webhookEvents)
+		if err != nil {
+			return nil, err
+		}
+
+		if slices.Contains(strings.Fields(webhookEvents), eventType) {
+			webhookIDs = append(webhookIDs, webhookID)
+		}
+	}
+
+	return webhookIDs, rows.Err()
+}
+
+func pruneDeliveries() error {
+	_, err := db.Exec("DELETE FROM outgoing_webhook_deliveries WHERE status != $1 AND created_at < $2", StatusPending, time.Now().UTC().Add(-logRetention))
+	return err
+}
@@ -0,0 +1,307 @@
+package outgoingWebhooks
+
+import (
+	"chatapp-backend/internal/database/databaseTest"
+	"chatapp-backend/internal/globals"
+	"chatapp-backend/internal/hub"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/snowflake"
+	"go.uber.org/zap"
+)
+
+const testServerID = 1
+const testChannelID = 2
+
+func setupTest(t *testing.T, allowPrivateURLs bool) {
+	t.Helper()
+
+	db = databaseTest.Open(t)
+
+	_, err := db.Exec("INSERT INTO channels (id, server_id, name) VALUES($1, $2, $3)", testChannelID, testServerID, "channel")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sugar = zap.NewNop().Sugar()
+	snowflakeNode, err = snowflake.NewNode(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = newClient(allowPrivateURLs)
+
+	// retries are due right away, so tests don't have to wait
+	baseBackoff = 0
+}
+
+func addWebhook(t *testing.T, url string, events string) (int64, string) {
+	t.Helper()
+
+	secret, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	webhookID := snowflakeNode.Generate().Int64()
+	_, err = db.Exec("INSERT INTO outgoing_webhooks (id, server_id, creator_id, url, secret, events) VALUES($1, $2, $3, $4, $5, $6)",
+		webhookID, testServerID, 1, url, secret, events)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return webhookID, secret
+}
+
+func emitMessage(t *testing.T) {
+	t.Helper()
+
+	queued, err := enqueue(event{
+		messageType: hub.MessageCreated,
+		channelType: globals.ChannelTypeChannel,
+		channel:     testChannelID,
+		data:        json.RawMessage(`{"message":"hello"}`),
+		createdAt:   time.Now().UTC(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queued != 1 {
+		t.Fatalf("expected 1 delivery to be queued, got %d", queued)
+	}
+}
+
+func deliveryStatus(t *testing.T, webhookID int64) (string, int) {
+	t.Helper()
+
+	var status string
+	var attempts int
+	err := db.QueryRow("SELECT status, attempts FROM outgoing_webhook_deliveries WHERE webhook_id = $1", webhookID).Scan(&status, &attempts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status, attempts
+}
+
+func TestSignedDelivery(t *testing.T) {
+	setupTest(t, true)
+
+	received := make(chan Payload, 1)
+	var secret string
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		timestamp, err := strconv.ParseInt(r.Header.Get("X-Webhook-Timestamp"), 10, 64)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if r.Header.Get("X-Webhook-Signature") != "sha256="+Sign(secret, timestamp, body) {
+			t.Error("signature doesn't match")
+		}
+		if r.Header.Get("X-Webhook-Event") != hub.MessageCreated {
+			t.Errorf("unexpected event header %s", r.Header.Get("X-Webhook-Event"))
+		}
+
+		var payload Payload
+		err = json.Unmarshal(body, &payload)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		received <- payload
+	}))
+	defer endpoint.Close()
+
+	webhookID, webhookSecret := addWebhook(t, endpoint.URL, hub.MessageCreated)
+	secret = webhookSecret
+
+	// not subscribed to, so nothing is queued
+	queued, err := enqueue(event{messageType: hub.ChannelCreated, channelType: globals.ChannelTypeServer, channel: testServerID, data: json.RawMessage(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queued != 0 {
+		t.Fatalf("unsubscribed event was queued")
+	}
+
+	emitMessage(t)
+
+	attempted, err := deliverDue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempted != 1 {
+		t.Fatalf("expected 1 attempt, got %d", attempted)
+	}
+
+	payload := <-received
+	if payload.ServerID != testServerID || payload.Event != hub.MessageCreated || string(payload.Data) != `{"message":"hello"}` {
+		t.Errorf("unexpected payload %+v", payload)
+	}
+
+	status, attempts := deliveryStatus(t, webhookID)
+	if status != StatusSucceeded || attempts != 1 {
+		t.Errorf("expected succeeded after 1 attempt, got %s after %d", status, attempts)
+	}
+}
+
+func TestDirectChannelEventsIgnored(t *testing.T) {
+	setupTest(t, true)
+
+	addWebhook(t, "http://127.0.0.1:1", hub.MessageCreated)
+
+	_, err := db.Exec("INSERT INTO channels (id, server_id, name) VALUES($1, NULL, $2)", 3, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queued, err := enqueue(event{messageType: hub.MessageCreated, channelType: globals.ChannelTypeChannel, channel: 3, data: json.RawMessage(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queued != 0 {
+		t.Error("messages of direct channels shouldn't be sent to server webhooks")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	setupTest(t, true)
+
+	var requests atomic.Int32
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer endpoint.Close()
+
+	webhookID, _ := addWebhook(t, endpoint.URL, hub.MessageCreated)
+	emitMessage(t)
+
+	for i := 1; i <= 2; i++ {
+		_, err := deliverDue()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		status, attempts := deliveryStatus(t, webhookID)
+		if status != StatusPending || attempts != i {
+			t.Fatalf("expected pending after %d attempts, got %s after %d", i, status, attempts)
+		}
+	}
+
+	_, err := deliverDue()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, attempts := deliveryStatus(t, webhookID)
+	if status != StatusSucceeded || attempts != 3 {
+		t.Errorf("expected succeeded after 3 attempts, got %s after %d", status, attempts)
+	}
+
+	var failures int
+	err = db.QueryRow("SELECT consecutive_failures FROM outgoing_webhooks WHERE id = $1", webhookID).Scan(&failures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failures != 0 {
+		t.Errorf("success should reset failures, got %d", failures)
+	}
+}
+
+func TestDisableAfterFailures(t *testing.T) {
+	setupTest(t, true)
+
+	defer func(attempts int, failures int) {
+		maxAttempts = attempts
+		maxConsecutiveFailures = failures
+	}(maxAttempts, maxConsecutiveFailures)
+	maxAttempts = 2
+	maxConsecutiveFailures = 3
+
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer endpoint.Close()
+
+	webhookID, _ := addWebhook(t, endpoint.URL, hub.MessageCreated)
+	emitMessage(t)
+	emitMessage(t)
+
+	for range 5 {
+		_, err := deliverDue()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var enabled bool
+	err := db.QueryRow("SELECT enabled FROM outgoing_webhooks WHERE id = $1", webhookID).Scan(&enabled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enabled {
+		t.Fatal("webhook should be disabled")
+	}
+
+	var pending int
+	err = db.QueryRow("SELECT COUNT(*) FROM outgoing_webhook_deliveries WHERE webhook_id = $1 AND status != $2", webhookID, StatusFailed).Scan(&pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending != 0 {
+		t.Errorf("every delivery should have failed, %d didn't", pending)
+	}
+
+	queued, err := enqueue(event{messageType: hub.MessageCreated, channelType: globals.ChannelTypeChannel, channel: testChannelID, data: json.RawMessage(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queued != 0 {
+		t.Error("disabled webhook shouldn't get new deliveries")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	defer func(base time.Duration) { baseBackoff = base }(baseBackoff)
+	baseBackoff = 10 * time.Second
+
+	expected := map[int]time.Duration{
+		1:  10 * time.Second,
+		2:  20 * time.Second,
+		4:  80 * time.Second,
+		20: maxBackoff,
+	}
+	for attempts, delay := range expected {
+		if backoff(attempts) != delay {
+			t.Errorf("backoff after %d attempts should be %s, got %s", attempts, delay, backoff(attempts))
+		}
+	}
+}
+
+func TestPrivateAddressRefused(t *testing.T) {
+	setupTest(t, false)
+
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request to a private address shouldn't be sent")
+	}))
+	defer endpoint.Close()
+
+	_, err := send(delivery{id: 1, webhookID: 1, event: hub.MessageCreated, payload: "{}", url: endpoint.URL, secret: "secret"})
+	if err == nil || !strings.Contains(err.Error(), errPrivateAddress.Error()) {
+		t.Errorf("expected private address error, got %v", err)
+	}
+}
@@ -0,0 +1,192 @@
+package passkey
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// passkeys are WebAuthn credentials, they can sign in on their own or be the second factor after the password.
+// the state of a ceremony is kept by the caller between the begin and finish steps, serialized as JSON
+
+const ceremonyTimeout = 5 * time.Minute
+
+const displayName = "Chatapp"
+
+// ErrCloned is returned if the signature counter went backwards, which means the key was copied
+var ErrCloned = errors.New("passkey signature counter went backwards")
+
+var webAuthn *webauthn.WebAuthn
+
+// Setup takes the domain passkeys are bound to, and the origins of the clients allowed to use them
+func Setup(rpID string, origins []string) error {
+	var err error
+	webAuthn, err = webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: displayName,
+		RPOrigins:     origins,
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementRequired,
+			UserVerification: protocol.VerificationPreferred,
+		},
+		Timeouts: webauthn.TimeoutsConfig{
+			Login:        webauthn.TimeoutConfig{Enforce: true, Timeout: ceremonyTimeout, TimeoutUVD: ceremonyTimeout},
+			Registration: webauthn.TimeoutConfig{Enforce: true, Timeout: ceremonyTimeout, TimeoutUVD: ceremonyTimeout},
+		},
+	})
+	return err
+}
+
+// User is what the ceremonies need to know about a user
+type User struct {
+	ID          int64
+	Name        string
+	DisplayName string
+	Credentials []webauthn.Credential
+}
+
+func (u User) WebAuthnID() []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(u.ID))
+}
+
+func (u User) WebAuthnName() string {
+	return u.Name
+}
+
+func (u User) WebAuthnDisplayName() string {
+	return u.DisplayName
+}
+
+func (u User) WebAuthnCredentials() []webauthn.Credential {
+	return u.Credentials
+}
+
+// UserIDFromHandle reads the user ID back from the handle the authenticator returns
+func UserIDFromHandle(handle []byte) (int64, bool) {
+	if len(handle) != 8 {
+		return 0, false
+	}
+	return int64(binary.BigEndian.Uint64(handle)), true
+}
+
+func marshalSession(session *webauthn.SessionData) (string, error) {
+	bytes, err := json.Marshal(session)
+	return string(bytes), err
+}
+
+func unmarshalSession(session string) (webauthn.SessionData, error) {
+	var data webauthn.SessionData
+	err := json.Unmarshal([]byte(session), &data)
+	return data, err
+}
+
+// BeginRegistration returns the options for the client and the session to keep until it answers,
+// passkeys the user already has are excluded so the same authenticator isn't registered twice
+func BeginRegistration(user User) (*protocol.CredentialCreation, string, error) {
+	creation, session, err := webAuthn.BeginRegistration(user,
+		webauthn.WithExclusions(webauthn.Credentials(user.Credentials).CredentialDescriptors()))
+	if err != nil {
+		return nil, "", err
+	}
+
+	marshaled, err := marshalSession(session)
+	return creation, marshaled, err
+}
+
+func FinishRegistration(user User, session string, response []byte) (*webauthn.Credential, error) {
+	data, err := unmarshalSession(session)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(response)
+	if err != nil {
+		return nil, err
+	}
+
+	return webAuthn.CreateCredential(user, data, parsed)
+}
+
+// BeginLogin is for using a passkey as the second factor, the user is already known from the password
+func BeginLogin(user User) (*protocol.CredentialAssertion, string, error) {
+	assertion, session, err := webAuthn.BeginLogin(user)
+	if err != nil {
+		return nil, "", err
+	}
+
+	marshaled, err := marshalSession(session)
+	return assertion, marshaled, err
+}
+
+// FinishLogin returns the credential with the updated counter, it should be stored again
+func FinishLogin(user User, session string, response []byte) (*webauthn.Credential, error) {
+	data, err := unmarshalSession(session)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(response)
+	if err != nil {
+		return nil, err
+	}
+
+	credential, err := webAuthn.ValidateLogin(user, data, parsed)
+	if err != nil {
+		return nil, err
+	}
+	if credential.Authenticator.CloneWarning {
+		return nil, ErrCloned
+	}
+
+	return credential, nil
+}
+
+// BeginDiscoverableLogin is for signing in without a password, the authenticator tells who the user is.
+// the passkey replaces both factors, so the user has to be verified by the authenticator
+func BeginDiscoverableLogin() (*protocol.CredentialAssertion, string, error) {
+	assertion, session, err := webAuthn.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		return nil, "", err
+	}
+
+	marshaled, err := marshalSession(session)
+	return assertion, marshaled, err
+}
+
+// FinishDiscoverableLogin looks the user up with findUser, by the ID in the user handle
+func FinishDiscoverableLogin(session string, response []byte, findUser func(userID int64) (User, error)) (User, *webauthn.Credential, error) {
+	data, err := unmarshalSession(session)
+	if err != nil {
+		return User{}, nil, err
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(response)
+	if err != nil {
+		return User{}, nil, err
+	}
+
+	var user User
+	handler := func(rawID, userHandle []byte) (webauthn.User, error) {
+		userID, ok := UserIDFromHandle(userHandle)
+		if !ok {
+			return nil, errors.New("user handle isn't a user ID")
+		}
+
+		user, err = findUser(userID)
+		return user, err
+	}
+
+	_, credential, err := webAuthn.ValidatePasskeyLogin(handler, data, parsed)
+	if err != nil {
+		return User{}, nil, err
+	}
+	if credential.Authenticator.CloneWarning {
+		return User{}, nil, ErrCloned
+	}
+
+	return user, credential, nil
+}
@@ -0,0 +1,301 @@
+package passkey_test
+
+import (
+	"chatapp-backend/internal/passkey"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+const (
+	rpID   = "localhost"
+	origin = "http://localhost:3000"
+)
+
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+)
+
+// authenticator is a software authenticator that makes the same responses a browser would pass on
+type authenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	counter      uint32
+}
+
+func newAuthenticator(t *testing.T) *authenticator {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credentialID := make([]byte, 16)
+	_, err = rand.Read(credentialID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &authenticator{key: key, credentialID: credentialID}
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (a *authenticator) authenticatorData(flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append(rpIDHash[:], flags)
+	return binary.BigEndian.AppendUint32(data, a.counter)
+}
+
+func clientData(t *testing.T, ceremony string, challenge protocol.URLEncodedBase64) []byte {
+	t.Helper()
+
+	bytes, err := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": challenge.String(),
+		"origin":    origin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes
+}
+
+func (a *authenticator) create(t *testing.T, creation *protocol.CredentialCreation) []byte {
+	t.Helper()
+
+	publicKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  int64(webauthncose.P256),
+		XCoord: a.key.X.FillBytes(make([]byte, 32)),
+		YCoord: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.userHandle = []byte(creation.Response.User.ID.(protocol.URLEncodedBase64))
+
+	authData := a.authenticatorData(flagUserPresent | flagUserVerified | flagAttested)
+	authData = append(authData, make([]byte, 16)...) // AAGUID
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(a.credentialID)))
+	authData = append(authData, a.credentialID...)
+	authData = append(authData, publicKey...)
+
+	attestation, err := webauthncbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": authData,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := json.Marshal(map[string]any{
+		"id":    encode(a.credentialID),
+		"rawId": encode(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    encode(clientData(t, "webauthn.create", creation.Response.Challenge)),
+			"attestationObject": encode(attestation),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func (a *authenticator) get(t *testing.T, assertion *protocol.CredentialAssertion) []byte {
+	t.Helper()
+
+	a.counter++
+	authData := a.authenticatorData(flagUserPresent | flagUserVerified)
+	clientDataJSON := clientData(t, "webauthn.get", assertion.Response.Challenge)
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := json.Marshal(map[string]any{
+		"id":    encode(a.credentialID),
+		"rawId": encode(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    encode(clientDataJSON),
+			"authenticatorData": encode(authData),
+			"signature":         encode(signature),
+			"userHandle":        encode(a.userHandle),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func setupTest(t *testing.T) {
+	t.Helper()
+
+	err := passkey.Setup(rpID, []string{origin})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// register runs the registration ceremony and returns the user with the new credential
+func register(t *testing.T, a *authenticator, user passkey.User) passkey.User {
+	t.Helper()
+
+	creation, session, err := passkey.BeginRegistration(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credential, err := passkey.FinishRegistration(user, session, a.create(t, creation))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user.Credentials = append(user.Credentials, *credential)
+	return user
+}
+
+func TestSecondFactor(t *testing.T) {
+	setupTest(t)
+
+	a := newAuthenticator(t)
+	user := register(t, a, passkey.User{ID: 123456789, Name: "someone", DisplayName: "Someone"})
+
+	userID, ok := passkey.UserIDFromHandle(a.userHandle)
+	if !ok || userID != user.ID {
+		t.Fatalf("user handle doesn't hold the user ID, got %d", userID)
+	}
+
+	assertion, session, err := passkey.BeginLogin(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(assertion.Response.AllowedCredentials) != 1 {
+		t.Fatalf("expected the registered passkey to be allowed, got %d", len(assertion.Response.AllowedCredentials))
+	}
+
+	credential, err := passkey.FinishLogin(user, session, a.get(t, assertion))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credential.Authenticator.SignCount != 1 {
+		t.Errorf("expected the counter to be updated, got %d", credential.Authenticator.SignCount)
+	}
+}
+
+func TestDiscoverableLogin(t *testing.T) {
+	setupTest(t)
+
+	a := newAuthenticator(t)
+	user := register(t, a, passkey.User{ID: 987654321, Name: "someone", DisplayName: "Someone"})
+
+	assertion, session, err := passkey.BeginDiscoverableLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assertion.Response.UserVerification != protocol.VerificationRequired {
+		t.Error("signing in without a password should need user verification")
+	}
+
+	found, _, err := passkey.FinishDiscoverableLogin(session, a.get(t, assertion), func(userID int64) (passkey.User, error) {
+		if userID != user.ID {
+			return passkey.User{}, errors.New("unknown user")
+		}
+		return user, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.ID != user.ID {
+		t.Errorf("expected user %d, got %d", user.ID, found.ID)
+	}
+}
+
+func TestRejectedAssertions(t *testing.T) {
+	setupTest(t)
+
+	a := newAuthenticator(t)
+	user := register(t, a, passkey.User{ID: 42, Name: "someone", DisplayName: "Someone"})
+
+	t.Run("other session", func(t *testing.T) {
+		assertion, _, err := passkey.BeginLogin(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, otherSession, err := passkey.BeginLogin(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = passkey.FinishLogin(user, otherSession, a.get(t, assertion))
+		if err == nil {
+			t.Error("assertion for another challenge was accepted")
+		}
+	})
+
+	t.Run("unknown passkey", func(t *testing.T) {
+		assertion, session, err := passkey.BeginLogin(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		other := newAuthenticator(t)
+		other.userHandle = a.userHandle
+		_, err = passkey.FinishLogin(user, session, other.get(t, assertion))
+		if err == nil {
+			t.Error("assertion of an unregistered passkey was accepted")
+		}
+	})
+
+	t.Run("cloned passkey", func(t *testing.T) {
+		assertion, session, err := passkey.BeginLogin(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		credential, err := passkey.FinishLogin(user, session, a.get(t, assertion))
+		if err != nil {
+			t.Fatal(err)
+		}
+		user.Credentials = []webauthn.Credential{*credential}
+
+		// a copy of the key that still has an older counter
+		a.counter -= 2
+		assertion, session, err = passkey.BeginLogin(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = passkey.FinishLogin(user, session, a.get(t, assertion))
+		if !errors.Is(err, passkey.ErrCloned) {
+			t.Errorf("expected ErrCloned, got %v", err)
+		}
+	})
+}
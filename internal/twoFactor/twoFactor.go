@@ -0,0 +1,97 @@
+package twoFactor
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"strings"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+// TOTP codes are the usual 6 digits every 30 seconds, which every authenticator app supports,
+// recovery codes are random and only stored hashed, each one works once
+
+const Issuer = "Chatapp"
+
+const (
+	period = 30
+	// codes of the step before and after are accepted too, as clocks drift
+	skew = 1
+
+	RecoveryCodeCount  = 10
+	recoveryCodeLength = 10
+)
+
+var validateOpts = totp.ValidateOpts{
+	Period:    period,
+	Digits:    otp.DigitsSix,
+	Algorithm: otp.AlgorithmSHA1,
+}
+
+// NewKey returns the secret to store and the URI authenticator apps read, usually from a QR code
+func NewKey(accountName string) (secret string, uri string, err error) {
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      Issuer,
+		AccountName: accountName,
+		Period:      period,
+		Digits:      otp.DigitsSix,
+		Algorithm:   otp.AlgorithmSHA1,
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	return key.Secret(), key.URL(), nil
+}
+
+// MatchCode returns the time step the code belongs to, ok is false if it doesn't match any step close to now.
+// callers should refuse steps that were already used, so a code can't be used twice
+func MatchCode(secret string, code string, now time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != int(otp.DigitsSix) {
+		return 0, false
+	}
+
+	step := now.Unix() / period
+	for offset := int64(-skew); offset <= skew; offset++ {
+		expected, err := totp.GenerateCodeCustom(secret, time.Unix((step+offset)*period, 0), validateOpts)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step + offset, true
+		}
+	}
+
+	return 0, false
+}
+
+// NewRecoveryCodes returns codes formatted like xxxxx-xxxxx
+func NewRecoveryCodes() ([]string, error) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+
+	codes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		bytes := make([]byte, recoveryCodeLength)
+		_, err := rand.Read(bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		code := strings.ToLower(encoding.EncodeToString(bytes))[:recoveryCodeLength]
+		codes[i] = code[:recoveryCodeLength/2] + "-" + code[recoveryCodeLength/2:]
+	}
+
+	return codes, nil
+}
+
+// NormalizeRecoveryCode makes typed codes comparable to the generated ones, case and dashes don't matter
+func NormalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+	code = strings.ReplaceAll(code, " ", "")
+	return code
+}
@@ -0,0 +1,101 @@
+package twoFactor_test
+
+import (
+	"chatapp-backend/internal/twoFactor"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+)
+
+func TestNewKey(t *testing.T) {
+	secret, uri, err := twoFactor.NewKey("someone")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Scheme != "otpauth" || parsed.Host != "totp" {
+		t.Errorf("unexpected URI %s", uri)
+	}
+	if parsed.Query().Get("secret") != secret || parsed.Query().Get("issuer") != twoFactor.Issuer {
+		t.Errorf("URI %s doesn't have the secret and issuer", uri)
+	}
+}
+
+func TestMatchCode(t *testing.T) {
+	secret, _, err := twoFactor.NewKey("someone")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1_700_000_000, 0)
+	step := now.Unix() / 30
+
+	tests := []struct {
+		name     string
+		codeTime time.Time
+		step     int64
+		ok       bool
+	}{
+		{name: "current step", codeTime: now, step: step, ok: true},
+		{name: "previous step", codeTime: now.Add(-30 * time.Second), step: step - 1, ok: true},
+		{name: "next step", codeTime: now.Add(30 * time.Second), step: step + 1, ok: true},
+		{name: "too old", codeTime: now.Add(-90 * time.Second), ok: false},
+		{name: "too new", codeTime: now.Add(90 * time.Second), ok: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			code, err := totp.GenerateCode(secret, tc.codeTime)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			matchedStep, ok := twoFactor.MatchCode(secret, code, now)
+			if ok != tc.ok {
+				t.Fatalf("MatchCode() ok = %v, want %v", ok, tc.ok)
+			}
+			if ok && matchedStep != tc.step {
+				t.Errorf("MatchCode() step = %d, want %d", matchedStep, tc.step)
+			}
+		})
+	}
+
+	for _, code := range []string{"", "12345", "1234567", "abcdef"} {
+		if _, ok := twoFactor.MatchCode(secret, code, now); ok {
+			t.Errorf("MatchCode(%q) matched", code)
+		}
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := twoFactor.NewRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != twoFactor.RecoveryCodeCount {
+		t.Fatalf("expected %d codes, got %d", twoFactor.RecoveryCodeCount, len(codes))
+	}
+
+	seen := make(map[string]bool)
+	for _, code := range codes {
+		if len(code) != 11 || code[5] != '-' {
+			t.Errorf("code %q isn't formatted like xxxxx-xxxxx", code)
+		}
+
+		normalized := twoFactor.NormalizeRecoveryCode(code)
+		if seen[normalized] {
+			t.Errorf("code %q was generated twice", code)
+		}
+		seen[normalized] = true
+	}
+
+	if twoFactor.NormalizeRecoveryCode(" ABCDE-fghij ") != "abcdefghij" {
+		t.Error("case, dashes and spaces should be ignored")
+	}
+}
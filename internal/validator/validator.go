@@ -50,3 +50,51 @@ func Password(password string) error {
 	}
 	return nil
 }
+
+// reservedUsernames could be mistaken for staff, mentions or the placeholder of deleted users
+var reservedUsernames = [...]string{
+	"admin",
+	"administrator",
+	"moderator",
+	"support",
+	"system",
+	"root",
+	"everyone",
+	"here",
+	"self",
+	"bot",
+	"webhook",
+	"deleted_user",
+	"null",
+	"undefined",
+}
+
+// Username doesn't check if it's taken, usernames are unique regardless of case
+func Username(username string) error {
+	length := len(username)
+	if length < 3 {
+		return fmt.Errorf("short_username")
+	} else if length > 32 {
+		return fmt.Errorf("long_username")
+	}
+
+	if !regexp.MustCompile(`^[a-zA-Z0-9_.]+$`).MatchString(username) {
+		return fmt.Errorf("bad_username_characters")
+	}
+	if strings.HasPrefix(username, ".") || strings.HasSuffix(username, ".") || strings.Contains(username, "..") {
+		return fmt.Errorf("bad_username_format")
+	}
+	// usernames can't look like an ID, as bots, webhooks and older accounts have their ID as username
+	if regexp.MustCompile(`^\d+$`).MatchString(username) {
+		return fmt.Errorf("only_numbers")
+	}
+
+	lowercase := strings.ToLower(username)
+	for i := range len(reservedUsernames) {
+		if lowercase == reservedUsernames[i] {
+			return fmt.Errorf("reserved_username")
+		}
+	}
+
+	return nil
+}
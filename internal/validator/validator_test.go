@@ -197,3 +197,114 @@ func TestPassword(t *testing.T) {
 		})
 	}
 }
+
+func TestUsername(t *testing.T) {
+	tests := []struct {
+		name          string
+		username      string
+		expectedError error
+	}{
+		{
+			name:          "Valid Username: Minimum Length",
+			username:      "abc",
+			expectedError: nil,
+		},
+		{
+			name:          "Valid Username: Maximum Length",
+			username:      "abcdefghijklmnopqrstuvwxyz123456",
+			expectedError: nil,
+		},
+		{
+			name:          "Valid Username: Mixed Case, Dots and Underscores",
+			username:      "John.Doe_42",
+			expectedError: nil,
+		},
+		{
+			name:          "Valid Username: Reserved Name as Part",
+			username:      "admin_fan",
+			expectedError: nil,
+		},
+
+		{
+			name:          "Error: Username Too Short",
+			username:      "ab",
+			expectedError: fmt.Errorf("short_username"),
+		},
+		{
+			name:          "Error: Username Too Long",
+			username:      "abcdefghijklmnopqrstuvwxyz1234567",
+			expectedError: fmt.Errorf("long_username"),
+		},
+
+		{
+			name:          "Error: Space",
+			username:      "john doe",
+			expectedError: fmt.Errorf("bad_username_characters"),
+		},
+		{
+			name:          "Error: At Sign",
+			username:      "john@doe",
+			expectedError: fmt.Errorf("bad_username_characters"),
+		},
+		{
+			name:          "Error: Non-ASCII Letter",
+			username:      "jöhn",
+			expectedError: fmt.Errorf("bad_username_characters"),
+		},
+
+		{
+			name:          "Error: Starting With Dot",
+			username:      ".john",
+			expectedError: fmt.Errorf("bad_username_format"),
+		},
+		{
+			name:          "Error: Ending With Dot",
+			username:      "john.",
+			expectedError: fmt.Errorf("bad_username_format"),
+		},
+		{
+			name:          "Error: Consecutive Dots",
+			username:      "john..doe",
+			expectedError: fmt.Errorf("bad_username_format"),
+		},
+
+		{
+			name:          "Error: Only Numbers",
+			username:      "1561557407828541440",
+			expectedError: fmt.Errorf("only_numbers"),
+		},
+
+		{
+			name:          "Error: Reserved Name",
+			username:      "admin",
+			expectedError: fmt.Errorf("reserved_username"),
+		},
+		{
+			name:          "Error: Reserved Name in Other Case",
+			username:      "Self",
+			expectedError: fmt.Errorf("reserved_username"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validator.Username(tc.username)
+
+			if tc.expectedError == nil {
+				if err != nil {
+					t.Errorf("Username(%q) failed unexpectedly: got error %v, want nil", tc.username, err)
+				}
+				return
+			}
+
+			if err == nil {
+				t.Errorf("Username(%q) passed unexpectedly: got nil, want error %v", tc.username, tc.expectedError)
+				return
+			}
+
+			if err.Error() != tc.expectedError.Error() {
+				t.Errorf("Username(%q) got error %q, want error %q", tc.username, err.Error(), tc.expectedError.Error())
+			}
+		})
+	}
+}
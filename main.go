@@ -1,6 +1,7 @@
 package main
 
 import (
+	"chatapp-backend/internal/accountDeletion"
 	"chatapp-backend/internal/database"
 	"chatapp-backend/internal/email"
 	"chatapp-backend/internal/handlers"
@@ -8,12 +9,18 @@ import (
 	"chatapp-backend/internal/jwt"
 	"chatapp-backend/internal/keyValue"
 	"chatapp-backend/internal/models"
+	"chatapp-backend/internal/outgoingWebhooks"
+	"chatapp-backend/internal/passkey"
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/bwmarrin/snowflake"
 	"github.com/joho/godotenv"
@@ -61,6 +68,21 @@ func setupLogger(cfg *models.ConfigFile) (*zap.SugaredLogger, error) {
 	return sugar, nil
 }
 
+// intEnv returns the integer value of the variable, or the fallback if it's unset,
+// as older .env files don't have every variable
+func intEnv(name string, fallback int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a number, got [%s]", name, value)
+	}
+	return number, nil
+}
+
 func readConfigFile() (*models.ConfigFile, error) {
 	var err error
 	err = godotenv.Load()
@@ -81,11 +103,53 @@ func readConfigFile() (*models.ConfigFile, error) {
 	cfg.LogToFile = os.Getenv("LOG_TO_FILE") == "true"
 	cfg.LogLevel = os.Getenv("LOG_LEVEL")
 	cfg.JwtSecret = os.Getenv("JWT_SECRET")
+	cfg.JwtKeysFile = os.Getenv("JWT_KEYS_FILE")
 	cfg.SnowflakeWorkerID, err = strconv.ParseInt(os.Getenv("SNOWFLAKE_WORKER_ID"), 10, 64)
 	if err != nil {
 		return nil, err
 	}
 
+	cfg.MaxChannelSubscriptions, err = intEnv("MAX_CHANNEL_SUBSCRIPTIONS", 10)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MaxChannelSubscriptions < 1 {
+		return nil, fmt.Errorf("MAX_CHANNEL_SUBSCRIPTIONS must be at least 1, got %d", cfg.MaxChannelSubscriptions)
+	}
+
+	shutdownTimeout, err := intEnv("SHUTDOWN_TIMEOUT", 10)
+	if err != nil {
+		return nil, err
+	}
+	if shutdownTimeout < 0 {
+		return nil, fmt.Errorf("SHUTDOWN_TIMEOUT can't be negative, got %d", shutdownTimeout)
+	}
+	cfg.ShutdownTimeout = time.Duration(shutdownTimeout) * time.Second
+
+	if origins := os.Getenv("ALLOWED_ORIGINS"); origins != "" {
+		for _, origin := range strings.Split(origins, ",") {
+			origin = strings.TrimSpace(origin)
+			if origin != "" {
+				cfg.AllowedOrigins = append(cfg.AllowedOrigins, origin)
+			}
+		}
+	}
+	// unset is no limit, like before the limits existed
+	cfg.MaxSessionsPerUser, err = intEnv("MAX_SESSIONS_PER_USER", 0)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MaxSessionsPerUser < 0 {
+		return nil, fmt.Errorf("MAX_SESSIONS_PER_USER can't be negative, got %d", cfg.MaxSessionsPerUser)
+	}
+	cfg.MaxSessionsPerIP, err = intEnv("MAX_SESSIONS_PER_IP", 0)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MaxSessionsPerIP < 0 {
+		return nil, fmt.Errorf("MAX_SESSIONS_PER_IP can't be negative, got %d", cfg.MaxSessionsPerIP)
+	}
+
 	cfg.UseRedis = os.Getenv("USE_REDIS") == "true"
 
 	cfg.UsePostgres = os.Getenv("USE_POSTGRES") == "true"
@@ -97,6 +161,13 @@ func readConfigFile() (*models.ConfigFile, error) {
 		cfg.DbDatabase = os.Getenv("DB_DATABASE")
 	}
 
+	cfg.AllowPrivateWebhookURLs = os.Getenv("ALLOW_PRIVATE_WEBHOOK_URLS") == "true"
+
+	cfg.PasskeyRPID = os.Getenv("PASSKEY_RP_ID")
+	if cfg.PasskeyRPID == "" {
+		cfg.PasskeyRPID = cfg.HostAddress
+	}
+
 	cfg.UseSmtp = os.Getenv("USE_SMTP") == "true"
 	if cfg.UseSmtp {
 		cfg.SmtpUsername = os.Getenv("SMTP_USERNAME")
@@ -158,7 +229,7 @@ func main() {
 
 	keyValue.Setup(sugar, redisClient, cfg.UseRedis)
 
-	hub.Setup(sugar, redisClient, cfg.UseRedis)
+	hub.Setup(sugar, redisClient, cfg)
 
 	fmt.Printf("Setting up snowflake ID generator using node number %d...\n", cfg.SnowflakeWorkerID)
 	snowflake.Epoch = 1420070400000 // discord epoch to make date extracting compatible
@@ -167,6 +238,9 @@ func main() {
 		sugar.Fatal(err)
 	}
 
+	outgoingWebhooks.Setup(sugar, db, snowflakeNode, cfg.AllowPrivateWebhookURLs)
+	accountDeletion.Setup(sugar, db)
+
 	isHttps := cfg.TlsCert != "" && cfg.TlsKey != ""
 
 	var httpProtocol string
@@ -180,42 +254,99 @@ func main() {
 
 	email.Setup(cfg, fullAddress)
 
-	jwt.Setup(cfg.JwtSecret, isHttps)
+	err = passkey.Setup(cfg.PasskeyRPID, append([]string{fullAddress}, cfg.AllowedOrigins...))
+	if err != nil {
+		sugar.Fatal(err)
+	}
+
+	err = jwt.Setup(cfg.JwtSecret, cfg.JwtKeysFile, isHttps)
+	if err != nil {
+		sugar.Fatal(err)
+	}
 
 	// handling termination
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	exitCode := make(chan int, 1)
 	go func() {
 		sig := <-sigChan
 		sugar.Infof("Received termination signal: %s", sig.String())
 
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+
 		issue := false
-		sugar.Debug("Closing database connection...")
-		err = db.Close()
+
+		// stop accepting new connections, then wait for in-flight requests
+		// in the background while websocket clients are being told to reconnect elsewhere
+		sugar.Debug("Shutting down HTTP server...")
+		httpDone := make(chan error, 1)
+		go func() {
+			httpDone <- handlers.Shutdown(ctx)
+		}()
+
+		sugar.Debug("Disconnecting websocket clients...")
+		err := hub.Shutdown(ctx)
+		if err != nil {
+			sugar.Error(err)
+			issue = true
+		}
+
+		err = <-httpDone
+		if err != nil {
+			sugar.Error(err)
+			issue = true
+		}
+
+		// after the http server, so events of the last requests are still queued
+		sugar.Debug("Waiting for outgoing webhook deliveries...")
+		err = outgoingWebhooks.Shutdown(ctx)
 		if err != nil {
 			sugar.Error(err)
 			issue = true
 		}
 
+		sugar.Debug("Waiting for account deletions...")
+		err = accountDeletion.Shutdown(ctx)
+		if err != nil {
+			sugar.Error(err)
+			issue = true
+		}
+
+		err = sugar.Sync()
+		if err != nil {
+			fmt.Println(err)
+		}
+
+		fmt.Println("Closing database connection...")
+		err = db.Close()
+		if err != nil {
+			fmt.Println(err)
+			issue = true
+		}
+
 		if cfg.UseRedis {
-			sugar.Debug("Closing redis connection...")
+			fmt.Println("Closing redis connection...")
 			err = redisClient.Close()
 			if err != nil {
-				sugar.Error(err)
+				fmt.Println(err)
 				issue = true
 			}
 		}
 
 		if issue {
-			os.Exit(1)
+			exitCode <- 1
+		} else {
+			exitCode <- 0
 		}
-		os.Exit(0)
 	}()
 
 	fmt.Printf("Server is running on %s\n", fullAddress)
 
 	err = handlers.Setup(isHttps, cfg, sugar, db, snowflakeNode)
-	if err != nil {
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		sugar.Fatal(err)
 	}
+
+	os.Exit(<-exitCode)
 }